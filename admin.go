@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jacobbrewer1/uhttp"
+	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/logging"
+)
+
+// adminReadHeaderTimeout is the maximum time to read the headers of a request to the admin server.
+const adminReadHeaderTimeout = 10 * time.Second
+
+// adminAuth only lets through requests holding the admin bearer token.
+func adminAuth(token string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				uhttp.UnauthorizedHandler()(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// getPausesHandler lists the pauses set through the admin endpoint.
+func (a *App) getPausesHandler(w http.ResponseWriter, r *http.Request) {
+	records, err := a.pauses(r.Context())
+	if err != nil {
+		uhttp.GenericErrorHandler(w, r, err)
+		return
+	}
+
+	uhttp.MustEncode(w, http.StatusOK, records)
+}
+
+// pauseHandler pauses unsealing of a target, or every target if none is given.
+func (a *App) pauseHandler(l *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		record := new(pauseRecord)
+		if err := uhttp.DecodeRequestJSON(r, record); err != nil {
+			uhttp.GenericErrorHandler(w, r, err)
+			return
+		}
+		if record.Reason == "" {
+			uhttp.GenericErrorHandler(w, r, errors.New("a reason must be provided"))
+			return
+		}
+		if record.Target != "" && !a.targets.has(record.Target) {
+			uhttp.GenericErrorHandler(w, r, fmt.Errorf("unknown target %q", record.Target))
+			return
+		}
+		record.At = time.Now().UTC()
+
+		if err := a.pause(r.Context(), record); err != nil {
+			uhttp.GenericErrorHandler(w, r, err)
+			return
+		}
+
+		l.Warn("Unsealing paused",
+			slog.String(loggingKeyTarget, record.Target),
+			slog.String(loggingKeyReason, record.Reason),
+		)
+		uhttp.MustEncode(w, http.StatusOK, record)
+	}
+}
+
+// resumeHandler resumes unsealing of a target, or lifts the global pause if no target is given.
+func (a *App) resumeHandler(l *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if err := a.resume(r.Context(), target); err != nil {
+			uhttp.GenericErrorHandler(w, r, err)
+			return
+		}
+
+		l.Warn("Unsealing resumed", slog.String(loggingKeyTarget, target))
+		uhttp.MustSendMessage(w, "resumed")
+	}
+}
+
+// getBreakerHandler lists the trips holding an unseal circuit breaker open.
+func (a *App) getBreakerHandler(w http.ResponseWriter, r *http.Request) {
+	trips, err := a.breaker.Trips(r.Context())
+	if err != nil {
+		uhttp.GenericErrorHandler(w, r, err)
+		return
+	}
+
+	uhttp.MustEncode(w, http.StatusOK, trips)
+}
+
+// resetBreakerHandler closes the circuit breaker of a pod, or the global circuit breaker if no pod is given.
+func (a *App) resetBreakerHandler(l *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pod := r.URL.Query().Get("pod")
+		if err := a.breaker.Reset(r.Context(), pod); err != nil {
+			uhttp.GenericErrorHandler(w, r, err)
+			return
+		}
+
+		l.Warn("Unseal circuit breaker reset", slog.String(loggingKeyPod, pod))
+		uhttp.MustSendMessage(w, "reset")
+	}
+}
+
+// listApprovalsHandler lists every unseal approval request.
+func (a *App) listApprovalsHandler(w http.ResponseWriter, r *http.Request) {
+	requests, err := a.approvals.List(r.Context())
+	if err != nil {
+		uhttp.GenericErrorHandler(w, r, err)
+		return
+	}
+
+	uhttp.MustEncode(w, http.StatusOK, requests)
+}
+
+// getApprovalHandler returns an unseal approval request and the message approvers sign to decide on it. The request
+// ID is unguessable, so this is what the approve links in notifications point to.
+func (a *App) getApprovalHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	request, err := a.approvals.Get(r.Context(), id)
+	if errors.Is(err, errApprovalNotFound) {
+		uhttp.NotFoundHandler()(w, r)
+		return
+	} else if err != nil {
+		uhttp.GenericErrorHandler(w, r, err)
+		return
+	}
+
+	uhttp.MustEncode(w, http.StatusOK, map[string]any{
+		"request": request,
+		"sign": map[string]string{
+			decisionApprove: string(approvalMessage(id, decisionApprove)),
+			decisionDeny:    string(approvalMessage(id, decisionDeny)),
+		},
+	})
+}
+
+// decideApprovalHandler records a signed approval or denial of an unseal approval request. The signature authenticates
+// the request, so no admin token is needed.
+func (a *App) decideApprovalHandler(l *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		decision := new(approvalDecision)
+		if err := uhttp.DecodeRequestJSON(r, decision); err != nil {
+			uhttp.GenericErrorHandler(w, r, err)
+			return
+		}
+
+		request, err := a.approvals.Decide(r.Context(), id, decision)
+		if errors.Is(err, errApprovalNotFound) {
+			uhttp.NotFoundHandler()(w, r)
+			return
+		} else if err != nil {
+			l.Warn("Rejected unseal approval decision",
+				slog.String(loggingKeyApproval, id),
+				slog.String(loggingKeyError, err.Error()),
+			)
+			uhttp.GenericErrorHandler(w, r, err)
+			return
+		}
+
+		l.Warn("Unseal approval decision recorded",
+			slog.String(loggingKeyApproval, id),
+			slog.String(loggingKeyApprover, decision.Approver),
+			slog.String(loggingKeyDecision, decision.Decision),
+		)
+
+		// Unseal the pod straight away rather than at the next reconciliation.
+		if request.Status == approvalApproved {
+			if pod, err := a.base.PodLister().Pods(request.Namespace).Get(request.Pod); err == nil && pod.UID == request.PodUID {
+				a.unsealQueue.Add(pod)
+			}
+		}
+
+		uhttp.MustEncode(w, http.StatusOK, request)
+	}
+}
+
+// deleteApprovalHandler removes an unseal approval request, so a new one is made the next time the pod is found
+// sealed.
+func (a *App) deleteApprovalHandler(l *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if err := a.approvals.Delete(r.Context(), id); errors.Is(err, errApprovalNotFound) {
+			uhttp.NotFoundHandler()(w, r)
+			return
+		} else if err != nil {
+			uhttp.GenericErrorHandler(w, r, err)
+			return
+		}
+
+		l.Warn("Unseal approval request deleted", slog.String(loggingKeyApproval, id))
+		uhttp.MustSendMessage(w, "deleted")
+	}
+}
+
+// withAdminServer starts the admin HTTP server if an admin token or unseal approvals are configured. Every request must
+// hold the token as a bearer token, except for approval decisions, which are signed by the approver instead.
+//
+// Every server registered while the options are applied is started once they all were, so the server is started from
+// a task instead, which runs after the registered servers were started.
+func (a *App) withAdminServer() web.StartOption {
+	return func(base *web.App) error {
+		token, err := valueOrFile(a.config.AdminToken, a.config.AdminTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read admin token: %w", err)
+		}
+		token = strings.TrimSpace(token)
+		if token == "" && a.approvals == nil {
+			return nil
+		}
+
+		l := logging.LoggerWithComponent(base.Logger(), "admin")
+
+		r := mux.NewRouter()
+		if a.approvals != nil {
+			r.HandleFunc("/approvals/{id}", a.getApprovalHandler).Methods(http.MethodGet)
+			r.HandleFunc("/approvals/{id}", a.decideApprovalHandler(l)).Methods(http.MethodPost)
+		}
+
+		if token != "" {
+			admin := r.NewRoute().Subrouter()
+			admin.Use(adminAuth(token))
+			admin.HandleFunc("/pause", a.getPausesHandler).Methods(http.MethodGet)
+			admin.HandleFunc("/pause", a.pauseHandler(l)).Methods(http.MethodPut)
+			admin.HandleFunc("/pause", a.resumeHandler(l)).Methods(http.MethodDelete)
+			if a.breaker != nil {
+				admin.HandleFunc("/breaker", a.getBreakerHandler).Methods(http.MethodGet)
+				admin.HandleFunc("/breaker", a.resetBreakerHandler(l)).Methods(http.MethodDelete)
+			}
+			if a.approvals != nil {
+				admin.HandleFunc("/approvals", a.listApprovalsHandler).Methods(http.MethodGet)
+				admin.HandleFunc("/approvals/{id}", a.deleteApprovalHandler(l)).Methods(http.MethodDelete)
+			}
+		}
+
+		srv := &http.Server{
+			Addr:              a.config.AdminAddr,
+			Handler:           r,
+			ReadHeaderTimeout: adminReadHeaderTimeout,
+		}
+		return web.WithIndefiniteAsyncTask("admin-server", func(ctx context.Context) {
+			if err := base.StartServer("admin", srv); err != nil {
+				l.Error("Error starting admin server", slog.String(loggingKeyError, err.Error()))
+				return
+			}
+			<-ctx.Done()
+		})(base)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobbrewer1/web"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a buffer that can be written to by several goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// freeAddr returns a local address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	addr := lis.Addr().String()
+	if err := lis.Close(); err != nil {
+		t.Fatalf("error closing listener: %v", err)
+	}
+	return addr
+}
+
+func TestWithAdminServer_StartsOnce(t *testing.T) {
+	t.Parallel()
+
+	logs := new(syncBuffer)
+	base, err := web.NewApp(slog.New(slog.NewJSONHandler(logs, nil)))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	addr := freeAddr(t)
+	a := &App{
+		config: &AppConfig{AdminAddr: addr, AdminToken: "token"},
+		base:   base,
+	}
+	if !assert.NoError(t, base.Start(web.WithMetricsEnabled(false), a.withAdminServer())) {
+		return
+	}
+
+	// Requests without the token are refused, which needs the server to be up.
+	assert.Eventually(t, func() bool {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://"+addr+"/pause", http.NoBody)
+		if err != nil {
+			return false
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode == http.StatusUnauthorized
+	}, 5*time.Second, 10*time.Millisecond)
+
+	base.Shutdown()
+
+	var listening, closed int
+	for line := range strings.Lines(logs.String()) {
+		if !strings.Contains(line, `"server":"admin"`) {
+			continue
+		}
+		switch {
+		case strings.Contains(line, `"msg":"server listening"`):
+			listening++
+		case strings.Contains(line, `"msg":"server closed"`):
+			closed++
+		}
+	}
+	assert.Equal(t, 1, listening, logs.String())
+	assert.Zero(t, closed, logs.String())
+}
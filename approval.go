@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jacobbrewer1/web"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// stateApprovalsKey is the key in the state ConfigMap holding the unseal approval requests.
+	stateApprovalsKey = "approvals"
+
+	// defaultApprovalTimeout is how long an approval request waits for approvals when none is configured.
+	defaultApprovalTimeout = time.Hour
+
+	// approvalPending is the status of a request still waiting for approvals.
+	approvalPending = "pending"
+
+	// approvalApproved is the status of a request approved by enough approvers.
+	approvalApproved = "approved"
+
+	// approvalDenied is the status of a request denied by an approver.
+	approvalDenied = "denied"
+
+	// approvalExpired is the status of a request that was not approved in time.
+	approvalExpired = "expired"
+
+	// decisionApprove approves an unseal.
+	decisionApprove = "approve"
+
+	// decisionDeny denies an unseal.
+	decisionDeny = "deny"
+
+	// skipPendingApproval is the skip reason when the unseal of the pod is waiting for approval.
+	skipPendingApproval = "pending_approval"
+
+	// skipApprovalDenied is the skip reason when the unseal of the pod was denied.
+	skipApprovalDenied = "approval_denied"
+
+	// skipApprovalExpired is the skip reason when the unseal of the pod was not approved in time.
+	skipApprovalExpired = "approval_expired"
+
+	// severityApproval marks notifications asking a human to approve an unseal.
+	severityApproval = "approval"
+)
+
+var (
+	// errApprovalNotFound is returned when there is no approval request with the given ID.
+	errApprovalNotFound = errors.New("approval request not found")
+
+	// errApprovalResolved is returned when a decision is made on a request that is no longer pending.
+	errApprovalResolved = errors.New("approval request is no longer pending")
+)
+
+type (
+	// approvalConfig is the configuration of the unseal approval workflow in the configuration file.
+	approvalConfig struct {
+		Required  int               `mapstructure:"required"`
+		Timeout   time.Duration     `mapstructure:"timeout"`
+		URL       string            `mapstructure:"url"`
+		Approvers []*approverConfig `mapstructure:"approvers"`
+	}
+
+	// approverConfig is the configuration of a single operator allowed to approve unseals.
+	approverConfig struct {
+		Name      string `mapstructure:"name"`
+		PublicKey string `mapstructure:"public_key"`
+	}
+
+	// approvals holds off suspicious unseals until enough operators approved them. Every approval and denial is signed
+	// with the ed25519 key of the operator. The requests are kept in the state ConfigMap so every replica shares them.
+	approvals struct {
+		state     *stateStore
+		required  int
+		timeout   time.Duration
+		url       string
+		approvers map[string]ed25519.PublicKey
+	}
+
+	// approvalRequest is a sealed pod waiting for approval to be unsealed.
+	approvalRequest struct {
+		ID          string               `json:"id"`
+		Target      string               `json:"target"`
+		Namespace   string               `json:"namespace"`
+		Pod         string               `json:"pod"`
+		PodUID      types.UID            `json:"pod_uid"`
+		Reason      string               `json:"reason"`
+		Required    int                  `json:"required"`
+		RequestedAt time.Time            `json:"requested_at"`
+		ExpiresAt   time.Time            `json:"expires_at"`
+		Approvals   map[string]time.Time `json:"approvals,omitempty"`
+		DeniedBy    string               `json:"denied_by,omitempty"`
+		Status      string               `json:"status,omitempty"`
+	}
+
+	// approvalDecision is a signed approval or denial of a request.
+	approvalDecision struct {
+		Approver  string `json:"approver"`
+		Decision  string `json:"decision"`
+		Signature string `json:"signature"`
+	}
+)
+
+// newApprovals creates the approval workflow from its configuration.
+func newApprovals(state *stateStore, cfg *approvalConfig) (*approvals, error) {
+	if len(cfg.Approvers) == 0 {
+		return nil, errors.New("no approvers provided")
+	}
+
+	a := &approvals{
+		state:     state,
+		required:  cfg.Required,
+		timeout:   cfg.Timeout,
+		url:       strings.TrimSuffix(cfg.URL, "/"),
+		approvers: make(map[string]ed25519.PublicKey, len(cfg.Approvers)),
+	}
+	if a.required == 0 {
+		a.required = 1
+	}
+	if a.required < 0 || a.required > len(cfg.Approvers) {
+		return nil, fmt.Errorf("required approvals must be between 1 and the number of approvers, got %d", a.required)
+	}
+	if a.timeout == 0 {
+		a.timeout = defaultApprovalTimeout
+	}
+
+	for i, approver := range cfg.Approvers {
+		if approver.Name == "" {
+			return nil, fmt.Errorf("approver %d has no name", i)
+		}
+		if _, ok := a.approvers[approver.Name]; ok {
+			return nil, fmt.Errorf("duplicate approver %s", approver.Name)
+		}
+
+		key, err := decodeKey(approver.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("approver %s has an invalid public key: %w", approver.Name, err)
+		}
+		a.approvers[approver.Name] = ed25519.PublicKey(key[:])
+	}
+
+	return a, nil
+}
+
+// approvalMessage returns the message an approver signs to make the decision on the request.
+func approvalMessage(id, decision string) []byte {
+	return []byte(appName + " " + decision + " " + id)
+}
+
+// status returns the status of the request at the given time.
+func (r *approvalRequest) status(now time.Time) string {
+	switch {
+	case r.DeniedBy != "":
+		return approvalDenied
+	case len(r.Approvals) >= r.Required:
+		return approvalApproved
+	case now.After(r.ExpiresAt):
+		return approvalExpired
+	default:
+		return approvalPending
+	}
+}
+
+// load parses the approval requests.
+func (ap *approvals) load(data map[string]string) (map[string]*approvalRequest, error) {
+	requests := make(map[string]*approvalRequest)
+	if value, ok := data[stateApprovalsKey]; ok {
+		if err := json.Unmarshal([]byte(value), &requests); err != nil {
+			return nil, fmt.Errorf("error parsing approval requests: %w", err)
+		}
+	}
+	return requests, nil
+}
+
+// save stores the approval requests.
+func (ap *approvals) save(data map[string]string, requests map[string]*approvalRequest) error {
+	value, err := json.Marshal(requests)
+	if err != nil {
+		return fmt.Errorf("error marshalling approval requests: %w", err)
+	}
+	data[stateApprovalsKey] = string(value)
+	return nil
+}
+
+// Request returns the approval request for the pod, creating it if there is none. Requests of pods that no longer
+// exist, as reported by exists, are dropped.
+func (ap *approvals) Request(
+	ctx context.Context,
+	target *vaultTarget,
+	pod *core.Pod,
+	reason string,
+	exists func(namespace, name string, uid types.UID) bool,
+) (request *approvalRequest, created bool, err error) {
+	err = ap.state.Update(ctx, func(data map[string]string) error {
+		request, created = nil, false
+
+		requests, err := ap.load(data)
+		if err != nil {
+			return err
+		}
+
+		changed := false
+		for id, r := range requests {
+			if r.PodUID == pod.UID {
+				request = r
+			} else if !exists(r.Namespace, r.Pod, r.PodUID) {
+				delete(requests, id)
+				changed = true
+			}
+		}
+
+		if request == nil {
+			id := make([]byte, 16)
+			if _, err := rand.Read(id); err != nil {
+				return fmt.Errorf("error generating approval request id: %w", err)
+			}
+
+			now := time.Now().UTC()
+			request = &approvalRequest{
+				ID:          hex.EncodeToString(id),
+				Target:      target.name,
+				Namespace:   pod.Namespace,
+				Pod:         pod.Name,
+				PodUID:      pod.UID,
+				Reason:      reason,
+				Required:    ap.required,
+				RequestedAt: now,
+				ExpiresAt:   now.Add(ap.timeout),
+			}
+			requests[request.ID] = request
+			created, changed = true, true
+		}
+
+		if !changed {
+			return errStateUnchanged
+		}
+		return ap.save(data, requests)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	request.Status = request.status(time.Now())
+	return request, created, nil
+}
+
+// Decide records the signed decision of an approver on the request, returning the updated request.
+func (ap *approvals) Decide(ctx context.Context, id string, decision *approvalDecision) (*approvalRequest, error) {
+	key, ok := ap.approvers[decision.Approver]
+	if !ok {
+		return nil, fmt.Errorf("unknown approver %q", decision.Approver)
+	}
+	if decision.Decision != decisionApprove && decision.Decision != decisionDeny {
+		return nil, fmt.Errorf("unknown decision %q", decision.Decision)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(decision.Signature)
+	if err != nil || !ed25519.Verify(key, approvalMessage(id, decision.Decision), signature) {
+		return nil, errors.New("invalid signature")
+	}
+
+	var request *approvalRequest
+	err = ap.state.Update(ctx, func(data map[string]string) error {
+		requests, err := ap.load(data)
+		if err != nil {
+			return err
+		}
+
+		request = requests[id]
+		if request == nil {
+			return errApprovalNotFound
+		}
+		if request.status(time.Now()) != approvalPending {
+			return errApprovalResolved
+		}
+
+		if decision.Decision == decisionDeny {
+			request.DeniedBy = decision.Approver
+		} else {
+			if request.Approvals == nil {
+				request.Approvals = make(map[string]time.Time)
+			}
+			request.Approvals[decision.Approver] = time.Now().UTC()
+		}
+		return ap.save(data, requests)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	request.Status = request.status(time.Now())
+	return request, nil
+}
+
+// Get returns the approval request with the given ID.
+func (ap *approvals) Get(ctx context.Context, id string) (*approvalRequest, error) {
+	data, err := ap.state.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	requests, err := ap.load(data)
+	if err != nil {
+		return nil, err
+	}
+
+	request := requests[id]
+	if request == nil {
+		return nil, errApprovalNotFound
+	}
+	request.Status = request.status(time.Now())
+	return request, nil
+}
+
+// List returns every approval request, oldest first.
+func (ap *approvals) List(ctx context.Context) ([]*approvalRequest, error) {
+	data, err := ap.state.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	requests, err := ap.load(data)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	list := slices.SortedFunc(maps.Values(requests), func(a, b *approvalRequest) int {
+		return a.RequestedAt.Compare(b.RequestedAt)
+	})
+	for _, r := range list {
+		r.Status = r.status(now)
+	}
+	return list, nil
+}
+
+// Delete removes the approval request with the given ID, so a new one is made the next time the pod is found sealed.
+func (ap *approvals) Delete(ctx context.Context, id string) error {
+	return ap.state.Update(ctx, func(data map[string]string) error {
+		requests, err := ap.load(data)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := requests[id]; !ok {
+			return errApprovalNotFound
+		}
+		delete(requests, id)
+		return ap.save(data, requests)
+	})
+}
+
+// Complete removes the approved request of the pod once it was unsealed, so the next suspicious seal of the pod needs
+// a new approval.
+func (ap *approvals) Complete(ctx context.Context, pod *core.Pod) error {
+	if ap == nil {
+		return nil
+	}
+
+	return ap.state.Update(ctx, func(data map[string]string) error {
+		requests, err := ap.load(data)
+		if err != nil {
+			return err
+		}
+
+		n := len(requests)
+		maps.DeleteFunc(requests, func(_ string, r *approvalRequest) bool {
+			return r.PodUID == pod.UID
+		})
+		if len(requests) == n {
+			return errStateUnchanged
+		}
+		return ap.save(data, requests)
+	})
+}
+
+// link returns the link to the approval request, or an empty string if no URL is configured.
+func (ap *approvals) link(id string) string {
+	if ap.url == "" {
+		return ""
+	}
+	return ap.url + "/approvals/" + id
+}
+
+// approvalReason returns why unsealing the pod needs approval, or an empty string if it does not.
+func approvalReason(target *vaultTarget, pod *core.Pod) string {
+	if target.inPlaceSeal == inPlaceSealApprove && isInPlaceSeal(pod) {
+		return "vault was sealed without restarting, e.g. by an operator"
+	}
+	if target.attestation.unknownImage == unknownImageApprove {
+		if err := target.attestation.attestImage(pod); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// checkApproval checks if unsealing the pod was approved, requesting approval if it has not been asked for yet. Pods
+// that are not approved are skipped.
+func (a *App) checkApproval(
+	ctx context.Context,
+	l *slog.Logger,
+	target *vaultTarget,
+	pod *core.Pod,
+	reason string,
+) (bool, error) {
+	request, created, err := a.approvals.Request(ctx, target, pod, reason, a.podExists)
+	if err != nil {
+		return false, err
+	}
+
+	l = l.With(slog.String(loggingKeyApproval, request.ID))
+	if created {
+		a.requestApproval(ctx, l, target, pod, request)
+	}
+
+	switch request.Status {
+	case approvalApproved:
+		l.Info("Unseal approved", slog.Any(loggingKeyApprovers, slices.Sorted(maps.Keys(request.Approvals))))
+		return true, nil
+	case approvalDenied:
+		a.skipPod(l, target, pod, &unsealSkip{
+			reason:  skipApprovalDenied,
+			message: "unseal denied by " + request.DeniedBy,
+		})
+	case approvalExpired:
+		a.skipPod(l, target, pod, &unsealSkip{
+			reason:  skipApprovalExpired,
+			message: "unseal was not approved before " + request.ExpiresAt.Format(time.RFC3339),
+		})
+	default:
+		a.skipPod(l, target, pod, &unsealSkip{
+			reason:  skipPendingApproval,
+			message: fmt.Sprintf("waiting for approval (%d/%d): %s", len(request.Approvals), request.Required, reason),
+		})
+	}
+	return false, nil
+}
+
+// requestApproval asks the approvers to approve the unseal of the pod.
+func (a *App) requestApproval(
+	ctx context.Context,
+	l *slog.Logger,
+	target *vaultTarget,
+	pod *core.Pod,
+	request *approvalRequest,
+) {
+	l.Warn("Unseal needs approval", slog.String(loggingKeyReason, request.Reason))
+	a.events.Eventf(pod, core.EventTypeWarning, eventUnsealPendingApproval,
+		"Waiting for %d approvals to unseal: %s", request.Required, request.Reason)
+
+	event := newUnsealEvent(target, pod, 0, request.RequestedAt)
+	event.Severity = severityApproval
+	event.ApprovalURL = a.approvals.link(request.ID)
+	event.Error = fmt.Sprintf("%d approvals needed before %s, %s", request.Required,
+		request.ExpiresAt.Format(time.RFC3339), request.Reason)
+	if event.ApprovalURL != "" {
+		event.Error += ", approve at " + event.ApprovalURL
+	} else {
+		event.Error += ", approval request " + request.ID
+	}
+	notify(ctx, l, target, event)
+}
+
+// podExists checks if the pod with the given UID still exists.
+func (a *App) podExists(namespace, name string, uid types.UID) bool {
+	pod, err := a.base.PodLister().Pods(namespace).Get(name)
+	return err == nil && pod.UID == uid
+}
+
+// withApprovals sets up the approval workflow if it is configured, and checks every target that needs approvals can
+// get them.
+func (a *App) withApprovals() web.StartOption {
+	return func(base *web.App) error {
+		vip := base.Viper()
+		if vip.IsSet("approval") {
+			cfg := new(approvalConfig)
+			if err := vip.UnmarshalKey("approval", cfg); err != nil {
+				return fmt.Errorf("failed to parse approval: %w", err)
+			}
+
+			approvals, err := newApprovals(a.state, cfg)
+			if err != nil {
+				return fmt.Errorf("invalid approval: %w", err)
+			}
+			a.approvals = approvals
+		}
+
+		for _, t := range a.targets {
+			if a.approvals == nil && t.needsApproval() {
+				return fmt.Errorf("target %s needs approvals but no approval is configured", t.name)
+			}
+		}
+		return nil
+	}
+}
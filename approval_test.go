@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testApprover is an approver with the key it signs decisions with.
+type testApprover struct {
+	name string
+	key  ed25519.PrivateKey
+}
+
+// newTestApprover generates a key pair for the approver.
+func newTestApprover(t *testing.T, name string) *testApprover {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	return &testApprover{name: name, key: key}
+}
+
+// config returns the configuration of the approver.
+func (a *testApprover) config() *approverConfig {
+	publicKey, _ := a.key.Public().(ed25519.PublicKey)
+	return &approverConfig{Name: a.name, PublicKey: base64.StdEncoding.EncodeToString(publicKey)}
+}
+
+// sign returns the signed decision of the approver on the request.
+func (a *testApprover) sign(id, decision string) *approvalDecision {
+	return &approvalDecision{
+		Approver:  a.name,
+		Decision:  decision,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(a.key, approvalMessage(id, decision))),
+	}
+}
+
+// seedApprovalRequests stores the approval requests in the state store.
+func seedApprovalRequests(t *testing.T, store *stateStore, requests ...*approvalRequest) {
+	t.Helper()
+
+	byID := make(map[string]*approvalRequest, len(requests))
+	for _, r := range requests {
+		byID[r.ID] = r
+	}
+	value, err := json.Marshal(byID)
+	if err != nil {
+		t.Fatalf("error marshalling approval requests: %v", err)
+	}
+	err = store.Update(context.Background(), func(data map[string]string) error {
+		data[stateApprovalsKey] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error seeding approval requests: %v", err)
+	}
+}
+
+func TestApprovals_Decide(t *testing.T) {
+	t.Parallel()
+
+	alice := newTestApprover(t, "alice")
+	bob := newTestApprover(t, "bob")
+	mallory := newTestApprover(t, "mallory")
+
+	const (
+		pending  = "pending"
+		expired  = "expired"
+		denied   = "denied"
+		approved = "approved"
+	)
+	now := time.Now().UTC()
+	requests := []*approvalRequest{
+		{ID: pending, Required: 2, RequestedAt: now, ExpiresAt: now.Add(time.Hour)},
+		{ID: expired, Required: 2, RequestedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)},
+		{ID: denied, Required: 2, RequestedAt: now, ExpiresAt: now.Add(time.Hour), DeniedBy: "bob"},
+		{
+			ID:          approved,
+			Required:    1,
+			RequestedAt: now,
+			ExpiresAt:   now.Add(time.Hour),
+			Approvals:   map[string]time.Time{"bob": now},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		id            string
+		decision      func() *approvalDecision
+		wantStatus    string
+		wantApprovals []string
+		wantErr       string
+	}{
+		{
+			name:          "approve",
+			id:            pending,
+			decision:      func() *approvalDecision { return alice.sign(pending, decisionApprove) },
+			wantStatus:    approvalPending,
+			wantApprovals: []string{"alice"},
+		},
+		{
+			name:       "deny",
+			id:         pending,
+			decision:   func() *approvalDecision { return alice.sign(pending, decisionDeny) },
+			wantStatus: approvalDenied,
+		},
+		{
+			name:     "unknown approver",
+			id:       pending,
+			decision: func() *approvalDecision { return mallory.sign(pending, decisionApprove) },
+			wantErr:  `unknown approver "mallory"`,
+		},
+		{
+			name: "unknown decision",
+			id:   pending,
+			decision: func() *approvalDecision {
+				return alice.sign(pending, "abstain")
+			},
+			wantErr: `unknown decision "abstain"`,
+		},
+		{
+			name: "signed by another approver",
+			id:   pending,
+			decision: func() *approvalDecision {
+				decision := bob.sign(pending, decisionApprove)
+				decision.Approver = alice.name
+				return decision
+			},
+			wantErr: "invalid signature",
+		},
+		{
+			name: "signature of another request",
+			id:   pending,
+			decision: func() *approvalDecision {
+				return alice.sign(expired, decisionApprove)
+			},
+			wantErr: "invalid signature",
+		},
+		{
+			name: "signature of another decision",
+			id:   pending,
+			decision: func() *approvalDecision {
+				decision := alice.sign(pending, decisionDeny)
+				decision.Decision = decisionApprove
+				return decision
+			},
+			wantErr: "invalid signature",
+		},
+		{
+			name: "malformed signature",
+			id:   pending,
+			decision: func() *approvalDecision {
+				decision := alice.sign(pending, decisionApprove)
+				decision.Signature = "not base64"
+				return decision
+			},
+			wantErr: "invalid signature",
+		},
+		{
+			name:     "expired",
+			id:       expired,
+			decision: func() *approvalDecision { return alice.sign(expired, decisionApprove) },
+			wantErr:  errApprovalResolved.Error(),
+		},
+		{
+			name:     "already denied",
+			id:       denied,
+			decision: func() *approvalDecision { return alice.sign(denied, decisionApprove) },
+			wantErr:  errApprovalResolved.Error(),
+		},
+		{
+			name:     "already approved",
+			id:       approved,
+			decision: func() *approvalDecision { return alice.sign(approved, decisionDeny) },
+			wantErr:  errApprovalResolved.Error(),
+		},
+		{
+			name:     "not found",
+			id:       "missing",
+			decision: func() *approvalDecision { return alice.sign("missing", decisionApprove) },
+			wantErr:  errApprovalNotFound.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			store, _ := newTestStateStore(t)
+			seedApprovalRequests(t, store, requests...)
+
+			ap, err := newApprovals(store, &approvalConfig{
+				Required:  2,
+				Approvers: []*approverConfig{alice.config(), bob.config()},
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			request, err := ap.Decide(context.Background(), tt.id, tt.decision())
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.wantStatus, request.Status)
+
+			var gotApprovals []string
+			for approver := range request.Approvals {
+				gotApprovals = append(gotApprovals, approver)
+			}
+			assert.Equal(t, tt.wantApprovals, gotApprovals)
+		})
+	}
+}
+
+func TestApprovals_Decide_Replay(t *testing.T) {
+	t.Parallel()
+
+	alice := newTestApprover(t, "alice")
+	bob := newTestApprover(t, "bob")
+
+	store, _ := newTestStateStore(t)
+	now := time.Now().UTC()
+	seedApprovalRequests(t, store, &approvalRequest{
+		ID:          "request",
+		Required:    2,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(time.Hour),
+	})
+
+	ap, err := newApprovals(store, &approvalConfig{
+		Required:  2,
+		Approvers: []*approverConfig{alice.config(), bob.config()},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+
+	// Replaying the approval of an approver does not count it twice.
+	decision := alice.sign("request", decisionApprove)
+	for range 2 {
+		request, err := ap.Decide(ctx, "request", decision)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, approvalPending, request.Status)
+		assert.Len(t, request.Approvals, 1)
+	}
+
+	request, err := ap.Decide(ctx, "request", bob.sign("request", decisionApprove))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, approvalApproved, request.Status)
+
+	// Once resolved, replaying an approval is rejected.
+	_, err = ap.Decide(ctx, "request", decision)
+	assert.ErrorIs(t, err, errApprovalResolved)
+}
+
+func TestNewApprovals(t *testing.T) {
+	t.Parallel()
+
+	alice := newTestApprover(t, "alice").config()
+
+	tests := []struct {
+		name    string
+		cfg     *approvalConfig
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			cfg:  &approvalConfig{Approvers: []*approverConfig{alice}},
+		},
+		{
+			name:    "no approvers",
+			cfg:     &approvalConfig{},
+			wantErr: "no approvers provided",
+		},
+		{
+			name:    "more required than approvers",
+			cfg:     &approvalConfig{Required: 2, Approvers: []*approverConfig{alice}},
+			wantErr: "required approvals must be between 1 and the number of approvers, got 2",
+		},
+		{
+			name:    "duplicate approver",
+			cfg:     &approvalConfig{Approvers: []*approverConfig{alice, alice}},
+			wantErr: "duplicate approver alice",
+		},
+		{
+			name:    "invalid public key",
+			cfg:     &approvalConfig{Approvers: []*approverConfig{{Name: "bob", PublicKey: "c2hvcnQ="}}},
+			wantErr: "approver bob has an invalid public key: invalid key length 5, expected 32",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ap, err := newApprovals(nil, tt.cfg)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, 1, ap.required)
+				assert.Equal(t, defaultApprovalTimeout, ap.timeout)
+			}
+		})
+	}
+}
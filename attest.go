@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+type (
+	// attestationConfig is the configuration of how a target verifies a pod is genuinely its Vault.
+	attestationConfig struct {
+		StatefulSet        string   `mapstructure:"stateful_set"`
+		ServiceAccount     string   `mapstructure:"service_account"`
+		ImageDigests       []string `mapstructure:"image_digests"`
+		TLSPublicKeySHA256 []string `mapstructure:"tls_public_key_sha256"`
+		UnknownImage       string   `mapstructure:"unknown_image"`
+	}
+
+	// attestation describes what a pod must look like before it is given unseal keys. Empty fields are not checked.
+	attestation struct {
+		// statefulSet is the name of the StatefulSet that must own the pod.
+		statefulSet string
+
+		// serviceAccount is the service account the pod must run as.
+		serviceAccount string
+
+		// imageDigests are the digests the Vault container image must match one of.
+		imageDigests []string
+
+		// publicKeyPins are the base64 encoded SHA-256 hashes of the public keys the Vault server certificate must
+		// match one of.
+		publicKeyPins []string
+
+		// unknownImage is what to do with pods whose image digest is not allowed, either unknownImageRefuse or
+		// unknownImageApprove.
+		unknownImage string
+	}
+)
+
+const (
+	// unknownImageRefuse refuses to unseal pods running an image digest that is not allowed.
+	unknownImageRefuse = "refuse"
+
+	// unknownImageApprove unseals pods running an image digest that is not allowed once enough operators approved it.
+	unknownImageApprove = "approve"
+)
+
+// newAttestation creates the attestation of a target from its configuration.
+func newAttestation(cfg *attestationConfig) *attestation {
+	if cfg == nil {
+		return &attestation{
+			unknownImage: unknownImageRefuse,
+		}
+	}
+
+	digests := make([]string, 0, len(cfg.ImageDigests))
+	for _, d := range cfg.ImageDigests {
+		if !strings.Contains(d, ":") {
+			d = "sha256:" + d
+		}
+		digests = append(digests, d)
+	}
+
+	att := &attestation{
+		statefulSet:    cfg.StatefulSet,
+		serviceAccount: cfg.ServiceAccount,
+		imageDigests:   digests,
+		publicKeyPins:  cfg.TLSPublicKeySHA256,
+		unknownImage:   cfg.UnknownImage,
+	}
+	if att.unknownImage == "" {
+		att.unknownImage = unknownImageRefuse
+	}
+	return att
+}
+
+// attestPod checks the pod is genuinely a Vault pod of the target. The TLS identity of the server is checked separately
+// on every connection to the pod.
+func (att *attestation) attestPod(ctx context.Context, client kubernetes.Interface, pod *core.Pod) error {
+	if att.serviceAccount != "" && pod.Spec.ServiceAccountName != att.serviceAccount {
+		return fmt.Errorf("pod runs as service account %q, expected %q", pod.Spec.ServiceAccountName, att.serviceAccount)
+	}
+
+	if att.statefulSet != "" {
+		if err := att.attestOwner(ctx, client, pod); err != nil {
+			return err
+		}
+	}
+
+	// An unknown image that needs approval was approved before the pod got this far.
+	if att.unknownImage == unknownImageRefuse {
+		if err := att.attestImage(pod); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// attestImage checks the Vault container of the pod runs an allowed image digest.
+func (att *attestation) attestImage(pod *core.Pod) error {
+	if len(att.imageDigests) == 0 {
+		return nil
+	}
+
+	digest := imageDigest(podImageID(pod))
+	if digest == "" {
+		return errors.New("vault container has no image digest")
+	}
+	if !slices.Contains(att.imageDigests, digest) {
+		return fmt.Errorf("vault container image digest %s is not allowed", digest)
+	}
+	return nil
+}
+
+// attestOwner checks the pod is controlled by the StatefulSet of the attestation, and that the StatefulSet would have
+// created it.
+func (att *attestation) attestOwner(ctx context.Context, client kubernetes.Interface, pod *core.Pod) error {
+	name := att.statefulSet
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "StatefulSet" || owner.Name != name {
+		return fmt.Errorf("pod is not controlled by stateful set %s", name)
+	}
+
+	sts, err := client.AppsV1().StatefulSets(pod.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting stateful set %s: %w", name, err)
+	}
+
+	if sts.UID != owner.UID {
+		return fmt.Errorf("pod is owned by a different stateful set named %s", name)
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(sts.Spec.Selector)
+	if err != nil {
+		return fmt.Errorf("error parsing selector of stateful set %s: %w", name, err)
+	}
+	if !selector.Matches(labels.Set(pod.Labels)) {
+		return fmt.Errorf("pod does not match the selector of stateful set %s", name)
+	}
+
+	if !strings.HasPrefix(pod.Name, name+"-") {
+		return fmt.Errorf("pod name does not belong to stateful set %s", name)
+	}
+
+	return nil
+}
+
+// imageDigest returns the digest of the image ID reported by the kubelet, e.g. "sha256:abc" for
+// "docker.io/hashicorp/vault@sha256:abc".
+func imageDigest(imageID string) string {
+	_, digest, ok := strings.Cut(imageID, "@")
+	if !ok {
+		return ""
+	}
+	return digest
+}
+
+// verifyConnection returns the function that checks the server certificate matches a pinned public key, or nil if no
+// keys are pinned.
+func (att *attestation) verifyConnection() func(tls.ConnectionState) error {
+	if len(att.publicKeyPins) == 0 {
+		return nil
+	}
+
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("vault presented no certificate")
+		}
+
+		sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		if !slices.Contains(att.publicKeyPins, base64.StdEncoding.EncodeToString(sum[:])) {
+			return errors.New("vault certificate public key is not pinned")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	testStatefulSetUID = types.UID("sts-uid")
+	testImageDigest    = "sha256:0123456789abcdef"
+)
+
+// newTestStatefulSetClient creates a Kubernetes client serving the vault StatefulSet in the vault namespace.
+func newTestStatefulSetClient(t *testing.T) kubernetes.Interface {
+	t.Helper()
+
+	sts := &apps.StatefulSet{
+		TypeMeta:   metav1.TypeMeta{Kind: "StatefulSet", APIVersion: "apps/v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "vault", Namespace: "vault", UID: testStatefulSetUID},
+		Spec: apps.StatefulSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "vault"}},
+		},
+	}
+	return newTestKubeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/apis/apps/v1/namespaces/vault/statefulsets/vault" {
+			writeTestObject(w, http.StatusOK, sts)
+			return
+		}
+		writeTestStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+	}))
+}
+
+// attestedPod creates a pod of the vault StatefulSet that passes every attestation check.
+func attestedPod() *core.Pod {
+	pod := testPod("vault-0")
+	pod.Labels = map[string]string{"app": "vault"}
+	pod.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "apps/v1",
+		Kind:       "StatefulSet",
+		Name:       "vault",
+		UID:        testStatefulSetUID,
+		Controller: ptr.To(true),
+	}}
+	pod.Spec.ServiceAccountName = "vault"
+	pod.Spec.Containers = []core.Container{{Name: "vault", Image: "hashicorp/vault:1.15"}}
+	pod.Status.ContainerStatuses = []core.ContainerStatus{{
+		Name:    "vault",
+		ImageID: "docker.io/hashicorp/vault@" + testImageDigest,
+	}}
+	return pod
+}
+
+func TestAttestation_AttestPod(t *testing.T) {
+	t.Parallel()
+
+	client := newTestStatefulSetClient(t)
+	attested := &attestationConfig{
+		StatefulSet:    "vault",
+		ServiceAccount: "vault",
+		ImageDigests:   []string{"0123456789abcdef"},
+	}
+
+	tests := []struct {
+		name    string
+		cfg     *attestationConfig
+		pod     func(pod *core.Pod)
+		wantErr string
+	}{
+		{
+			name: "attested",
+			cfg:  attested,
+		},
+		{
+			name: "nothing checked",
+			pod: func(pod *core.Pod) {
+				pod.OwnerReferences = nil
+				pod.Status.ContainerStatuses = nil
+			},
+		},
+		{
+			name:    "wrong service account",
+			cfg:     attested,
+			pod:     func(pod *core.Pod) { pod.Spec.ServiceAccountName = "default" },
+			wantErr: `pod runs as service account "default", expected "vault"`,
+		},
+		{
+			name:    "no owner",
+			cfg:     attested,
+			pod:     func(pod *core.Pod) { pod.OwnerReferences = nil },
+			wantErr: "pod is not controlled by stateful set vault",
+		},
+		{
+			name:    "owner is not the controller",
+			cfg:     attested,
+			pod:     func(pod *core.Pod) { pod.OwnerReferences[0].Controller = nil },
+			wantErr: "pod is not controlled by stateful set vault",
+		},
+		{
+			name:    "wrong owner kind",
+			cfg:     attested,
+			pod:     func(pod *core.Pod) { pod.OwnerReferences[0].Kind = "ReplicaSet" },
+			wantErr: "pod is not controlled by stateful set vault",
+		},
+		{
+			name:    "wrong owner name",
+			cfg:     attested,
+			pod:     func(pod *core.Pod) { pod.OwnerReferences[0].Name = "vault-other" },
+			wantErr: "pod is not controlled by stateful set vault",
+		},
+		{
+			name:    "owner replaced by another stateful set of the same name",
+			cfg:     attested,
+			pod:     func(pod *core.Pod) { pod.OwnerReferences[0].UID = "other-uid" },
+			wantErr: "pod is owned by a different stateful set named vault",
+		},
+		{
+			name:    "stateful set not found",
+			cfg:     &attestationConfig{StatefulSet: "missing"},
+			pod:     func(pod *core.Pod) { pod.OwnerReferences[0].Name = "missing" },
+			wantErr: "error getting stateful set missing: ",
+		},
+		{
+			name:    "labels not matching the selector",
+			cfg:     attested,
+			pod:     func(pod *core.Pod) { pod.Labels["app"] = "other" },
+			wantErr: "pod does not match the selector of stateful set vault",
+		},
+		{
+			name:    "name not belonging to the stateful set",
+			cfg:     attested,
+			pod:     func(pod *core.Pod) { pod.Name = "other-0" },
+			wantErr: "pod name does not belong to stateful set vault",
+		},
+		{
+			name:    "mismatched image digest",
+			cfg:     attested,
+			pod:     func(pod *core.Pod) { pod.Status.ContainerStatuses[0].ImageID = "hashicorp/vault@sha256:bad" },
+			wantErr: "vault container image digest sha256:bad is not allowed",
+		},
+		{
+			name:    "tag only image before the container started",
+			cfg:     attested,
+			pod:     func(pod *core.Pod) { pod.Status.ContainerStatuses = nil },
+			wantErr: "vault container has no image digest",
+		},
+		{
+			name:    "missing image digest",
+			cfg:     attested,
+			pod:     func(pod *core.Pod) { pod.Status.ContainerStatuses[0].ImageID = "" },
+			wantErr: "vault container has no image digest",
+		},
+		{
+			name: "unknown image left to approval",
+			cfg: &attestationConfig{
+				ImageDigests: []string{"0123456789abcdef"},
+				UnknownImage: unknownImageApprove,
+			},
+			pod: func(pod *core.Pod) { pod.Status.ContainerStatuses[0].ImageID = "hashicorp/vault@sha256:bad" },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			pod := attestedPod()
+			if tt.pod != nil {
+				tt.pod(pod)
+			}
+
+			err := newAttestation(tt.cfg).attestPod(context.Background(), client, pod)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestAttestation_AttestImage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		digests []string
+		image   string
+		imageID string
+		wantErr string
+	}{
+		{
+			name:    "no digests allowed",
+			image:   "hashicorp/vault:1.15",
+			imageID: "",
+		},
+		{
+			name:    "allowed digest",
+			digests: []string{"0123456789abcdef"},
+			imageID: "docker.io/hashicorp/vault@" + testImageDigest,
+		},
+		{
+			name:    "allowed digest with algorithm",
+			digests: []string{"sha512:fedcba"},
+			imageID: "docker.io/hashicorp/vault@sha512:fedcba",
+		},
+		{
+			name:    "one of several digests",
+			digests: []string{"fedcba", "0123456789abcdef"},
+			imageID: "docker.io/hashicorp/vault@" + testImageDigest,
+		},
+		{
+			name:    "mismatched digest",
+			digests: []string{"fedcba"},
+			imageID: "docker.io/hashicorp/vault@" + testImageDigest,
+			wantErr: "vault container image digest " + testImageDigest + " is not allowed",
+		},
+		{
+			name:    "tag only image",
+			digests: []string{"0123456789abcdef"},
+			image:   "hashicorp/vault:1.15",
+			wantErr: "vault container has no image digest",
+		},
+		{
+			name:    "digest in the image of the spec",
+			digests: []string{"0123456789abcdef"},
+			image:   "hashicorp/vault@" + testImageDigest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			pod := testPod("vault-0")
+			pod.Spec.Containers = []core.Container{{Name: "vault", Image: tt.image}}
+			pod.Status.ContainerStatuses = []core.ContainerStatus{{Name: "vault", ImageID: tt.imageID}}
+
+			err := newAttestation(&attestationConfig{ImageDigests: tt.digests}).attestImage(pod)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestImageDigest(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		imageID string
+		want    string
+	}{
+		{imageID: "docker.io/hashicorp/vault@sha256:abc", want: "sha256:abc"},
+		{imageID: "docker-pullable://hashicorp/vault@sha256:abc", want: "sha256:abc"},
+		{imageID: "hashicorp/vault:1.15@sha256:abc", want: "sha256:abc"},
+		{imageID: "hashicorp/vault:1.15"},
+		{imageID: "sha256:abc"},
+		{imageID: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.imageID, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.want, imageDigest(tt.imageID))
+		})
+	}
+}
+
+func TestAttestation_VerifyConnection(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		writeTestObject(w, http.StatusOK, &api.SealStatusResponse{Sealed: true, T: 3, N: 5})
+	}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	// The certificate of the test server is valid for example.com.
+	cert := srv.Certificate()
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+
+	tests := []struct {
+		name       string
+		pins       []string
+		serverName string
+		wantErr    string
+	}{
+		{
+			name:       "no pins",
+			serverName: "example.com",
+		},
+		{
+			name:       "pinned key",
+			pins:       []string{pin},
+			serverName: "example.com",
+		},
+		{
+			name:       "one of several pinned keys",
+			pins:       []string{"b3RoZXI=", pin},
+			serverName: "example.com",
+		},
+		{
+			name:       "key not pinned",
+			pins:       []string{"b3RoZXI="},
+			serverName: "example.com",
+			wantErr:    "vault certificate public key is not pinned",
+		},
+		{
+			name:       "pinned key with a SAN mismatch",
+			pins:       []string{pin},
+			serverName: "vault-0.vault-internal",
+			wantErr:    "x509: certificate is valid for example.com, *.example.com, not vault-0.vault-internal",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			att := newAttestation(&attestationConfig{TLSPublicKeySHA256: tt.pins})
+			if len(tt.pins) == 0 {
+				assert.Nil(t, att.verifyConnection())
+			}
+
+			vc, err := newVaultClient(srv.URL, &api.TLSConfig{
+				CACertBytes:   ca,
+				TLSServerName: tt.serverName,
+			}, att.verifyConnection())
+			if !assert.NoError(t, err) {
+				return
+			}
+			vc.SetMaxRetries(0)
+
+			_, err = vaultSealStatus(context.Background(), vc)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestAttestation_VerifyConnection_NoCertificate(t *testing.T) {
+	t.Parallel()
+
+	verify := newAttestation(&attestationConfig{TLSPublicKeySHA256: []string{"cGlu"}}).verifyConnection()
+	if !assert.NotNil(t, verify) {
+		return
+	}
+	assert.EqualError(t, verify(tls.ConnectionState{}), "vault presented no certificate")
+	assert.EqualError(t, verify(tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{RawSubjectPublicKeyInfo: []byte("other")}},
+	}), "vault certificate public key is not pinned")
+}
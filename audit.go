@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/k8s"
+	"github.com/jacobbrewer1/web/logging"
+	core "k8s.io/api/core/v1"
+)
+
+const (
+	// auditActionIntent is recorded before an unseal key is submitted to a pod, so a key is never released unaudited.
+	auditActionIntent = "intent"
+
+	// auditActionSubmit is recorded when an unseal key was submitted to a pod.
+	auditActionSubmit = "submit"
+
+	// auditActionReset is recorded when the unseal progress of a pod was reset.
+	auditActionReset = "reset"
+
+	// auditActionInit is recorded when a pod was initialized.
+	auditActionInit = "init"
+
+	// auditActionRaftJoin is recorded when a pod was joined to the Raft cluster of the active pod.
+	auditActionRaftJoin = "raft_join"
+
+	// maxAuditEntrySize is the maximum size of a single line in the audit log.
+	maxAuditEntrySize = 1024 * 1024
+
+	// minAuditHMACKeySize is the minimum size of the key the audit log is chained with.
+	minAuditHMACKeySize = 32
+
+	// stateAuditKey is the key in the state ConfigMap holding the last entry of the audit log, which the next entry of
+	// any replica is chained onto.
+	stateAuditKey = "audit"
+
+	// auditRecordTimeout is the maximum time to chain an entry onto the audit log.
+	auditRecordTimeout = 10 * time.Second
+
+	// auditWebhookQueueSize is the number of entries waiting to be forwarded to the webhook, after which no more entries
+	// are recorded.
+	auditWebhookQueueSize = 1000
+
+	// auditWebhookAttempts is the number of times forwarding an entry to the webhook is attempted.
+	auditWebhookAttempts = 5
+
+	// auditWebhookRetryDelay is the delay before the first retry of forwarding an entry, doubled on every retry.
+	auditWebhookRetryDelay = time.Second
+
+	// auditWebhookQueueFull, auditWebhookDelivery and auditWebhookShutdown are the reasons an entry was not forwarded to
+	// the webhook.
+	auditWebhookQueueFull = "queue_full"
+	auditWebhookDelivery  = "delivery"
+	auditWebhookShutdown  = "shutdown"
+)
+
+type (
+	// auditEntry is a single record in the audit log. Every entry holds the hash of the entry before it, so an edited,
+	// removed or reordered entry breaks the chain. The hash is an HMAC, so the chain cannot be rebuilt without the key.
+	auditEntry struct {
+		Sequence  uint64    `json:"seq"`
+		Time      time.Time `json:"time"`
+		Replica   string    `json:"replica"`
+		Action    string    `json:"action"`
+		Target    string    `json:"target"`
+		Namespace string    `json:"namespace"`
+		Pod       string    `json:"pod"`
+		PodUID    string    `json:"pod_uid"`
+		Node      string    `json:"node"`
+		Image     string    `json:"image"`
+		KeyIndex  *int      `json:"key_index,omitempty"`
+		Sealed    *bool     `json:"sealed,omitempty"`
+		Progress  int       `json:"progress"`
+		Threshold int       `json:"threshold"`
+		Error     string    `json:"error,omitempty"`
+		PrevHash  string    `json:"prev_hash"`
+		Hash      string    `json:"hash,omitempty"`
+	}
+
+	// auditLog is an append-only, hash-chained record of every unseal key released to a Vault pod. Every replica
+	// chains its entries onto the last entry in the state ConfigMap, so the replicas share a single chain that continues
+	// across restarts.
+	auditLog struct {
+		l     *slog.Logger
+		key   []byte
+		state *stateStore
+
+		// mu serialises writes so the entries of the replica reach the sinks in the order they were chained.
+		mu sync.Mutex
+
+		file   *os.File
+		stdout io.Writer
+
+		// webhook queues the entries to forward to the webhook, in order.
+		webhook           chan []byte
+		webhookURL        string
+		webhookClient     *http.Client
+		webhookRetryDelay time.Duration
+	}
+)
+
+// newAuditLog creates the audit log, chaining the entries with the given key onto the last entry in the state store. If
+// a file is given, the last entry in the file must have been written with the same key.
+func newAuditLog(
+	l *slog.Logger,
+	key []byte,
+	state *stateStore,
+	path string,
+	stdout bool,
+	webhookURL string,
+) (*auditLog, error) {
+	if len(key) < minAuditHMACKeySize {
+		return nil, fmt.Errorf("audit hmac key must be at least %d bytes", minAuditHMACKeySize)
+	}
+
+	a := &auditLog{
+		l:     l,
+		key:   key,
+		state: state,
+	}
+
+	if path != "" {
+		last, err := lastAuditEntry(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading audit log: %w", err)
+		}
+		if last != nil {
+			if err := a.checkEntry(last); err != nil {
+				return nil, err
+			}
+		}
+
+		a.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600) // nolint:gosec
+		if err != nil {
+			return nil, fmt.Errorf("error opening audit log: %w", err)
+		}
+	}
+
+	if stdout {
+		a.stdout = os.Stdout
+	}
+
+	if webhookURL != "" {
+		a.webhook = make(chan []byte, auditWebhookQueueSize)
+		a.webhookURL = webhookURL
+		a.webhookClient = &http.Client{Timeout: notifyTimeout}
+		a.webhookRetryDelay = auditWebhookRetryDelay
+	}
+
+	return a, nil
+}
+
+// checkEntry checks the entry was written with the key of the audit log.
+func (a *auditLog) checkEntry(entry *auditEntry) error {
+	hash, err := entry.computeHash(a.key)
+	if err != nil {
+		return err
+	} else if !hmac.Equal([]byte(hash), []byte(entry.Hash)) {
+		return errors.New("last audit log entry was not written with the audit hmac key, or has been modified")
+	}
+	return nil
+}
+
+// head returns the last entry of the audit log in the state, or nil if nothing was recorded yet.
+func (a *auditLog) head(data map[string]string) (*auditEntry, error) {
+	value, ok := data[stateAuditKey]
+	if !ok {
+		return nil, nil
+	}
+
+	entry := new(auditEntry)
+	if err := json.Unmarshal([]byte(value), entry); err != nil {
+		return nil, fmt.Errorf("error parsing last audit log entry: %w", err)
+	}
+	if err := a.checkEntry(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// checkHead checks the last entry in the state was written with the key of the audit log, so no replica starts with a
+// key the chain cannot be continued with.
+func (a *auditLog) checkHead(ctx context.Context) error {
+	data, err := a.state.Get(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = a.head(data)
+	return err
+}
+
+// recorder returns the function that records the actions taken while unsealing the pod of the target. A nil audit log
+// records nothing.
+func (a *auditLog) recorder(target *vaultTarget, pod *core.Pod) unsealRecorder {
+	if a == nil {
+		return func(string, int, *api.SealStatusResponse, error) error { return nil }
+	}
+
+	return func(action string, keyIndex int, status *api.SealStatusResponse, err error) error {
+		entry := &auditEntry{
+			Time:      time.Now().UTC(),
+			Replica:   k8s.PodName(),
+			Action:    action,
+			Target:    target.name,
+			Namespace: pod.Namespace,
+			Pod:       pod.Name,
+			PodUID:    string(pod.UID),
+			Node:      pod.Spec.NodeName,
+			Image:     podImageID(pod),
+		}
+		if action == auditActionIntent || action == auditActionSubmit {
+			entry.KeyIndex = &keyIndex
+		}
+		if status != nil {
+			entry.Sealed = &status.Sealed
+			entry.Progress = status.Progress
+			entry.Threshold = status.T
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+
+		if err := a.Record(entry); err != nil {
+			a.l.Error("Error writing audit log entry",
+				slog.String(loggingKeyNamespace, pod.Namespace),
+				slog.String(loggingKeyPod, pod.Name),
+				slog.String(loggingKeyError, err.Error()),
+			)
+			return fmt.Errorf("error recording %s in the audit log: %w", action, err)
+		}
+		return nil
+	}
+}
+
+// Record chains the entry onto the last entry in the state and writes it to every sink. The file is synced before
+// returning, and the entry is queued to be forwarded to the webhook in the background. The entry is refused if the
+// webhook queue is full. An entry that was chained but could not be written leaves a gap in the chain.
+func (a *auditLog) Record(entry *auditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Only Record adds to the queue, so there is room for the entry once chained.
+	if a.webhook != nil && len(a.webhook) == cap(a.webhook) {
+		auditWebhookFailures.WithLabelValues(auditWebhookQueueFull).Inc()
+		return errors.New("audit webhook queue is full")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), auditRecordTimeout)
+	defer cancel()
+
+	var line []byte
+	err := a.state.Update(ctx, func(data map[string]string) error {
+		last, err := a.head(data)
+		if err != nil {
+			return err
+		}
+
+		entry.Sequence, entry.PrevHash, entry.Hash = 0, "", ""
+		if last != nil {
+			entry.Sequence, entry.PrevHash = last.Sequence+1, last.Hash
+		}
+
+		entry.Hash, err = entry.computeHash(a.key)
+		if err != nil {
+			return err
+		}
+
+		line, err = json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("error marshalling audit entry: %w", err)
+		}
+		data[stateAuditKey] = string(line)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error chaining audit entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	if a.file != nil {
+		if _, err := a.file.Write(line); err != nil {
+			return fmt.Errorf("error writing audit log: %w", err)
+		}
+		if err := a.file.Sync(); err != nil {
+			return fmt.Errorf("error syncing audit log: %w", err)
+		}
+	}
+
+	if a.stdout != nil {
+		if _, err := a.stdout.Write(line); err != nil {
+			return fmt.Errorf("error writing audit log to stdout: %w", err)
+		}
+	}
+
+	if a.webhook != nil {
+		a.webhook <- line
+	}
+
+	return nil
+}
+
+// forwardEntries forwards the queued entries to the webhook in the order they were recorded, until the context is
+// done. An entry is retried with backoff, and skipped once every attempt failed, so the entries after it are still
+// forwarded.
+func (a *auditLog) forwardEntries(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			if dropped := len(a.webhook); dropped > 0 {
+				a.l.Error("Audit log entries not forwarded before shutdown", slog.Int(loggingKeyCount, dropped))
+				auditWebhookFailures.WithLabelValues(auditWebhookShutdown).Add(float64(dropped))
+			}
+			return
+		case line := <-a.webhook:
+			if err := a.forwardWithRetry(ctx, line); errors.Is(err, context.Canceled) {
+				auditWebhookFailures.WithLabelValues(auditWebhookShutdown).Inc()
+			} else if err != nil {
+				a.l.Error("Error forwarding audit log entry, skipping it", slog.String(loggingKeyError, err.Error()))
+				auditWebhookFailures.WithLabelValues(auditWebhookDelivery).Inc()
+			}
+		}
+	}
+}
+
+// forwardWithRetry forwards the entry to the webhook, retrying with backoff until it was forwarded or every attempt
+// failed.
+func (a *auditLog) forwardWithRetry(ctx context.Context, line []byte) error {
+	delay := a.webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		reqCtx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		err := a.forward(reqCtx, line)
+		cancel()
+		if err == nil || attempt == auditWebhookAttempts {
+			return err
+		}
+
+		a.l.Warn("Error forwarding audit log entry, retrying",
+			slog.Int(loggingKeyAttempt, attempt),
+			slog.String(loggingKeyError, err.Error()),
+		)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// forward posts the audit entry to the webhook.
+func (a *auditLog) forward(ctx context.Context, line []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.webhookURL, bytes.NewReader(line))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return doNotifyRequest(a.webhookClient, req)
+}
+
+// computeHash returns the HMAC of the entry with the given key, covering every field but the hash itself.
+func (e *auditEntry) computeHash(key []byte) (string, error) {
+	unhashed := *e
+	unhashed.Hash = ""
+
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling audit entry: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// podImageID returns the image digest of the Vault container of the pod, falling back to the image name if the
+// container has not started.
+func podImageID(pod *core.Pod) string {
+	if len(pod.Spec.Containers) == 0 {
+		return ""
+	}
+
+	name := pod.Spec.Containers[0].Name
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == name && status.ImageID != "" {
+			return status.ImageID
+		}
+	}
+	return pod.Spec.Containers[0].Image
+}
+
+// lastAuditEntry returns the last entry of the audit log file, or nil if the file does not exist or is empty.
+func lastAuditEntry(path string) (*auditEntry, error) {
+	f, err := os.Open(path) // nolint:gosec
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint:errcheck
+
+	var last []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxAuditEntrySize)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			last = bytes.Clone(scanner.Bytes())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if last == nil {
+		return nil, nil
+	}
+
+	entry := new(auditEntry)
+	if err := json.Unmarshal(last, entry); err != nil {
+		return nil, fmt.Errorf("error parsing last audit entry: %w", err)
+	}
+	return entry, nil
+}
+
+// verifyAuditLog checks every entry of the audit log is intact, written with the key and chained onto the entry before
+// it. The entries are ordered by sequence first, so the interleaved logs of every replica can be verified together, and
+// an entry found more than once, e.g. in the file and on stdout, is only checked once. Lines that are not audit entries,
+// e.g. the application logs alongside them on stdout, are skipped, which still breaks the chain if an entry was edited
+// into one. The chain must start at the first entry ever written, so removing entries from the start is detected. The
+// chain must contain the entry with the head hash, as removing entries from the end cannot be detected otherwise. The
+// last entry is returned.
+func verifyAuditLog(r io.Reader, key []byte, head string) (*auditEntry, error) {
+	if head == "" {
+		return nil, errors.New("the hash of the latest known entry must be provided, as truncation is undetectable otherwise")
+	}
+
+	type auditLine struct {
+		number int
+		entry  *auditEntry
+	}
+
+	var lines []*auditLine
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxAuditEntrySize)
+	for number := 1; scanner.Scan(); number++ {
+		entry := new(auditEntry)
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil || entry.Hash == "" {
+			continue
+		}
+
+		hash, err := entry.computeHash(key)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number, err)
+		}
+		if !hmac.Equal([]byte(hash), []byte(entry.Hash)) {
+			return nil, fmt.Errorf("line %d: entry has been modified", number)
+		}
+
+		// Entries are written exactly as marshalled, so any other encoding of the same entry has been edited.
+		written, err := json.Marshal(entry)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: error marshalling entry: %w", number, err)
+		}
+		if !bytes.Equal(written, bytes.TrimSpace(scanner.Bytes())) {
+			return nil, fmt.Errorf("line %d: entry has been modified", number)
+		}
+
+		lines = append(lines, &auditLine{number: number, entry: entry})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading audit log: %w", err)
+	}
+
+	if len(lines) == 0 {
+		return nil, errors.New("audit log is empty")
+	}
+
+	slices.SortStableFunc(lines, func(a, b *auditLine) int {
+		return cmp.Compare(a.entry.Sequence, b.entry.Sequence)
+	})
+
+	var (
+		last     *auditEntry
+		seenHead bool
+	)
+	for _, line := range lines {
+		entry := line.entry
+		if last != nil && entry.Sequence == last.Sequence {
+			if entry.Hash != last.Hash {
+				return nil, fmt.Errorf("line %d: another entry has sequence %d, the chain has been forked",
+					line.number, entry.Sequence)
+			}
+			continue
+		}
+
+		wantSeq, wantPrev := uint64(0), ""
+		if last != nil {
+			wantSeq, wantPrev = last.Sequence+1, last.Hash
+		}
+		if entry.Sequence != wantSeq {
+			return nil, fmt.Errorf("line %d: expected sequence %d, got %d", line.number, wantSeq, entry.Sequence)
+		}
+		if entry.PrevHash != wantPrev {
+			return nil, fmt.Errorf("line %d: entry is not chained onto the previous entry", line.number)
+		}
+
+		seenHead = seenHead || entry.Hash == head
+		last = entry
+	}
+
+	if !seenHead {
+		return nil, fmt.Errorf("audit log has been truncated, entry %s not found", head)
+	}
+
+	return last, nil
+}
+
+// withAuditLog sets up the audit log if any audit sink is configured.
+func (a *App) withAuditLog() web.StartOption {
+	return func(base *web.App) error {
+		webhookURL, err := valueOrFile(a.config.AuditWebhookURL, a.config.AuditWebhookURLFile)
+		if err != nil {
+			return fmt.Errorf("failed to read audit webhook url: %w", err)
+		}
+
+		if a.config.AuditLogFile == "" && !a.config.AuditLogStdout && webhookURL == "" {
+			return nil
+		}
+
+		key, err := valueOrFile(a.config.AuditHMACKey, a.config.AuditHMACKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read audit hmac key: %w", err)
+		} else if key == "" {
+			return errors.New("AUDIT_HMAC_KEY or AUDIT_HMAC_KEY_FILE must be set to write the audit log")
+		}
+
+		a.audit, err = newAuditLog(
+			logging.LoggerWithComponent(base.Logger(), "audit"),
+			[]byte(key),
+			a.state,
+			a.config.AuditLogFile,
+			a.config.AuditLogStdout,
+			webhookURL,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create audit log: %w", err)
+		}
+
+		if a.audit.webhook != nil {
+			if err := web.WithIndefiniteAsyncTask("audit-webhook", a.audit.forwardEntries)(base); err != nil {
+				return err
+			}
+		}
+		return web.WithDependencyBootstrap(a.audit.checkHead)(base)
+	}
+}
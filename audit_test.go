@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testAuditKey = []byte("0123456789abcdef0123456789abcdef")
+
+// newTestAuditLog creates an audit log chained through the state store, writing to a new file.
+func newTestAuditLog(t *testing.T, state *stateStore) (*auditLog, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := newAuditLog(slog.New(slog.DiscardHandler), testAuditKey, state, path, false, "")
+	if err != nil {
+		t.Fatalf("error creating audit log: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = a.file.Close()
+	})
+	return a, path
+}
+
+// recordTestEntries records n entries of the pod in the audit log.
+func recordTestEntries(t *testing.T, a *auditLog, pod string, n int) {
+	t.Helper()
+
+	for i := range n {
+		keyIndex := i
+		if err := a.Record(&auditEntry{Action: auditActionSubmit, Pod: pod, KeyIndex: &keyIndex}); err != nil {
+			t.Fatalf("error recording entry: %v", err)
+		}
+	}
+}
+
+// readTestAuditLog returns the lines of the audit log file.
+func readTestAuditLog(t *testing.T, path string) []string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading audit log: %v", err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// writeTestAuditLog writes n entries to a new audit log file, returning the path and the lines of the file.
+func writeTestAuditLog(t *testing.T, n int) (string, []string) {
+	t.Helper()
+
+	state, _ := newTestStateStore(t)
+	a, path := newTestAuditLog(t, state)
+	recordTestEntries(t, a, "vault-0", n)
+	return path, readTestAuditLog(t, path)
+}
+
+// entryHash returns the hash of the audit log line.
+func entryHash(t *testing.T, line string) string {
+	t.Helper()
+
+	entry := new(auditEntry)
+	if err := json.Unmarshal([]byte(line), entry); err != nil {
+		t.Fatalf("error parsing entry: %v", err)
+	}
+	return entry.Hash
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	t.Parallel()
+
+	_, lines := writeTestAuditLog(t, 4)
+	head := entryHash(t, lines[3])
+
+	tests := []struct {
+		name    string
+		lines   func() []string
+		key     []byte
+		head    string
+		wantSeq uint64
+		wantErr string
+	}{
+		{
+			name:    "intact",
+			lines:   func() []string { return lines },
+			head:    head,
+			wantSeq: 3,
+		},
+		{
+			name:    "intact with an earlier head",
+			lines:   func() []string { return lines },
+			head:    entryHash(t, lines[1]),
+			wantSeq: 3,
+		},
+		{
+			name:    "no head",
+			lines:   func() []string { return lines },
+			wantErr: "the hash of the latest known entry must be provided, as truncation is undetectable otherwise",
+		},
+		{
+			name:    "truncated end",
+			lines:   func() []string { return lines[:2] },
+			head:    head,
+			wantErr: "audit log has been truncated, entry " + head + " not found",
+		},
+		{
+			name:    "truncated start",
+			lines:   func() []string { return lines[1:] },
+			head:    head,
+			wantErr: "line 1: expected sequence 0, got 1",
+		},
+		{
+			name:    "removed entry",
+			lines:   func() []string { return []string{lines[0], lines[2], lines[3]} },
+			head:    head,
+			wantErr: "line 2: expected sequence 1, got 2",
+		},
+		{
+			name:    "reordered entries",
+			lines:   func() []string { return []string{lines[0], lines[2], lines[1], lines[3]} },
+			head:    head,
+			wantSeq: 3,
+		},
+		{
+			name:    "duplicated entry",
+			lines:   func() []string { return []string{lines[0], lines[1], lines[1], lines[2], lines[3]} },
+			head:    head,
+			wantSeq: 3,
+		},
+		{
+			name: "application logs in between",
+			lines: func() []string {
+				return []string{
+					lines[0],
+					`{"time":"2024-01-01T00:00:00Z","level":"INFO","msg":"Unsealed pod"}`,
+					lines[1],
+					"panic: not json",
+					lines[2],
+					"",
+					lines[3],
+				}
+			},
+			head:    head,
+			wantSeq: 3,
+		},
+		{
+			name: "tampered field",
+			lines: func() []string {
+				tampered := strings.Replace(lines[1], `"pod":"vault-0"`, `"pod":"vault-1"`, 1)
+				return []string{lines[0], tampered, lines[2], lines[3]}
+			},
+			head:    head,
+			wantErr: "line 2: entry has been modified",
+		},
+		{
+			name: "tampered encoding",
+			lines: func() []string {
+				tampered := strings.Replace(lines[1], `"pod":"vault-0"`, `"pod": "vault-0"`, 1)
+				return []string{lines[0], tampered, lines[2], lines[3]}
+			},
+			head:    head,
+			wantErr: "line 2: entry has been modified",
+		},
+		{
+			name:    "wrong key",
+			lines:   func() []string { return lines },
+			key:     []byte("fedcba9876543210fedcba9876543210"),
+			head:    head,
+			wantErr: "line 1: entry has been modified",
+		},
+		{
+			name:    "empty",
+			lines:   func() []string { return nil },
+			head:    head,
+			wantErr: "audit log is empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			key := tt.key
+			if key == nil {
+				key = testAuditKey
+			}
+
+			log := strings.Join(tt.lines(), "\n")
+			last, err := verifyAuditLog(strings.NewReader(log), key, tt.head)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.wantSeq, last.Sequence)
+			}
+		})
+	}
+}
+
+func TestVerifyAuditLog_RebuiltChain(t *testing.T) {
+	t.Parallel()
+
+	_, lines := writeTestAuditLog(t, 2)
+
+	// Rebuild the chain after editing the first entry, as someone without the key would.
+	rebuilt := new(bytes.Buffer)
+	var prev string
+	for i, line := range lines {
+		entry := new(auditEntry)
+		if !assert.NoError(t, json.Unmarshal([]byte(line), entry)) {
+			return
+		}
+		if i == 0 {
+			entry.Pod = "vault-1"
+		}
+		entry.PrevHash = prev
+
+		hash, err := entry.computeHash([]byte("fedcba9876543210fedcba9876543210"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		entry.Hash = hash
+		prev = hash
+
+		data, err := json.Marshal(entry)
+		if !assert.NoError(t, err) {
+			return
+		}
+		rebuilt.Write(append(data, '\n'))
+	}
+
+	_, err := verifyAuditLog(rebuilt, testAuditKey, prev)
+	assert.EqualError(t, err, "line 1: entry has been modified")
+}
+
+func TestAuditLog_SharedChain(t *testing.T) {
+	t.Parallel()
+
+	// Two replicas, or a replica and its restart, chain onto the same state.
+	state, _ := newTestStateStore(t)
+	a, pathA := newTestAuditLog(t, state)
+	b, pathB := newTestAuditLog(t, state)
+
+	recordTestEntries(t, a, "vault-0", 2)
+	recordTestEntries(t, b, "vault-1", 1)
+	recordTestEntries(t, a, "vault-0", 1)
+
+	linesA := readTestAuditLog(t, pathA)
+	linesB := readTestAuditLog(t, pathB)
+	if !assert.Len(t, linesA, 3) || !assert.Len(t, linesB, 1) {
+		return
+	}
+
+	data, err := state.Get(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	head := entryHash(t, data[stateAuditKey])
+	assert.Equal(t, entryHash(t, linesA[2]), head)
+
+	// The logs of every replica are verified together.
+	merged := strings.Join(append(linesA, linesB...), "\n")
+	last, err := verifyAuditLog(strings.NewReader(merged), testAuditKey, head)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(3), last.Sequence)
+	}
+
+	// The log of a single replica has gaps.
+	_, err = verifyAuditLog(strings.NewReader(strings.Join(linesA, "\n")), testAuditKey, head)
+	assert.EqualError(t, err, "line 3: expected sequence 2, got 3")
+}
+
+func TestVerifyAuditLog_Fork(t *testing.T) {
+	t.Parallel()
+
+	// Replicas that do not share their state each start a chain of their own.
+	stateA, _ := newTestStateStore(t)
+	stateB, _ := newTestStateStore(t)
+	a, pathA := newTestAuditLog(t, stateA)
+	b, pathB := newTestAuditLog(t, stateB)
+	recordTestEntries(t, a, "vault-0", 1)
+	recordTestEntries(t, b, "vault-1", 1)
+
+	lines := append(readTestAuditLog(t, pathA), readTestAuditLog(t, pathB)...)
+	_, err := verifyAuditLog(strings.NewReader(strings.Join(lines, "\n")), testAuditKey, entryHash(t, lines[1]))
+	assert.EqualError(t, err, "line 2: another entry has sequence 0, the chain has been forked")
+}
+
+func TestAuditLog_Webhook(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu       sync.Mutex
+		requests int
+		received []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		// Fail the first two attempts, so the first entry is retried before the rest are forwarded.
+		if requests <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, strings.TrimSpace(string(body)))
+	}))
+	t.Cleanup(srv.Close)
+
+	state, _ := newTestStateStore(t)
+	a, err := newAuditLog(slog.New(slog.DiscardHandler), testAuditKey, state, "", false, srv.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	a.webhookRetryDelay = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.forwardEntries(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	recordTestEntries(t, a, "vault-0", 3)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, line := range received {
+		entry := new(auditEntry)
+		if assert.NoError(t, json.Unmarshal([]byte(line), entry)) {
+			assert.Equal(t, uint64(i), entry.Sequence)
+		}
+	}
+	assert.Equal(t, 5, requests)
+}
+
+func TestAuditLog_WebhookQueueFull(t *testing.T) {
+	t.Parallel()
+
+	state, _ := newTestStateStore(t)
+	a, err := newAuditLog(slog.New(slog.DiscardHandler), testAuditKey, state, "", false, "http://localhost")
+	if !assert.NoError(t, err) {
+		return
+	}
+	a.webhook = make(chan []byte, 1)
+
+	keyIndex := 0
+	assert.NoError(t, a.Record(&auditEntry{Action: auditActionIntent, KeyIndex: &keyIndex}))
+	assert.EqualError(t, a.Record(&auditEntry{Action: auditActionIntent, KeyIndex: &keyIndex}),
+		"audit webhook queue is full")
+
+	// The refused entry is not chained.
+	data, err := state.Get(context.Background())
+	if assert.NoError(t, err) {
+		assert.Equal(t, strings.TrimSpace(string(<-a.webhook)), data[stateAuditKey])
+	}
+}
+
+func TestNewAuditLog_Key(t *testing.T) {
+	t.Parallel()
+
+	path, _ := writeTestAuditLog(t, 1)
+	state, _ := newTestStateStore(t)
+	otherKey := []byte("fedcba9876543210fedcba9876543210")
+
+	_, err := newAuditLog(slog.New(slog.DiscardHandler), otherKey, state, path, false, "")
+	assert.EqualError(t, err, "last audit log entry was not written with the audit hmac key, or has been modified")
+
+	_, err = newAuditLog(slog.New(slog.DiscardHandler), []byte("short"), state, "", true, "")
+	assert.EqualError(t, err, "audit hmac key must be at least 32 bytes")
+
+	// The chain in the state must have been written with the key too.
+	a, _ := newTestAuditLog(t, state)
+	recordTestEntries(t, a, "vault-0", 1)
+	other, err := newAuditLog(slog.New(slog.DiscardHandler), otherKey, state, "", true, "")
+	if assert.NoError(t, err) {
+		assert.EqualError(t, other.checkHead(context.Background()),
+			"last audit log entry was not written with the audit hmac key, or has been modified")
+	}
+}
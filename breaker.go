@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jacobbrewer1/web"
+	core "k8s.io/api/core/v1"
+)
+
+const (
+	// stateBreakerKey is the key in the state ConfigMap holding the state of the unseal circuit breaker.
+	stateBreakerKey = "breaker"
+
+	// breakerScopePod is the scope of a circuit breaker tripped by too many unseals of a single pod.
+	breakerScopePod = "pod"
+
+	// breakerScopeGlobal is the scope of a circuit breaker tripped by too many unseals across every pod.
+	breakerScopeGlobal = "global"
+
+	// skipBreakerOpen is the skip reason when the unseal circuit breaker of the pod is open.
+	skipBreakerOpen = "circuit_breaker"
+
+	// severityCritical marks notifications that need a human to act.
+	severityCritical = "critical"
+)
+
+type (
+	// circuitBreaker stops unsealing once a pod, or every pod together, has been unsealed too often within the window.
+	// A tripped breaker stays open until it is reset through the admin endpoint, or its state is removed from the state
+	// ConfigMap. The state is kept in the state ConfigMap so every replica shares it. Every custody group submits keys to
+	// every pod, so each group only counts its own unseals.
+	circuitBreaker struct {
+		state       *stateStore
+		group       string
+		podLimit    int
+		globalLimit int
+		window      time.Duration
+	}
+
+	// breakerState is the state of the circuit breaker as stored in the state ConfigMap.
+	breakerState struct {
+		Unseals []*breakerUnseal        `json:"unseals,omitempty"`
+		Global  *breakerTrip            `json:"global,omitempty"`
+		Pods    map[string]*breakerTrip `json:"pods,omitempty"`
+	}
+
+	// breakerUnseal records an unseal attempt that released keys to a pod. Nonce is the nonce of the unseal the keys
+	// were added to, if Vault reported one.
+	breakerUnseal struct {
+		Pod   string    `json:"pod"`
+		Group string    `json:"group,omitempty"`
+		Nonce string    `json:"nonce,omitempty"`
+		At    time.Time `json:"at"`
+	}
+
+	// breakerTrip describes why the circuit breaker was tripped.
+	breakerTrip struct {
+		Scope  string    `json:"scope"`
+		Target string    `json:"target"`
+		Pod    string    `json:"pod"`
+		Count  int       `json:"count"`
+		Limit  int       `json:"limit"`
+		Window string    `json:"window"`
+		At     time.Time `json:"at"`
+	}
+)
+
+// newCircuitBreaker creates a circuit breaker allowing podLimit unseals of a single pod and globalLimit unseals across
+// every pod within the window, counting the unseals of the given custody group. A zero limit is not enforced, and nil
+// is returned if neither limit is.
+func newCircuitBreaker(state *stateStore, group string, podLimit, globalLimit int, window time.Duration) *circuitBreaker {
+	if podLimit <= 0 && globalLimit <= 0 {
+		return nil
+	}
+
+	return &circuitBreaker{
+		state:       state,
+		group:       group,
+		podLimit:    podLimit,
+		globalLimit: globalLimit,
+		window:      window,
+	}
+}
+
+// breakerPodID identifies the pod in the circuit breaker state. Pods are identified by name rather than UID, so a pod
+// that is replaced on every crash is still counted as the same pod.
+func breakerPodID(pod *core.Pod) string {
+	return pod.Namespace + "/" + pod.Name
+}
+
+// String returns a human readable description of the trip.
+func (t *breakerTrip) String() string {
+	if t.Scope == breakerScopeGlobal {
+		return fmt.Sprintf("unseal circuit breaker open for every pod after %d unseals within %s, last of pod %s",
+			t.Count, t.Window, t.Pod)
+	}
+	return fmt.Sprintf("unseal circuit breaker open for pod %s after %d unseals within %s", t.Pod, t.Count, t.Window)
+}
+
+// load parses the circuit breaker state, dropping unseals that fell out of the window.
+func (b *circuitBreaker) load(data map[string]string) (*breakerState, error) {
+	state := new(breakerState)
+	if value, ok := data[stateBreakerKey]; ok {
+		if err := json.Unmarshal([]byte(value), state); err != nil {
+			return nil, fmt.Errorf("error parsing circuit breaker state: %w", err)
+		}
+	}
+	if state.Pods == nil {
+		state.Pods = make(map[string]*breakerTrip)
+	}
+
+	cutoff := time.Now().Add(-b.window)
+	state.Unseals = slices.DeleteFunc(state.Unseals, func(u *breakerUnseal) bool {
+		return u.At.Before(cutoff)
+	})
+	return state, nil
+}
+
+// save stores the circuit breaker state.
+func (b *circuitBreaker) save(data map[string]string, state *breakerState) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error marshalling circuit breaker state: %w", err)
+	}
+	data[stateBreakerKey] = string(value)
+	return nil
+}
+
+// Check returns the trip holding the circuit breaker of the pod open, or nil if the pod may be unsealed. The breaker
+// is tripped if unsealing the pod would exceed a limit, in which case tripped is true.
+func (b *circuitBreaker) Check(ctx context.Context, target *vaultTarget, pod *core.Pod) (trip *breakerTrip, tripped bool, err error) {
+	if b == nil {
+		return nil, false, nil
+	}
+
+	id := breakerPodID(pod)
+	err = b.state.Update(ctx, func(data map[string]string) error {
+		trip, tripped = nil, false
+
+		state, err := b.load(data)
+		if err != nil {
+			return err
+		}
+		if state.Global != nil {
+			trip = state.Global
+			return errStateUnchanged
+		}
+		if state.Pods[id] != nil {
+			trip = state.Pods[id]
+			return errStateUnchanged
+		}
+
+		podCount, globalCount := 0, 0
+		for _, u := range state.Unseals {
+			if u.Group != b.group {
+				continue
+			}
+			globalCount++
+			if u.Pod == id {
+				podCount++
+			}
+		}
+
+		trip = &breakerTrip{
+			Target: target.name,
+			Pod:    id,
+			Window: b.window.String(),
+			At:     time.Now().UTC(),
+		}
+		switch {
+		case b.podLimit > 0 && podCount >= b.podLimit:
+			trip.Scope, trip.Count, trip.Limit = breakerScopePod, podCount, b.podLimit
+			state.Pods[id] = trip
+		case b.globalLimit > 0 && globalCount >= b.globalLimit:
+			trip.Scope, trip.Count, trip.Limit = breakerScopeGlobal, globalCount, b.globalLimit
+			state.Global = trip
+		default:
+			trip = nil
+			return errStateUnchanged
+		}
+
+		tripped = true
+		return b.save(data, state)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return trip, tripped, nil
+}
+
+// Record counts an unseal attempt of the pod that released keys towards the limits. Keys submitted again to the unseal
+// with the same nonce, e.g. by a custody group, are part of an unseal that was already counted.
+func (b *circuitBreaker) Record(ctx context.Context, pod *core.Pod, nonce string) error {
+	if b == nil {
+		return nil
+	}
+
+	id := breakerPodID(pod)
+	return b.state.Update(ctx, func(data map[string]string) error {
+		state, err := b.load(data)
+		if err != nil {
+			return err
+		}
+
+		if nonce != "" && slices.ContainsFunc(state.Unseals, func(u *breakerUnseal) bool {
+			return u.Pod == id && u.Group == b.group && u.Nonce == nonce
+		}) {
+			return errStateUnchanged
+		}
+
+		state.Unseals = append(state.Unseals, &breakerUnseal{
+			Pod:   id,
+			Group: b.group,
+			Nonce: nonce,
+			At:    time.Now().UTC(),
+		})
+		return b.save(data, state)
+	})
+}
+
+// Reset closes the circuit breaker of the given pod, in the form namespace/name, or the global circuit breaker if
+// empty. The unseals counted against the breaker are forgotten, so it does not trip again straight away.
+func (b *circuitBreaker) Reset(ctx context.Context, pod string) error {
+	return b.state.Update(ctx, func(data map[string]string) error {
+		state, err := b.load(data)
+		if err != nil {
+			return err
+		}
+
+		if pod == "" {
+			state.Global = nil
+			state.Unseals = nil
+		} else {
+			delete(state.Pods, pod)
+			state.Unseals = slices.DeleteFunc(state.Unseals, func(u *breakerUnseal) bool {
+				return u.Pod == pod
+			})
+		}
+		return b.save(data, state)
+	})
+}
+
+// Trips returns every trip holding a circuit breaker open.
+func (b *circuitBreaker) Trips(ctx context.Context) ([]*breakerTrip, error) {
+	data, err := b.state.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := b.load(data)
+	if err != nil {
+		return nil, err
+	}
+
+	trips := make([]*breakerTrip, 0, len(state.Pods)+1)
+	if state.Global != nil {
+		trips = append(trips, state.Global)
+	}
+	for _, trip := range state.Pods {
+		trips = append(trips, trip)
+	}
+	slices.SortFunc(trips, func(a, b *breakerTrip) int {
+		return strings.Compare(a.Pod, b.Pod)
+	})
+	return trips, nil
+}
+
+// breakerTripped escalates a tripped circuit breaker to humans, as unsealing stops until it is reset.
+func (a *App) breakerTripped(ctx context.Context, l *slog.Logger, target *vaultTarget, pod *core.Pod, trip *breakerTrip) {
+	l.Error("Unseal circuit breaker tripped, unsealing stopped until it is reset",
+		slog.String(loggingKeyReason, trip.String()),
+	)
+	a.events.Eventf(pod, core.EventTypeWarning, eventUnsealCircuitOpen, "Stopped unsealing: %s", trip.String())
+	breakerTrips.WithLabelValues(target.name, pod.Namespace, trip.Scope).Inc()
+
+	event := newUnsealEvent(target, pod, 0, trip.At)
+	event.Severity = severityCritical
+	event.Error = trip.String() + ", reset it through the admin endpoint or the state ConfigMap to resume unsealing"
+	notify(ctx, l, target, event)
+}
+
+// withCircuitBreaker sets up the circuit breaker limiting how often pods are unsealed.
+func (a *App) withCircuitBreaker() web.StartOption {
+	return func(_ *web.App) error {
+		a.breaker = newCircuitBreaker(
+			a.state,
+			a.config.CustodyGroup,
+			a.config.UnsealLimitPerPod,
+			a.config.UnsealLimitGlobal,
+			a.config.UnsealLimitWindow,
+		)
+		return nil
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testBreakerWindow = time.Hour
+
+// testPod creates a pod in the vault namespace with the given name.
+func testPod(name string) *core.Pod {
+	return &core.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "vault"}}
+}
+
+// seedBreakerState stores the circuit breaker state in the state store.
+func seedBreakerState(t *testing.T, store *stateStore, state *breakerState) {
+	t.Helper()
+
+	value, err := json.Marshal(state)
+	if err != nil {
+		t.Fatalf("error marshalling circuit breaker state: %v", err)
+	}
+	err = store.Update(context.Background(), func(data map[string]string) error {
+		data[stateBreakerKey] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error seeding circuit breaker state: %v", err)
+	}
+}
+
+// unsealsAgo creates n unseals of the pod by the group, each the given duration ago.
+func unsealsAgo(pod, group string, n int, ago time.Duration) []*breakerUnseal {
+	unseals := make([]*breakerUnseal, n)
+	for i := range unseals {
+		unseals[i] = &breakerUnseal{Pod: pod, Group: group, At: time.Now().Add(-ago).UTC()}
+	}
+	return unseals
+}
+
+func TestCircuitBreaker_Check(t *testing.T) {
+	t.Parallel()
+
+	const (
+		pod   = "vault/vault-0"
+		other = "vault/vault-1"
+	)
+
+	existingTrip := &breakerTrip{Scope: breakerScopeGlobal, Pod: other, Count: 5, Limit: 5, Window: "1h0m0s"}
+
+	tests := []struct {
+		name        string
+		group       string
+		podLimit    int
+		globalLimit int
+		state       *breakerState
+		wantScope   string
+		wantCount   int
+		wantTripped bool
+	}{
+		{
+			name:     "no unseals",
+			podLimit: 3,
+			state:    &breakerState{},
+		},
+		{
+			name:     "below the pod limit",
+			podLimit: 3,
+			state:    &breakerState{Unseals: unsealsAgo(pod, "", 2, time.Minute)},
+		},
+		{
+			name:        "at the pod limit",
+			podLimit:    3,
+			state:       &breakerState{Unseals: unsealsAgo(pod, "", 3, time.Minute)},
+			wantScope:   breakerScopePod,
+			wantCount:   3,
+			wantTripped: true,
+		},
+		{
+			name:     "unseal just outside the window is dropped",
+			podLimit: 3,
+			state: &breakerState{Unseals: append(
+				unsealsAgo(pod, "", 2, time.Minute),
+				unsealsAgo(pod, "", 1, testBreakerWindow+time.Minute)...,
+			)},
+		},
+		{
+			name:     "unseal just inside the window is counted",
+			podLimit: 3,
+			state: &breakerState{Unseals: append(
+				unsealsAgo(pod, "", 2, time.Minute),
+				unsealsAgo(pod, "", 1, testBreakerWindow-time.Minute)...,
+			)},
+			wantScope:   breakerScopePod,
+			wantCount:   3,
+			wantTripped: true,
+		},
+		{
+			name:     "unseals of other pods do not count towards the pod limit",
+			podLimit: 3,
+			state: &breakerState{Unseals: append(
+				unsealsAgo(pod, "", 2, time.Minute),
+				unsealsAgo(other, "", 5, time.Minute)...,
+			)},
+		},
+		{
+			name:        "unseals of every pod count towards the global limit",
+			podLimit:    3,
+			globalLimit: 4,
+			state: &breakerState{Unseals: append(
+				unsealsAgo(pod, "", 2, time.Minute),
+				unsealsAgo(other, "", 2, time.Minute)...,
+			)},
+			wantScope:   breakerScopeGlobal,
+			wantCount:   4,
+			wantTripped: true,
+		},
+		{
+			name:        "below the global limit",
+			globalLimit: 4,
+			state: &breakerState{Unseals: append(
+				unsealsAgo(pod, "", 1, time.Minute),
+				unsealsAgo(other, "", 2, time.Minute)...,
+			)},
+		},
+		{
+			name:     "unseals of other custody groups are ignored",
+			group:    "group-a",
+			podLimit: 3,
+			state: &breakerState{Unseals: append(
+				unsealsAgo(pod, "group-a", 2, time.Minute),
+				unsealsAgo(pod, "group-b", 3, time.Minute)...,
+			)},
+		},
+		{
+			name:        "unseals of the custody group are counted",
+			group:       "group-a",
+			podLimit:    3,
+			state:       &breakerState{Unseals: unsealsAgo(pod, "group-a", 3, time.Minute)},
+			wantScope:   breakerScopePod,
+			wantCount:   3,
+			wantTripped: true,
+		},
+		{
+			name:      "open global breaker",
+			podLimit:  3,
+			state:     &breakerState{Global: existingTrip},
+			wantScope: breakerScopeGlobal,
+			wantCount: 5,
+		},
+		{
+			name:      "open breaker of the pod",
+			podLimit:  3,
+			state:     &breakerState{Pods: map[string]*breakerTrip{pod: {Scope: breakerScopePod, Pod: pod, Count: 3}}},
+			wantScope: breakerScopePod,
+			wantCount: 3,
+		},
+		{
+			name:     "open breaker of another pod",
+			podLimit: 3,
+			state:    &breakerState{Pods: map[string]*breakerTrip{other: {Scope: breakerScopePod, Pod: other, Count: 3}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			store, _ := newTestStateStore(t)
+			seedBreakerState(t, store, tt.state)
+
+			b := newCircuitBreaker(store, tt.group, tt.podLimit, tt.globalLimit, testBreakerWindow)
+			trip, tripped, err := b.Check(context.Background(), &vaultTarget{name: "vault"}, testPod("vault-0"))
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.wantTripped, tripped)
+			if tt.wantScope == "" {
+				assert.Nil(t, trip)
+				return
+			}
+			if assert.NotNil(t, trip) {
+				assert.Equal(t, tt.wantScope, trip.Scope)
+				assert.Equal(t, tt.wantCount, trip.Count)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker_RecordAndReset(t *testing.T) {
+	t.Parallel()
+
+	store, _ := newTestStateStore(t)
+	b := newCircuitBreaker(store, "", 2, 0, testBreakerWindow)
+	ctx := context.Background()
+	target := &vaultTarget{name: "vault"}
+	pod := testPod("vault-0")
+
+	for range 2 {
+		trip, _, err := b.Check(ctx, target, pod)
+		assert.NoError(t, err)
+		assert.Nil(t, trip)
+		assert.NoError(t, b.Record(ctx, pod, ""))
+	}
+
+	trip, tripped, err := b.Check(ctx, target, pod)
+	assert.NoError(t, err)
+	assert.True(t, tripped)
+	if assert.NotNil(t, trip) {
+		assert.Equal(t, "unseal circuit breaker open for pod vault/vault-0 after 2 unseals within 1h0m0s", trip.String())
+	}
+
+	// The trip is kept, but only reported as tripped once.
+	trip, tripped, err = b.Check(ctx, target, pod)
+	assert.NoError(t, err)
+	assert.False(t, tripped)
+	assert.NotNil(t, trip)
+
+	trips, err := b.Trips(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, trips, 1)
+
+	// Resetting the breaker forgets the unseals of the pod, so it does not trip again straight away.
+	assert.NoError(t, b.Reset(ctx, breakerPodID(pod)))
+	trip, tripped, err = b.Check(ctx, target, pod)
+	assert.NoError(t, err)
+	assert.False(t, tripped)
+	assert.Nil(t, trip)
+}
+
+func TestCircuitBreaker_RecordSameNonce(t *testing.T) {
+	t.Parallel()
+
+	store, _ := newTestStateStore(t)
+	b := newCircuitBreaker(store, "group-a", 2, 0, testBreakerWindow)
+	ctx := context.Background()
+	target := &vaultTarget{name: "vault"}
+	pod := testPod("vault-0")
+
+	// Submitting the keys of the group to the same unseal again is counted once.
+	for range 3 {
+		assert.NoError(t, b.Record(ctx, pod, "nonce-a"))
+	}
+	trip, _, err := b.Check(ctx, target, pod)
+	assert.NoError(t, err)
+	assert.Nil(t, trip)
+
+	// The same nonce of another pod is another unseal.
+	assert.NoError(t, b.Record(ctx, testPod("vault-1"), "nonce-a"))
+	trip, _, err = b.Check(ctx, target, pod)
+	assert.NoError(t, err)
+	assert.Nil(t, trip)
+
+	assert.NoError(t, b.Record(ctx, pod, "nonce-b"))
+	trip, tripped, err := b.Check(ctx, target, pod)
+	assert.NoError(t, err)
+	assert.True(t, tripped)
+	if assert.NotNil(t, trip) {
+		assert.Equal(t, 2, trip.Count)
+	}
+}
+
+func TestNewCircuitBreaker_NoLimits(t *testing.T) {
+	t.Parallel()
+
+	b := newCircuitBreaker(nil, "", 0, 0, testBreakerWindow)
+	assert.Nil(t, b)
+
+	trip, tripped, err := b.Check(context.Background(), &vaultTarget{}, testPod("vault-0"))
+	assert.NoError(t, err)
+	assert.False(t, tripped)
+	assert.Nil(t, trip)
+}
@@ -56,3 +56,121 @@ Create the name of the service account to use
 {{- define "vault-unseal.serviceAccountName" -}}
 {{ include "vault-unseal.name" . }}
 {{- end }}
+
+{{/*
+Create the name of the Secret holding the unseal keys
+*/}}
+{{- define "vault-unseal.unsealKeysSecretName" -}}
+{{- default (printf "%s-unseal-keys" (include "vault-unseal.fullname" .)) .Values.unsealKeysSecret.name }}
+{{- end }}
+
+{{/*
+Create the namespace of the Secret holding the unseal keys
+*/}}
+{{- define "vault-unseal.unsealKeysSecretNamespace" -}}
+{{- default .Release.Namespace .Values.unsealKeysSecret.namespace }}
+{{- end }}
+
+{{/*
+Create the data keys of the Secret holding the unseal keys
+*/}}
+{{- define "vault-unseal.unsealKeysSecretKeys" -}}
+{{- if .Values.unsealKeysSecret.keys }}
+{{- toJson .Values.unsealKeysSecret.keys }}
+{{- else if and .Values.unsealKeysSecret.create (not .Values.custody.groups) }}
+{{- $keys := list }}
+{{- range $i, $_ := .Values.unsealKeys }}
+{{- $keys = append $keys (printf "key-%d" $i) }}
+{{- end }}
+{{- toJson $keys }}
+{{- else }}
+{{- list | toJson }}
+{{- end }}
+{{- end }}
+
+{{/*
+The rules of the Role in the release namespace, for the state the replicas share
+*/}}
+{{- define "vault-unseal.releaseRules" -}}
+- apiGroups: [ "" ]
+  resources: [ "configmaps" ]
+  verbs: [ "get", "create", "update" ]
+{{- if or (eq .Values.sharding.mode "leader-election") (eq .Values.unsealLock.backend "lease") }}
+- apiGroups: [ "coordination.k8s.io" ]
+  resources: [ "leases" ]
+  verbs: [ "get", "create", "update", "delete" ]
+{{- end }}
+{{- if eq .Values.sharding.mode "hash-bucket" }}
+- apiGroups: [ "discovery.k8s.io" ]
+  resources: [ "endpointslices" ]
+  verbs: [ "get" ]
+{{- end }}
+{{- end }}
+
+{{/*
+The rules of the Role in every namespace of the targets, for the Vault pods
+*/}}
+{{- define "vault-unseal.targetRules" -}}
+- apiGroups: [ "" ]
+  resources: [ "pods" ]
+  verbs: [ "get", "list", "watch", "patch" ]
+- apiGroups: [ "" ]
+  resources: [ "services" ]
+  verbs: [ "get" ]
+- apiGroups: [ "" ]
+  resources: [ "events" ]
+  verbs: [ "create", "patch" ]
+- apiGroups: [ "apps" ]
+  resources: [ "statefulsets" ]
+  verbs: [ "get" ]
+{{- end }}
+
+{{/*
+The rules of the ClusterRole, for what cannot be limited to a namespace. Empty if nothing needs it.
+*/}}
+{{- define "vault-unseal.clusterRules" -}}
+{{- if .Values.rbac.clusterWide }}
+- apiGroups: [ "" ]
+  resources: [ "pods" ]
+  verbs: [ "list", "watch" ]
+{{- end }}
+{{- if eq .Values.sharding.mode "hash-bucket" }}
+- apiGroups: [ "discovery.k8s.io" ]
+  resources: [ "endpointslices" ]
+  verbs: [ "list", "watch" ]
+{{- end }}
+{{- end }}
+
+{{/*
+Create the namespaces the Vault pods of the targets are in, as a JSON list
+*/}}
+{{- define "vault-unseal.targetNamespaces" -}}
+{{- $namespaces := list }}
+{{- if .Values.targets }}
+{{- range .Values.targets }}
+{{- $namespaces = append $namespaces .namespace }}
+{{- end }}
+{{- else }}
+{{- $namespaces = append $namespaces .Values.vault.namespace }}
+{{- end }}
+{{- $namespaces | uniq | toJson }}
+{{- end }}
+
+{{/*
+Create the Secrets read through the Secret informers, as a JSON list of the namespace and name of every Secret.
+Custody groups read their own unseal keys Secret instead, see custody-role.yaml.
+*/}}
+{{- define "vault-unseal.informerSecrets" -}}
+{{- $secrets := list }}
+{{- if .Values.targets }}
+{{- range .Values.targets }}
+{{- if not $.Values.custody.groups }}
+{{- with .unseal_keys_secret }}{{ if .name }}{{ $secrets = append $secrets (dict "name" .name "namespace" (default $.Release.Namespace .namespace)) }}{{ end }}{{ end }}
+{{- end }}
+{{- with .tls }}{{ with .ca_secret }}{{ if .name }}{{ $secrets = append $secrets (dict "name" .name "namespace" (default $.Release.Namespace .namespace)) }}{{ end }}{{ end }}{{ end }}
+{{- end }}
+{{- else if not .Values.custody.groups }}
+{{- $secrets = append $secrets (dict "name" (include "vault-unseal.unsealKeysSecretName" .) "namespace" (include "vault-unseal.unsealKeysSecretNamespace" .)) }}
+{{- end }}
+{{- $secrets | uniq | toJson }}
+{{- end }}
@@ -2,35 +2,44 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"strconv"
+	"sync"
 
 	"github.com/jacobbrewer1/web"
 	"github.com/jacobbrewer1/web/cache"
-	"github.com/jacobbrewer1/web/logging"
 	core "k8s.io/api/core/v1"
 	kubeCache "k8s.io/client-go/tools/cache"
 )
 
-// watchVaultPods watches for new pods and distributes them to the correct handler that will determine if it is a
-// Vault pod. If it is, it will attempt to unseal the vault using the unseal keys provided.
+// watchVaultPods watches for new pods and distributes them to the correct handler that will determine which target, if
+// any, the pod belongs to. If it is a Vault pod, it is queued to be unsealed using the keys of that target.
 func (a *App) watchVaultPods(
 	l *slog.Logger,
 ) web.AsyncTaskFunc {
 	return func(ctx context.Context) {
+		synced := make([]kubeCache.InformerSynced, 0, len(a.secretInformers))
+		for _, si := range a.secretInformers {
+			synced = append(synced, si.informer.HasSynced)
+		}
+		if !kubeCache.WaitForCacheSync(ctx.Done(), synced...) {
+			l.Error("Timed out waiting for unseal keys secret cache to sync")
+			return
+		}
+
 		if _, err := a.base.PodInformer().AddEventHandler(kubeCache.ResourceEventHandlerFuncs{
 			AddFunc: newPodHandler(
-				ctx,
-				logging.LoggerWithComponent(l, "new-pod-handler"),
-				a.base.ServiceEndpointHashBucket(),
-				a.config.unsealKeys,
+				a.shard,
+				a.targets,
+				a.unsealQueue,
 			),
 			UpdateFunc: updatePodHandler(
-				ctx,
-				logging.LoggerWithComponent(l, "update-pod-handler"),
-				a.base.ServiceEndpointHashBucket(),
-				a.config.unsealKeys,
+				a.shard,
+				a.targets,
+				a.unsealQueue,
 			),
+			DeleteFunc: deletePodHandler(a.unsealQueue),
 		}); err != nil {
 			l.Error("Error adding event handler", slog.String(loggingKeyError, err.Error()))
 			return
@@ -47,98 +56,189 @@ func (a *App) watchVaultPods(
 	}
 }
 
-// newPodHandler is the handler for new pods. It will check if the pod is a Vault pod and if it is sealed. If it is, it
-// will attempt to unseal the vault using the unseal keys provided.
-func newPodHandler(ctx context.Context, l *slog.Logger, hashBucket cache.HashBucket, unsealKeys []string) func(any) {
-	return func(podObj any) {
-		pod, ok := podObj.(*core.Pod)
-		if !ok {
-			return
+// watchUnsealKeysSecret keeps the cache of every unseal keys Secret up to date so that changes to the Secrets are used
+// for the next unseal without restarting the application.
+func (a *App) watchUnsealKeysSecret(
+	l *slog.Logger,
+) web.AsyncTaskFunc {
+	return func(ctx context.Context) {
+		secretName := func(obj any) string {
+			if tombstone, ok := obj.(kubeCache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			secret, ok := obj.(*core.Secret)
+			if !ok {
+				return ""
+			}
+			return secret.Namespace + "/" + secret.Name
 		}
 
-		l = l.With(
-			slog.String(loggingKeyPod, pod.Name),
-		)
-
-		if pod.GetNamespace() != targetNamespace {
-			return
+		handler := kubeCache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj any) {
+				l.Info("Unseal keys secret loaded", slog.String(loggingKeySecret, secretName(obj)))
+				a.checkKeySources(secretName(obj))
+			},
+			UpdateFunc: func(oldObj, obj any) {
+				// Resyncs deliver the Secret unchanged, so only changes to the Secret are logged and checked.
+				oldSecret, oldOK := oldObj.(*core.Secret)
+				newSecret, newOK := obj.(*core.Secret)
+				if oldOK && newOK && oldSecret.ResourceVersion == newSecret.ResourceVersion {
+					return
+				}
+
+				l.Info("Unseal keys secret updated", slog.String(loggingKeySecret, secretName(obj)))
+				a.checkKeySources(secretName(obj))
+			},
+			DeleteFunc: func(obj any) {
+				l.Warn("Unseal keys secret deleted", slog.String(loggingKeySecret, secretName(obj)))
+				a.checkKeySources(secretName(obj))
+			},
 		}
 
-		if !hashBucket.InBucket(pod.Name) {
-			return
+		for ref, si := range a.secretInformers {
+			if _, err := si.informer.AddEventHandler(handler); err != nil {
+				l.Error("Error adding event handler", slog.String(loggingKeySecret, ref), slog.String(loggingKeyError, err.Error()))
+				return
+			}
+
+			if err := si.informer.SetWatchErrorHandler(func(r *kubeCache.Reflector, err error) {
+				l.Error("Error watching secret", slog.String(loggingKeySecret, ref), slog.String(loggingKeyError, err.Error()))
+			}); err != nil {
+				l.Error("Error setting watch error handler",
+					slog.String(loggingKeySecret, ref),
+					slog.String(loggingKeyError, err.Error()),
+				)
+				return
+			}
 		}
 
-		if !isVaultPod(pod) {
-			return
+		var wg sync.WaitGroup
+		for _, si := range a.secretInformers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				si.informer.Run(ctx.Done())
+			}()
 		}
-		if !isVaultPodSealed(pod) {
-			return
-		}
-
-		l.Info("Updated Vault pod detected, attempting to unseal vault", slog.String(loggingKeyPod, pod.Name))
+		wg.Wait()
+	}
+}
 
-		if err := unsealNewVaultPod( // nolint:revive // Traditional error handling
-			ctx,
-			l,
-			generateVaultAddress(pod.Spec.Containers[0].Ports, pod.Status.PodIP),
-			unsealKeys,
-		); err != nil {
-			l.Error("Error unsealing vault", slog.String(loggingKeyError, err.Error()))
+// newPodHandler is the handler for new pods. It will check if the pod is a Vault pod and if it may be sealed. If it is,
+// the pod is queued to be unsealed using the unseal keys of its target.
+func newPodHandler(hashBucket cache.HashBucket, targets vaultTargets, queue *unsealQueue) func(any) {
+	return func(podObj any) {
+		pod, ok := podObj.(*core.Pod)
+		if !ok {
 			return
 		}
+
+		enqueueVaultPod(hashBucket, targets, queue, pod)
 	}
 }
 
-// updatePodHandler is the handler for updated pods. It will check if the pod is a Vault pod and if it is sealed. If it
-// is, it will attempt to unseal the vault using the unseal keys provided.
-func updatePodHandler(ctx context.Context, l *slog.Logger, hashBucket cache.HashBucket, unsealKeys []string) func(any, any) {
+// updatePodHandler is the handler for updated pods. It will check if the pod is a Vault pod and if it may be sealed. If
+// it is, the pod is queued to be unsealed using the unseal keys of its target.
+func updatePodHandler(hashBucket cache.HashBucket, targets vaultTargets, queue *unsealQueue) func(any, any) {
 	return func(_, newObj any) {
 		pod, ok := newObj.(*core.Pod)
 		if !ok {
 			return
 		}
 
-		l = l.With(
-			slog.String(loggingKeyPod, pod.Name),
-		)
+		enqueueVaultPod(hashBucket, targets, queue, pod)
+	}
+}
 
-		if pod.GetNamespace() != targetNamespace {
-			return
+// deletePodHandler is the handler for deleted pods. It stops tracking the pod as sealed.
+func deletePodHandler(queue *unsealQueue) func(any) {
+	return func(podObj any) {
+		if tombstone, ok := podObj.(kubeCache.DeletedFinalStateUnknown); ok {
+			podObj = tombstone.Obj
 		}
 
-		if !hashBucket.InBucket(pod.Name) {
+		pod, ok := podObj.(*core.Pod)
+		if !ok {
 			return
 		}
 
-		if !isVaultPod(pod) {
-			return
-		}
-		if !isVaultPodSealed(pod) {
-			return
+		queue.Forget(pod)
+	}
+}
+
+// checkKeySources reads the unseal keys of every target using the Secret, so the key source health reflects the latest
+// version of the Secret.
+func (a *App) checkKeySources(secret string) {
+	for _, t := range a.targets {
+		if t.unsealKeysSecret != nil && t.unsealKeysSecret.String() == secret {
+			_, _ = t.keys.UnsealKeys() // The result is recorded by the key source.
 		}
+	}
+}
 
-		l.Info("Updated Vault pod detected, attempting to unseal vault", slog.String(loggingKeyPod, pod.Name))
+// enqueueVaultPod queues the pod to be unsealed if it is a Vault pod owned by this replica. Pods of targets using the
+// label seal check are only queued when the label reports them as sealed, the seal status of the other pods is checked
+// by the unseal workers so the informer is never blocked on a call to Vault.
+func enqueueVaultPod(hashBucket cache.HashBucket, targets vaultTargets, queue *unsealQueue, pod *core.Pod) {
+	target := targets.ForPod(pod)
+	if target == nil {
+		return
+	}
 
-		if err := unsealNewVaultPod( // nolint:revive // Traditional error handling
-			ctx,
-			l,
-			generateVaultAddress(pod.Spec.Containers[0].Ports, pod.Status.PodIP),
-			unsealKeys,
-		); err != nil {
-			l.Error("Error unsealing vault", slog.String(loggingKeyError, err.Error()))
-			return
-		}
+	if !hashBucket.InBucket(pod.Namespace + "/" + pod.Name) {
+		return
 	}
+
+	// Unsealed pods are queued once per container start so the running container is recorded.
+	unsealed := pod.Labels[vaultSealedLabel] == "false" && needsUnsealedContainer(pod)
+	if target.sealCheck == sealCheckLabel && !isVaultPodSealed(pod) && !unsealed {
+		return
+	}
+
+	queue.Add(pod)
 }
 
-// isVaultPod checks if the pod is a Vault pod by checking the labels.
-func isVaultPod(pod *core.Pod) bool {
-	return pod.Labels["app.kubernetes.io/name"] == "vault"
+// isPodSealed checks if the Vault pod is sealed using the seal check of the target. When asking Vault for its seal
+// status, the vault-sealed label is only used as a hint and any disagreement is logged. Uninitialized pods are sealed,
+// but are only reported as sealed if the target initializes them or joins them to the Raft cluster.
+func isPodSealed(ctx context.Context, l *slog.Logger, target *vaultTarget, pod *core.Pod) (bool, error) {
+	if target.sealCheck != sealCheckAPI {
+		return isVaultPodSealed(pod), nil
+	}
+
+	if pod.Status.Phase != core.PodRunning || pod.Status.PodIP == "" {
+		return false, nil
+	}
+
+	vc, err := newPodVaultClient(target, pod)
+	if err != nil {
+		return false, fmt.Errorf("error creating vault client: %w", err)
+	}
+
+	status, err := vaultSealStatus(ctx, vc)
+	if err != nil {
+		return false, err
+	}
+
+	if hint, ok := pod.Labels[vaultSealedLabel]; ok && hint != strconv.FormatBool(status.Sealed) {
+		l.Debug("Vault seal status does not match the pod label",
+			slog.Bool(loggingKeySealed, status.Sealed),
+			slog.String(loggingKeyLabel, hint),
+		)
+	}
+
+	// An uninitialized pod is only worth queueing if the target initializes it or joins it to the Raft cluster.
+	if !status.Initialized && target.init == nil && target.raftJoin == nil {
+		l.Debug("Vault is not initialized, skipping unseal")
+		return false, nil
+	}
+
+	return status.Sealed, nil
 }
 
 // isVaultPodSealed checks if the pod is a Vault pod and if it is sealed by checking the labels.
 func isVaultPodSealed(pod *core.Pod) bool {
-	sealed, ok := pod.Labels["vault-sealed"]
+	sealed, ok := pod.Labels[vaultSealedLabel]
 	if !ok {
 		return false
 	}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// runCommand runs the subcommand with the given name, returning false if there is no such subcommand.
+func runCommand(name string, args []string) (bool, error) {
+	switch name {
+	case "encrypt":
+		return true, encryptCommand(args, os.Stdin, os.Stdout)
+	case "keygen":
+		return true, keygenCommand(os.Stdout)
+	case "verify-audit":
+		return true, verifyAuditCommand(args, os.Stdout)
+	case "approver-keygen":
+		return true, approverKeygenCommand(os.Stdout)
+	case "approve":
+		return true, approveCommand(args, os.Stdout)
+	default:
+		return false, nil
+	}
+}
+
+// encryptCommand reads plain unseal keys from the input, one per line, and writes a configuration file fragment holding
+// the encrypted keys to the output.
+func encryptCommand(args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("encrypt", flag.ContinueOnError)
+	recipient := fs.String("recipient", "", "Base64 encoded X25519 public key to encrypt the unseal keys to")
+	passphraseFile := fs.String("passphrase-file", "", "File holding the passphrase to encrypt the unseal keys with")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("error parsing flags: %w", err)
+	}
+
+	var encrypt func(string) (string, error)
+	switch {
+	case *recipient != "" && *passphraseFile != "":
+		return errors.New("only one of -recipient and -passphrase-file can be set")
+	case *recipient != "":
+		recipientKey, err := decodeKey(*recipient)
+		if err != nil {
+			return fmt.Errorf("error decoding recipient: %w", err)
+		}
+		encrypt = func(key string) (string, error) {
+			return encryptForRecipient(key, recipientKey)
+		}
+	default:
+		passphrase, err := valueOrFile(os.Getenv("UNSEAL_KEYS_PASSPHRASE"), *passphraseFile)
+		if err != nil {
+			return fmt.Errorf("error reading passphrase: %w", err)
+		}
+		if passphrase == "" {
+			return errors.New("one of -recipient, -passphrase-file or UNSEAL_KEYS_PASSPHRASE must be set")
+		}
+		encrypt = func(key string) (string, error) {
+			return encryptWithPassphrase(key, passphrase)
+		}
+	}
+
+	keys := make([]string, 0)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		key := strings.TrimSpace(scanner.Text())
+		if key == "" {
+			continue
+		}
+
+		encrypted, err := encrypt(key)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, encrypted)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading unseal keys: %w", err)
+	}
+
+	if err := validateUnsealKeys(keys, 0, false); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(map[string][]string{"unseal_keys": keys}); err != nil {
+		return fmt.Errorf("error writing encrypted unseal keys: %w", err)
+	}
+	return nil
+}
+
+// keygenCommand generates a new identity that unseal keys can be encrypted to.
+func keygenCommand(out io.Writer) error {
+	identity, recipient, err := generateIdentity()
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(out, "identity: %s\nrecipient: %s\n", identity, recipient); err != nil {
+		return fmt.Errorf("error writing identity: %w", err)
+	}
+	return nil
+}
+
+// verifyAuditCommand checks the audit log file has not been edited or truncated.
+func verifyAuditCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("verify-audit", flag.ContinueOnError)
+	head := fs.String("head", "", "Hash of an entry known to be in the log, e.g. the last entry forwarded to the webhook")
+	keyFile := fs.String("key-file", "", "File holding the key the audit log is chained with, instead of AUDIT_HMAC_KEY")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("error parsing flags: %w", err)
+	}
+	if fs.NArg() != 1 || *head == "" {
+		return errors.New("usage: verify-audit -head <hash> [-key-file <file>] <file>")
+	}
+
+	key, err := valueOrFile(os.Getenv("AUDIT_HMAC_KEY"), *keyFile)
+	if err != nil {
+		return fmt.Errorf("error reading audit hmac key: %w", err)
+	} else if key == "" {
+		return errors.New("no audit hmac key provided, set AUDIT_HMAC_KEY or -key-file")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("error opening audit log: %w", err)
+	}
+	defer f.Close() // nolint:errcheck
+
+	last, err := verifyAuditLog(f, []byte(key), *head)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(out, "ok: %d entries, last hash %s\n", last.Sequence+1, last.Hash); err != nil {
+		return fmt.Errorf("error writing result: %w", err)
+	}
+	return nil
+}
+
+// approverKeygenCommand generates a new key pair an operator signs unseal approvals with.
+func approverKeygenCommand(out io.Writer) error {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("error generating key: %w", err)
+	}
+
+	if _, err := fmt.Fprintf(out, "private_key: %s\npublic_key: %s\n",
+		base64.StdEncoding.EncodeToString(privateKey.Seed()),
+		base64.StdEncoding.EncodeToString(publicKey),
+	); err != nil {
+		return fmt.Errorf("error writing key: %w", err)
+	}
+	return nil
+}
+
+// approveCommand signs a decision on an unseal approval request and sends it to the approval link.
+func approveCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("approve", flag.ContinueOnError)
+	name := fs.String("name", "", "Name of the approver, as configured in vault-unseal")
+	keyFile := fs.String("key-file", "", "File holding the private key generated by approver-keygen")
+	deny := fs.Bool("deny", false, "Deny the unseal instead of approving it")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("error parsing flags: %w", err)
+	}
+	if fs.NArg() != 1 || *name == "" || *keyFile == "" {
+		return errors.New("usage: approve -name <approver> -key-file <file> [-deny] <approval link>")
+	}
+
+	link := strings.TrimSuffix(fs.Arg(0), "/")
+	_, id, ok := strings.Cut(link, "/approvals/")
+	if !ok || id == "" {
+		return fmt.Errorf("invalid approval link %q", link)
+	}
+
+	seed, err := valueOrFile("", *keyFile)
+	if err != nil {
+		return fmt.Errorf("error reading key: %w", err)
+	}
+	key, err := decodeKey(seed)
+	if err != nil {
+		return err
+	}
+
+	decision := &approvalDecision{
+		Approver: *name,
+		Decision: decisionApprove,
+	}
+	if *deny {
+		decision.Decision = decisionDeny
+	}
+	signature := ed25519.Sign(ed25519.NewKeyFromSeed(key[:]), approvalMessage(id, decision.Decision))
+	decision.Signature = base64.StdEncoding.EncodeToString(signature)
+
+	body, err := json.Marshal(decision)
+	if err != nil {
+		return fmt.Errorf("error marshalling decision: %w", err)
+	}
+
+	resp, err := http.Post(link, "application/json", bytes.NewReader(body)) // nolint:gosec // The link is given by the operator.
+	if err != nil {
+		return fmt.Errorf("error sending decision: %w", err)
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	if _, err := fmt.Fprintln(out, strings.TrimSpace(string(respBody))); err != nil {
+		return fmt.Errorf("error writing result: %w", err)
+	}
+	return nil
+}
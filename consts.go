@@ -1,12 +1,37 @@
 package main
 
+import "time"
+
 const (
 	appName = "vault-unseal"
 
-	loggingKeyError    = "err"
-	loggingKeyPod      = "pod"
-	loggingKeySealed   = "sealed"
-	loggingKeyProgress = "progress"
+	loggingKeyError     = "err"
+	loggingKeyPod       = "pod"
+	loggingKeySealed    = "sealed"
+	loggingKeyProgress  = "progress"
+	loggingKeySecret    = "secret"
+	loggingKeyTarget    = "target"
+	loggingKeyLabel     = "label"
+	loggingKeyNamespace = "namespace"
+	loggingKeyWorker    = "worker"
+	loggingKeyAttempt   = "attempt"
+	loggingKeyReason    = "reason"
+	loggingKeyApproval  = "approval"
+	loggingKeyApprovers = "approvers"
+	loggingKeyApprover  = "approver"
+	loggingKeyDecision  = "decision"
+	loggingKeyRule      = "rule"
+	loggingKeyAction    = "action"
+	loggingKeySelector  = "selector"
+	loggingKeyShares    = "shares"
+	loggingKeyThreshold = "threshold"
+	loggingKeyLeader    = "leader"
+	loggingKeyFile      = "file"
+	loggingKeyCount     = "count"
+
+	// vaultSealedLabel is the label Vault's Kubernetes service registration writes with the seal status of the pod.
+	vaultSealedLabel = "vault-sealed"
 
-	targetNamespace = "vault"
+	// sealStatusTimeout is the maximum time to wait for a Vault pod to report its seal status.
+	sealStatusTimeout = 5 * time.Second
 )
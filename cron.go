@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronDescriptors are the shorthands accepted in place of the five cron fields.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	// cronMonths are the names accepted in the month field.
+	cronMonths = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+
+	// cronWeekdays are the names accepted in the day of week field.
+	cronWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+)
+
+type (
+	// cronSchedule is a parsed standard five field cron expression: minute, hour, day of month, month and day of week.
+	cronSchedule struct {
+		minute, hour, dom, month, dow uint64
+
+		// domAny and dowAny record whether the day fields were "*". As in cron, if both are restricted a day matches
+		// when either field matches.
+		domAny, dowAny bool
+	}
+
+	// cronField describes the range and names of a cron field.
+	cronField struct {
+		name     string
+		min, max int
+		names    []string
+		namesMin int
+	}
+)
+
+// parseCron parses a five field cron expression, or one of the @daily style descriptors.
+func parseCron(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if d, ok := cronDescriptors[strings.ToLower(spec)]; ok {
+		spec = d
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	s := new(cronSchedule)
+	var err error
+	if s.minute, err = parseCronField(fields[0], cronField{name: "minute", max: 59}); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(fields[1], cronField{name: "hour", max: 23}); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseCronField(fields[2], cronField{name: "day of month", min: 1, max: 31}); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseCronField(fields[3], cronField{name: "month", min: 1, max: 12, names: cronMonths, namesMin: 1}); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseCronField(fields[4], cronField{name: "day of week", max: 7, names: cronWeekdays}); err != nil {
+		return nil, err
+	}
+
+	// Both 0 and 7 are Sunday.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+	return s, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps into a bit set.
+func parseCronField(expr string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		rangeExpr, stepExpr, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepExpr)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %s field", stepExpr, f.name)
+			}
+		}
+
+		var lo, hi int
+		switch {
+		case rangeExpr == "*":
+			lo, hi = f.min, f.max
+		case strings.Contains(rangeExpr, "-"):
+			loExpr, hiExpr, _ := strings.Cut(rangeExpr, "-")
+			var err error
+			if lo, err = f.value(loExpr); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(hiExpr); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q in %s field", rangeExpr, f.name)
+			}
+		default:
+			var err error
+			if lo, err = f.value(rangeExpr); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if hasStep {
+				hi = f.max
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// value parses a single number or name of the field.
+func (f cronField) value(expr string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(expr, name) {
+			return i + f.namesMin, nil
+		}
+	}
+
+	v, err := strconv.Atoi(expr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q in %s field", expr, f.name)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d out of range %d-%d in %s field", v, f.min, f.max, f.name)
+	}
+	return v, nil
+}
+
+// Matches checks if the schedule fires at the minute of the given time, in the time's location.
+func (s *cronSchedule) Matches(t time.Time) bool {
+	return s.minute&(1<<t.Minute()) != 0 && s.hour&(1<<t.Hour()) != 0 && s.matchesDay(t)
+}
+
+// matchesDay checks if the schedule fires on the day of the given time.
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	if s.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+
+	domMatch := s.dom&(1<<t.Day()) != 0
+	dowMatch := s.dow&(1<<int(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// firedWithin checks if the schedule fired within the duration before the given time, in the location. Rather than
+// checking every minute of the window, days and hours that do not match are skipped, so the longest window only takes
+// a few hundred steps.
+func (s *cronSchedule) firedWithin(now time.Time, d time.Duration, loc *time.Location) bool {
+	start := now.Add(-d)
+	t := now.Truncate(time.Minute)
+	for t.After(start) {
+		local := t.In(loc)
+
+		if !s.matchesDay(local) {
+			// Skip to the last minute of the previous day. An ambiguous midnight may resolve to a later time, in which
+			// case the previous minute is checked instead.
+			prev := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc).Add(-time.Minute)
+			if !prev.Before(t) {
+				prev = t.Add(-time.Minute)
+			}
+			t = prev
+			continue
+		}
+
+		if s.hour&(1<<local.Hour()) != 0 {
+			// The latest matching minute of the hour, up to the current minute.
+			if minutes := s.minute & (1<<(local.Minute()+1) - 1); minutes != 0 {
+				fired := t.Add(-time.Duration(local.Minute()-(bits.Len64(minutes)-1)) * time.Minute)
+				return fired.After(start)
+			}
+		}
+
+		// Skip to the last minute of the previous hour.
+		t = t.Add(-time.Duration(local.Minute()+1) * time.Minute)
+	}
+	return false
+}
+
+// validate checks the schedule fires at least once, e.g. it is not only on the 31st of February.
+func (s *cronSchedule) validate() error {
+	// Every day of the month and week is in a leap year.
+	for t := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC); t.Year() == 2024; t = t.AddDate(0, 0, 1) {
+		if s.matchesDay(t) {
+			return nil
+		}
+	}
+	return errors.New("schedule never fires")
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// cronBits returns the bit set of the values.
+func cronBits(values ...int) uint64 {
+	var bits uint64
+	for _, v := range values {
+		bits |= 1 << v
+	}
+	return bits
+}
+
+// cronRange returns the bit set of the values from lo to hi, stepping by step.
+func cronRange(lo, hi, step int) uint64 {
+	var bits uint64
+	for v := lo; v <= hi; v += step {
+		bits |= 1 << v
+	}
+	return bits
+}
+
+func TestParseCronField(t *testing.T) {
+	t.Parallel()
+
+	minute := cronField{name: "minute", max: 59}
+	month := cronField{name: "month", min: 1, max: 12, names: cronMonths, namesMin: 1}
+	weekday := cronField{name: "day of week", max: 7, names: cronWeekdays}
+
+	tests := []struct {
+		name    string
+		expr    string
+		field   cronField
+		want    uint64
+		wantErr string
+	}{
+		{
+			name:  "any",
+			expr:  "*",
+			field: minute,
+			want:  cronRange(0, 59, 1),
+		},
+		{
+			name:  "any of a field starting at one",
+			expr:  "*",
+			field: month,
+			want:  cronRange(1, 12, 1),
+		},
+		{
+			name:  "value",
+			expr:  "5",
+			field: minute,
+			want:  cronBits(5),
+		},
+		{
+			name:  "range",
+			expr:  "10-15",
+			field: minute,
+			want:  cronRange(10, 15, 1),
+		},
+		{
+			name:  "list",
+			expr:  "1,5,59",
+			field: minute,
+			want:  cronBits(1, 5, 59),
+		},
+		{
+			name:  "step of any",
+			expr:  "*/15",
+			field: minute,
+			want:  cronBits(0, 15, 30, 45),
+		},
+		{
+			name:  "step of any in a field starting at one",
+			expr:  "*/5",
+			field: month,
+			want:  cronBits(1, 6, 11),
+		},
+		{
+			name:  "step of a range",
+			expr:  "10-30/10",
+			field: minute,
+			want:  cronBits(10, 20, 30),
+		},
+		{
+			name:  "step of a value runs to the end of the field",
+			expr:  "50/3",
+			field: minute,
+			want:  cronBits(50, 53, 56, 59),
+		},
+		{
+			name:  "list of ranges and steps",
+			expr:  "0-2,30/15,58",
+			field: minute,
+			want:  cronBits(0, 1, 2, 30, 45, 58),
+		},
+		{
+			name:  "month names",
+			expr:  "jan,MAR-May",
+			field: month,
+			want:  cronBits(1, 3, 4, 5),
+		},
+		{
+			name:  "weekday names",
+			expr:  "MON-FRI",
+			field: weekday,
+			want:  cronRange(1, 5, 1),
+		},
+		{
+			name:    "value below the range",
+			expr:    "0",
+			field:   month,
+			wantErr: "value 0 out of range 1-12 in month field",
+		},
+		{
+			name:    "value above the range",
+			expr:    "60",
+			field:   minute,
+			wantErr: "value 60 out of range 0-59 in minute field",
+		},
+		{
+			name:    "reversed range",
+			expr:    "15-10",
+			field:   minute,
+			wantErr: `invalid range "15-10" in minute field`,
+		},
+		{
+			name:    "zero step",
+			expr:    "*/0",
+			field:   minute,
+			wantErr: `invalid step "0" in minute field`,
+		},
+		{
+			name:    "invalid step",
+			expr:    "*/x",
+			field:   minute,
+			wantErr: `invalid step "x" in minute field`,
+		},
+		{
+			name:    "unknown name",
+			expr:    "SUNDAY",
+			field:   weekday,
+			wantErr: `invalid value "SUNDAY" in day of week field`,
+		},
+		{
+			name:    "names of another field",
+			expr:    "JAN",
+			field:   minute,
+			wantErr: `invalid value "JAN" in minute field`,
+		},
+		{
+			name:    "empty list entry",
+			expr:    "1,",
+			field:   minute,
+			wantErr: `invalid value "" in minute field`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseCronField(tt.expr, tt.field)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		spec    string
+		want    *cronSchedule
+		wantErr string
+	}{
+		{
+			name: "every field",
+			spec: "30 9 1-7 JAN-MAR MON",
+			want: &cronSchedule{
+				minute: cronBits(30),
+				hour:   cronBits(9),
+				dom:    cronRange(1, 7, 1),
+				month:  cronRange(1, 3, 1),
+				dow:    cronBits(1),
+			},
+		},
+		{
+			name: "descriptor",
+			spec: " @Daily ",
+			want: &cronSchedule{
+				minute: cronBits(0),
+				hour:   cronBits(0),
+				dom:    cronRange(1, 31, 1),
+				month:  cronRange(1, 12, 1),
+				dow:    cronRange(0, 7, 1),
+				domAny: true,
+				dowAny: true,
+			},
+		},
+		{
+			name: "seven is sunday",
+			spec: "0 0 * * 7",
+			want: &cronSchedule{
+				minute: cronBits(0),
+				hour:   cronBits(0),
+				dom:    cronRange(1, 31, 1),
+				month:  cronRange(1, 12, 1),
+				dow:    cronBits(0, 7),
+				domAny: true,
+			},
+		},
+		{
+			name: "a step of one is not any",
+			spec: "0 0 */1 * */1",
+			want: &cronSchedule{
+				minute: cronBits(0),
+				hour:   cronBits(0),
+				dom:    cronRange(1, 31, 1),
+				month:  cronRange(1, 12, 1),
+				dow:    cronRange(0, 7, 1),
+			},
+		},
+		{
+			name:    "too few fields",
+			spec:    "0 0 * *",
+			wantErr: "expected 5 fields, got 4",
+		},
+		{
+			name:    "too many fields",
+			spec:    "0 0 0 * * *",
+			wantErr: "expected 5 fields, got 6",
+		},
+		{
+			name:    "unknown descriptor",
+			spec:    "@reboot",
+			wantErr: "expected 5 fields, got 1",
+		},
+		{
+			name:    "invalid field",
+			spec:    "0 24 * * *",
+			wantErr: "value 24 out of range 0-23 in hour field",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseCron(tt.spec)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCronSchedule_Matches(t *testing.T) {
+	t.Parallel()
+
+	// 2024-09-13 is a Friday.
+	friday13 := time.Date(2024, 9, 13, 0, 0, 0, 0, time.UTC)
+	friday6 := time.Date(2024, 9, 6, 0, 0, 0, 0, time.UTC)
+	monday13 := time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)
+	monday6 := time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		spec string
+		at   time.Time
+		want bool
+	}{
+		{
+			name: "minute and hour",
+			spec: "30 9 * * *",
+			at:   friday6.Add(9*time.Hour + 30*time.Minute),
+			want: true,
+		},
+		{
+			name: "wrong minute",
+			spec: "30 9 * * *",
+			at:   friday6.Add(9*time.Hour + 31*time.Minute),
+		},
+		{
+			name: "wrong hour",
+			spec: "30 9 * * *",
+			at:   friday6.Add(10*time.Hour + 30*time.Minute),
+		},
+		{
+			name: "wrong month",
+			spec: "0 0 * JAN-AUG *",
+			at:   friday6,
+		},
+		{
+			name: "sunday as seven",
+			spec: "0 0 * * 7",
+			at:   time.Date(2024, 9, 8, 0, 0, 0, 0, time.UTC),
+			want: true,
+		},
+		{
+			name: "restricted day of month and any day of week",
+			spec: "0 0 13 * *",
+			at:   monday13,
+			want: true,
+		},
+		{
+			name: "restricted day of month only matches that day",
+			spec: "0 0 13 * *",
+			at:   friday6,
+		},
+		{
+			name: "any day of month and restricted day of week",
+			spec: "0 0 * * FRI",
+			at:   friday6,
+			want: true,
+		},
+		{
+			name: "restricted day of week only matches that day",
+			spec: "0 0 * * FRI",
+			at:   monday13,
+		},
+		{
+			name: "both day fields restricted matches the day of month",
+			spec: "0 0 13 * FRI",
+			at:   monday13,
+			want: true,
+		},
+		{
+			name: "both day fields restricted matches the day of week",
+			spec: "0 0 13 * FRI",
+			at:   friday6,
+			want: true,
+		},
+		{
+			name: "both day fields restricted matches both",
+			spec: "0 0 13 * FRI",
+			at:   friday13,
+			want: true,
+		},
+		{
+			name: "both day fields restricted matches neither",
+			spec: "0 0 13 * FRI",
+			at:   monday6,
+		},
+		{
+			name: "a step of one restricts the day of month, so any day matches",
+			spec: "0 0 */1 * FRI",
+			at:   monday6,
+			want: true,
+		},
+		{
+			name: "a step of one restricts the day of week, so any day matches",
+			spec: "0 0 13 * */1",
+			at:   monday6,
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := parseCron(tt.spec)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.want, s.Matches(tt.at))
+		})
+	}
+}
+
+func TestCronSchedule_FiredWithin(t *testing.T) {
+	t.Parallel()
+
+	london, err := time.LoadLocation("Europe/London")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		now  time.Time
+		d    time.Duration
+		loc  *time.Location
+		want bool
+	}{
+		{
+			name: "fired at now",
+			spec: "0 9 * * *",
+			now:  time.Date(2024, 6, 3, 9, 0, 30, 0, time.UTC),
+			d:    time.Minute,
+			loc:  time.UTC,
+			want: true,
+		},
+		{
+			name: "fired within the duration",
+			spec: "0 9 * * *",
+			now:  time.Date(2024, 6, 3, 10, 59, 0, 0, time.UTC),
+			d:    2 * time.Hour,
+			loc:  time.UTC,
+			want: true,
+		},
+		{
+			name: "fired exactly the duration ago",
+			spec: "0 9 * * *",
+			now:  time.Date(2024, 6, 3, 11, 0, 0, 0, time.UTC),
+			d:    2 * time.Hour,
+			loc:  time.UTC,
+		},
+		{
+			name: "not yet fired",
+			spec: "0 9 * * *",
+			now:  time.Date(2024, 6, 3, 8, 59, 0, 0, time.UTC),
+			d:    2 * time.Hour,
+			loc:  time.UTC,
+		},
+		{
+			name: "evaluated in the location",
+			spec: "0 9 * * *",
+			now:  time.Date(2024, 6, 3, 8, 30, 0, 0, time.UTC),
+			d:    time.Hour,
+			loc:  london,
+			want: true,
+		},
+		{
+			name: "window spanning midnight",
+			spec: "0 22 * * FRI",
+			now:  time.Date(2024, 9, 7, 1, 0, 0, 0, time.UTC),
+			d:    4 * time.Hour,
+			loc:  time.UTC,
+			want: true,
+		},
+		{
+			name: "just within the longest window",
+			spec: "0 0 1 1 *",
+			now:  time.Date(2024, 1, 31, 23, 59, 0, 0, time.UTC),
+			d:    maxPolicyWindow,
+			loc:  time.UTC,
+			want: true,
+		},
+		{
+			name: "just outside the longest window",
+			spec: "0 0 1 1 *",
+			now:  time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+			d:    maxPolicyWindow,
+			loc:  time.UTC,
+		},
+		{
+			name: "skipped by the spring forward transition",
+			spec: "30 1 * * *",
+			now:  time.Date(2024, 3, 31, 3, 0, 0, 0, london),
+			d:    2 * time.Hour,
+			loc:  london,
+		},
+		{
+			name: "the day before the spring forward transition",
+			spec: "30 1 * * *",
+			now:  time.Date(2024, 3, 30, 3, 0, 0, 0, london),
+			d:    2 * time.Hour,
+			loc:  london,
+			want: true,
+		},
+		{
+			name: "window across the spring forward transition is elapsed time",
+			spec: "0 0 * * *",
+			now:  time.Date(2024, 3, 31, 3, 30, 0, 0, london),
+			d:    3 * time.Hour,
+			loc:  london,
+			want: true,
+		},
+		{
+			name: "window across the spring forward transition is not wall clock time",
+			spec: "0 0 * * *",
+			now:  time.Date(2024, 3, 31, 3, 30, 0, 0, london),
+			d:    2 * time.Hour,
+			loc:  london,
+		},
+		{
+			name: "first occurrence of the fall back transition",
+			spec: "30 1 * * *",
+			now:  time.Date(2024, 10, 27, 0, 40, 0, 0, time.UTC),
+			d:    15 * time.Minute,
+			loc:  london,
+			want: true,
+		},
+		{
+			name: "second occurrence of the fall back transition",
+			spec: "30 1 * * *",
+			now:  time.Date(2024, 10, 27, 1, 40, 0, 0, time.UTC),
+			d:    15 * time.Minute,
+			loc:  london,
+			want: true,
+		},
+		{
+			name: "between the occurrences of the fall back transition",
+			spec: "30 1 * * *",
+			now:  time.Date(2024, 10, 27, 1, 10, 0, 0, time.UTC),
+			d:    15 * time.Minute,
+			loc:  london,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := parseCron(tt.spec)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.want, s.firedWithin(tt.now, tt.d, tt.loc))
+		})
+	}
+}
+
+func TestCronSchedule_FiredWithin_EveryMinute(t *testing.T) {
+	t.Parallel()
+
+	london, err := time.LoadLocation("Europe/London")
+	if !assert.NoError(t, err) {
+		return
+	}
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// firedEveryMinute is the reference, checking every minute of the window.
+	firedEveryMinute := func(s *cronSchedule, now time.Time, d time.Duration, loc *time.Location) bool {
+		start := now.Add(-d)
+		for t := now.Truncate(time.Minute); t.After(start); t = t.Add(-time.Minute) {
+			if s.Matches(t.In(loc)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	specs := []string{"*/15 * * * *", "30 1 * * *", "0 9-17 * * MON-FRI", "0 0 29 2 *", "45 23 13 * 5", "@monthly"}
+	windows := []time.Duration{time.Minute, 90 * time.Minute, 25 * time.Hour, 8 * 24 * time.Hour}
+	locations := []*time.Location{time.UTC, london, kolkata}
+
+	// Every 7 hours and 13 minutes around both transitions of London in 2024.
+	for _, spec := range specs {
+		s, err := parseCron(spec)
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, loc := range locations {
+			for _, d := range windows {
+				for now := time.Date(2024, 3, 25, 0, 0, 0, 0, time.UTC); now.Month() < 11; now = now.Add(433 * time.Minute) {
+					if now.Month() > 4 && now.Month() < 10 {
+						continue
+					}
+					if !assert.Equal(t, firedEveryMinute(s, now, d, loc), s.firedWithin(now, d, loc),
+						"%s in %s for %s at %s", spec, loc, d, now) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCronSchedule_Validate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		spec    string
+		wantErr string
+	}{
+		{
+			name: "every day",
+			spec: "@daily",
+		},
+		{
+			name: "leap day",
+			spec: "0 0 29 FEB *",
+		},
+		{
+			name:    "day missing from the month",
+			spec:    "0 0 31 FEB *",
+			wantErr: "schedule never fires",
+		},
+		{
+			name:    "day missing from every month",
+			spec:    "0 0 31 APR,JUN,SEP,NOV *",
+			wantErr: "schedule never fires",
+		},
+		{
+			name: "missing day of month but restricted day of week",
+			spec: "0 0 31 FEB MON",
+		},
+		{
+			name:    "missing day of month and any day of week",
+			spec:    "0 0 30 2 *",
+			wantErr: "schedule never fires",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := parseCron(tt.spec)
+			if !assert.NoError(t, err) {
+				return
+			}
+			err = s.validate()
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// encryptedKeyPrefix marks an unseal key as encrypted. It is followed by the scheme and the base64 encoded payload,
+	// e.g. "enc:box:<payload>".
+	encryptedKeyPrefix = "enc:"
+
+	// schemeBox is an unseal key encrypted to an X25519 recipient with an anonymous NaCl box.
+	schemeBox = "box"
+
+	// schemePassphrase is an unseal key encrypted with a NaCl secretbox using a key derived from a passphrase.
+	schemePassphrase = "pass"
+
+	// passphraseSaltSize is the size of the random salt used when deriving a key from a passphrase.
+	passphraseSaltSize = 16
+
+	// passphraseIterations is the number of PBKDF2 iterations used when deriving a key from a passphrase.
+	passphraseIterations = 600_000
+
+	// naclKeySize is the size of the keys used by NaCl box and secretbox.
+	naclKeySize = 32
+
+	// naclNonceSize is the size of the nonce used by NaCl secretbox.
+	naclNonceSize = 24
+)
+
+var (
+	// errNoDecryptionKey is returned when an encrypted unseal key is found but no identity or passphrase is configured.
+	errNoDecryptionKey = errors.New("encrypted unseal key found but no identity or passphrase is configured")
+)
+
+// keyDecrypter decrypts unseal keys that have been encrypted with the encrypt subcommand. Keys that are not encrypted
+// are returned unchanged.
+type keyDecrypter struct {
+	identity   *[naclKeySize]byte
+	recipient  *[naclKeySize]byte
+	passphrase string
+}
+
+// newKeyDecrypter creates a keyDecrypter from the identity and passphrase in the application configuration. Values in
+// the environment take precedence over files.
+func newKeyDecrypter(config *AppConfig) (*keyDecrypter, error) {
+	identity, err := valueOrFile(config.UnsealKeysIdentity, config.UnsealKeysIdentityFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading unseal keys identity: %w", err)
+	}
+
+	passphrase, err := valueOrFile(config.UnsealKeysPassphrase, config.UnsealKeysPassphraseFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading unseal keys passphrase: %w", err)
+	}
+
+	d := &keyDecrypter{
+		passphrase: passphrase,
+	}
+
+	if identity != "" {
+		d.identity, err = decodeKey(identity)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding unseal keys identity: %w", err)
+		}
+
+		d.recipient, err = publicKeyFor(d.identity)
+		if err != nil {
+			return nil, fmt.Errorf("error deriving unseal keys recipient: %w", err)
+		}
+	}
+
+	return d, nil
+}
+
+// DecryptAll decrypts every encrypted key in the list.
+func (d *keyDecrypter) DecryptAll(keys []string) ([]string, error) {
+	decrypted := make([]string, 0, len(keys))
+	for i, key := range keys {
+		plain, err := d.Decrypt(key)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting unseal key %d: %w", i, err)
+		}
+		decrypted = append(decrypted, plain)
+	}
+	return decrypted, nil
+}
+
+// Decrypt decrypts the given key if it is encrypted, otherwise the key is returned unchanged.
+func (d *keyDecrypter) Decrypt(key string) (string, error) {
+	if !strings.HasPrefix(key, encryptedKeyPrefix) {
+		return key, nil
+	}
+
+	scheme, encoded, ok := strings.Cut(strings.TrimPrefix(key, encryptedKeyPrefix), ":")
+	if !ok {
+		return "", errors.New("malformed encrypted unseal key")
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("error decoding encrypted unseal key: %w", err)
+	}
+
+	switch scheme {
+	case schemeBox:
+		if d.identity == nil {
+			return "", errNoDecryptionKey
+		}
+
+		plain, ok := box.OpenAnonymous(nil, payload, d.recipient, d.identity)
+		if !ok {
+			return "", errors.New("unable to decrypt unseal key with the configured identity")
+		}
+		return string(plain), nil
+	case schemePassphrase:
+		if d.passphrase == "" {
+			return "", errNoDecryptionKey
+		}
+
+		if len(payload) < passphraseSaltSize+naclNonceSize {
+			return "", errors.New("encrypted unseal key is too short")
+		}
+
+		salt := payload[:passphraseSaltSize]
+		nonce := new([naclNonceSize]byte)
+		copy(nonce[:], payload[passphraseSaltSize:passphraseSaltSize+naclNonceSize])
+
+		secretKey, err := deriveKey(d.passphrase, salt)
+		if err != nil {
+			return "", err
+		}
+
+		plain, ok := secretbox.Open(nil, payload[passphraseSaltSize+naclNonceSize:], nonce, secretKey)
+		if !ok {
+			return "", errors.New("unable to decrypt unseal key with the configured passphrase")
+		}
+		return string(plain), nil
+	default:
+		return "", fmt.Errorf("unknown unseal key encryption scheme %q", scheme)
+	}
+}
+
+// encryptForRecipient encrypts the key to the given X25519 public key.
+func encryptForRecipient(key string, recipient *[naclKeySize]byte) (string, error) {
+	sealed, err := box.SealAnonymous(nil, []byte(key), recipient, rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("error encrypting unseal key: %w", err)
+	}
+	return encryptedKeyPrefix + schemeBox + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// encryptWithPassphrase encrypts the key with a key derived from the given passphrase.
+func encryptWithPassphrase(key, passphrase string) (string, error) {
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("error generating salt: %w", err)
+	}
+
+	nonce := new([naclNonceSize]byte)
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", fmt.Errorf("error generating nonce: %w", err)
+	}
+
+	secretKey, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+
+	payload := make([]byte, 0, passphraseSaltSize+naclNonceSize+secretbox.Overhead+len(key))
+	payload = append(payload, salt...)
+	payload = append(payload, nonce[:]...)
+	payload = secretbox.Seal(payload, []byte(key), nonce, secretKey)
+
+	return encryptedKeyPrefix + schemePassphrase + ":" + base64.StdEncoding.EncodeToString(payload), nil
+}
+
+// generateIdentity generates a new X25519 identity, returning the base64 encoded private and public keys.
+func generateIdentity() (identity, recipient string, err error) {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("error generating identity: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(privateKey[:]), base64.StdEncoding.EncodeToString(publicKey[:]), nil
+}
+
+// deriveKey derives a secretbox key from the passphrase and salt.
+func deriveKey(passphrase string, salt []byte) (*[naclKeySize]byte, error) {
+	derived, err := pbkdf2.Key(sha256.New, passphrase, salt, passphraseIterations, naclKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving key from passphrase: %w", err)
+	}
+
+	key := new([naclKeySize]byte)
+	copy(key[:], derived)
+	return key, nil
+}
+
+// publicKeyFor returns the X25519 public key for the given private key.
+func publicKeyFor(privateKey *[naclKeySize]byte) (*[naclKeySize]byte, error) {
+	raw, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey := new([naclKeySize]byte)
+	copy(publicKey[:], raw)
+	return publicKey, nil
+}
+
+// decodeKey decodes a base64 encoded X25519 key.
+func decodeKey(encoded string) (*[naclKeySize]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding key: %w", err)
+	}
+
+	if len(raw) != naclKeySize {
+		return nil, fmt.Errorf("invalid key length %d, expected %d", len(raw), naclKeySize)
+	}
+
+	key := new([naclKeySize]byte)
+	copy(key[:], raw)
+	return key, nil
+}
+
+// valueOrFile returns the value if it is set, otherwise the trimmed contents of the file if a path is set.
+func valueOrFile(value, path string) (string, error) {
+	if value != "" || path == "" {
+		return value, nil
+	}
+
+	got, err := os.ReadFile(path) // nolint:gosec // The path is provided by the operator
+	if err != nil {
+		return "", fmt.Errorf("error reading file %s: %w", path, err)
+	}
+	return strings.TrimSpace(string(got)), nil
+}
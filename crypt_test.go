@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptWithPassphrase(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		key        string
+		passphrase string
+		decrypt    string
+		wantErr    string
+	}{
+		{
+			name:       "round trip",
+			key:        "unseal-key",
+			passphrase: "correct horse battery staple",
+			decrypt:    "correct horse battery staple",
+		},
+		{
+			name:       "round trip of a long key",
+			key:        strings.Repeat("k", 1024),
+			passphrase: "passphrase",
+			decrypt:    "passphrase",
+		},
+		{
+			name:       "wrong passphrase",
+			key:        "unseal-key",
+			passphrase: "passphrase",
+			decrypt:    "other passphrase",
+			wantErr:    "unable to decrypt unseal key with the configured passphrase",
+		},
+		{
+			name:       "no passphrase",
+			key:        "unseal-key",
+			passphrase: "passphrase",
+			wantErr:    errNoDecryptionKey.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			encrypted, err := encryptWithPassphrase(tt.key, tt.passphrase)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.True(t, strings.HasPrefix(encrypted, encryptedKeyPrefix+schemePassphrase+":"))
+			assert.NotContains(t, encrypted, tt.key)
+
+			d := &keyDecrypter{passphrase: tt.decrypt}
+			got, err := d.Decrypt(encrypted)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.key, got)
+		})
+	}
+}
+
+func TestEncryptWithPassphrase_UniqueSalt(t *testing.T) {
+	t.Parallel()
+
+	first, err := encryptWithPassphrase("unseal-key", "passphrase")
+	assert.NoError(t, err)
+	second, err := encryptWithPassphrase("unseal-key", "passphrase")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+}
+
+func TestEncryptForRecipient(t *testing.T) {
+	t.Parallel()
+
+	identity, recipient, err := generateIdentity()
+	if !assert.NoError(t, err) {
+		return
+	}
+	otherIdentity, _, err := generateIdentity()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		name     string
+		identity string
+		wantErr  string
+	}{
+		{
+			name:     "round trip",
+			identity: identity,
+		},
+		{
+			name:     "wrong identity",
+			identity: otherIdentity,
+			wantErr:  "unable to decrypt unseal key with the configured identity",
+		},
+		{
+			name:    "no identity",
+			wantErr: errNoDecryptionKey.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			recipientKey, err := decodeKey(recipient)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			encrypted, err := encryptForRecipient("unseal-key", recipientKey)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.True(t, strings.HasPrefix(encrypted, encryptedKeyPrefix+schemeBox+":"))
+
+			d, err := newKeyDecrypter(&AppConfig{UnsealKeysIdentity: tt.identity})
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			got, err := d.Decrypt(encrypted)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "unseal-key", got)
+		})
+	}
+}
+
+func TestKeyDecrypter_Decrypt(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		key     string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "plaintext key is unchanged",
+			key:  "unseal-key",
+			want: "unseal-key",
+		},
+		{
+			name:    "malformed",
+			key:     encryptedKeyPrefix + "unseal-key",
+			wantErr: "malformed encrypted unseal key",
+		},
+		{
+			name:    "invalid base64",
+			key:     encryptedKeyPrefix + schemePassphrase + ":not base64",
+			wantErr: "error decoding encrypted unseal key: illegal base64 data at input byte 3",
+		},
+		{
+			name:    "unknown scheme",
+			key:     encryptedKeyPrefix + "rot13:" + base64.StdEncoding.EncodeToString([]byte("unseal-key")),
+			wantErr: `unknown unseal key encryption scheme "rot13"`,
+		},
+		{
+			name:    "too short",
+			key:     encryptedKeyPrefix + schemePassphrase + ":" + base64.StdEncoding.EncodeToString([]byte("short")),
+			wantErr: "encrypted unseal key is too short",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			d := &keyDecrypter{passphrase: "passphrase"}
+			got, err := d.Decrypt(tt.key)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestKeyDecrypter_DecryptAll(t *testing.T) {
+	t.Parallel()
+
+	encrypted, err := encryptWithPassphrase("second", "passphrase")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	d := &keyDecrypter{passphrase: "passphrase"}
+	got, err := d.DecryptAll([]string{"first", encrypted})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first", "second"}, got)
+
+	_, err = (&keyDecrypter{passphrase: "wrong"}).DecryptAll([]string{"first", encrypted})
+	assert.EqualError(t, err, "error decrypting unseal key 1: unable to decrypt unseal key with the configured passphrase")
+}
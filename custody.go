@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jacobbrewer1/web"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// custodyGroupPlaceholder is replaced with the custody group of the replica in the name of the unseal keys Secret.
+	custodyGroupPlaceholder = "{group}"
+
+	// custodySecretTimeout is the maximum time to wait for the unseal keys Secret of the custody group.
+	custodySecretTimeout = 10 * time.Second
+
+	// skipAwaitingCustodians is the skip reason when the replica submitted its unseal keys, but Vault needs keys held
+	// by other custody groups.
+	skipAwaitingCustodians = "awaiting_custodians"
+
+	// stateCustodyKey is the key in the state ConfigMap holding the unseals each custody group submitted its keys to.
+	stateCustodyKey = "custody"
+
+	// custodySubmissionTTL is how long the unseal a custody group submitted its keys to is remembered for.
+	custodySubmissionTTL = 24 * time.Hour
+)
+
+type (
+	// custodySubmissions remembers the unseal, identified by its nonce, each pod was given the keys of the custody group
+	// for. The keys count towards the progress of that unseal, so they are not submitted again while it waits for the
+	// other groups. The submissions are kept in the state ConfigMap, so they are kept when the pod moves to another
+	// replica of the group.
+	custodySubmissions struct {
+		state *stateStore
+		group string
+	}
+
+	// custodySubmission records the unseal a pod was given the keys of the custody group for.
+	custodySubmission struct {
+		Nonce string    `json:"nonce"`
+		At    time.Time `json:"at"`
+	}
+)
+
+// validateCustodyGroup checks the custody group can be used in the name of its service.
+func validateCustodyGroup(group string) error {
+	if errs := validation.IsDNS1123Label(group); len(errs) > 0 {
+		return fmt.Errorf("invalid custody group %q: %s", group, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// validateCustody checks the target can only give the replica the unseal keys of its custody group.
+func validateCustody(cfg *targetConfig) error {
+	if len(cfg.UnsealKeys) > 0 {
+		return errors.New("unseal_keys cannot be used with a custody group, as every group would hold them")
+	}
+
+	if cfg.UnsealKeysSecret == nil || !strings.Contains(cfg.UnsealKeysSecret.Name, custodyGroupPlaceholder) {
+		return fmt.Errorf("unseal_keys_secret name must contain %s when using a custody group", custodyGroupPlaceholder)
+	}
+
+	// Initializing Vault gives a single replica every unseal key.
+	if cfg.Init != nil {
+		return errors.New("init cannot be used with a custody group, as the replica would get every unseal key")
+	}
+
+	// Reading a CA Secret needs the Secret informer, which can read the unseal keys of every group.
+	if cfg.TLS != nil && cfg.TLS.CASecret != nil && cfg.TLS.CASecret.Name != "" {
+		return errors.New("tls ca_secret cannot be used with a custody group, use ca_file instead")
+	}
+	return nil
+}
+
+// custodySecretGetter reads Secrets straight from the API server. A custody group is only allowed to get its own
+// Secret, so it cannot use the Secret informer that lists every Secret.
+func custodySecretGetter(client kubernetes.Interface) secretGetter {
+	return func(namespace, name string) (*core.Secret, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), custodySecretTimeout)
+		defer cancel()
+
+		return client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+}
+
+// newCustodySubmissions creates the submissions of the custody group, or returns nil if no custody group is set.
+func newCustodySubmissions(state *stateStore, group string) *custodySubmissions {
+	if group == "" {
+		return nil
+	}
+
+	return &custodySubmissions{
+		state: state,
+		group: group,
+	}
+}
+
+// load parses the submissions of the custody group, dropping those older than custodySubmissionTTL. The submissions of
+// every group are returned, so the state can be saved again.
+func (c *custodySubmissions) load(data map[string]string) (map[string]map[string]*custodySubmission, error) {
+	groups := make(map[string]map[string]*custodySubmission)
+	if value, ok := data[stateCustodyKey]; ok {
+		if err := json.Unmarshal([]byte(value), &groups); err != nil {
+			return nil, fmt.Errorf("error parsing custody submissions: %w", err)
+		}
+	}
+	if groups[c.group] == nil {
+		groups[c.group] = make(map[string]*custodySubmission)
+	}
+
+	cutoff := time.Now().Add(-custodySubmissionTTL)
+	for pod, submission := range groups[c.group] {
+		if submission.At.Before(cutoff) {
+			delete(groups[c.group], pod)
+		}
+	}
+	return groups, nil
+}
+
+// save stores the submissions of every custody group.
+func (c *custodySubmissions) save(data map[string]string, groups map[string]map[string]*custodySubmission) error {
+	if len(groups[c.group]) == 0 {
+		delete(groups, c.group)
+	}
+
+	value, err := json.Marshal(groups)
+	if err != nil {
+		return fmt.Errorf("error marshalling custody submissions: %w", err)
+	}
+	data[stateCustodyKey] = string(value)
+	return nil
+}
+
+// Nonce returns the nonce of the unseal the pod was last given the keys of the custody group for, or an empty string
+// if the keys were not submitted to the pod.
+func (c *custodySubmissions) Nonce(ctx context.Context, pod *core.Pod) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+
+	data, err := c.state.Get(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	groups, err := c.load(data)
+	if err != nil {
+		return "", err
+	}
+	if submission, ok := groups[c.group][breakerPodID(pod)]; ok {
+		return submission.Nonce, nil
+	}
+	return "", nil
+}
+
+// Record remembers the keys of the custody group were submitted to the unseal of the pod with the given nonce.
+func (c *custodySubmissions) Record(ctx context.Context, pod *core.Pod, nonce string) error {
+	if c == nil || nonce == "" {
+		return nil
+	}
+
+	return c.state.Update(ctx, func(data map[string]string) error {
+		groups, err := c.load(data)
+		if err != nil {
+			return err
+		}
+
+		groups[c.group][breakerPodID(pod)] = &custodySubmission{
+			Nonce: nonce,
+			At:    time.Now().UTC(),
+		}
+		return c.save(data, groups)
+	})
+}
+
+// Forget forgets the unseal the pod was given the keys of the custody group for, e.g. because the pod was unsealed.
+func (c *custodySubmissions) Forget(ctx context.Context, pod *core.Pod) error {
+	if c == nil {
+		return nil
+	}
+
+	return c.state.Update(ctx, func(data map[string]string) error {
+		groups, err := c.load(data)
+		if err != nil {
+			return err
+		}
+
+		id := breakerPodID(pod)
+		if _, ok := groups[c.group][id]; !ok {
+			return errStateUnchanged
+		}
+		delete(groups[c.group], id)
+		return c.save(data, groups)
+	})
+}
+
+// withCustodySubmissions sets up the submissions of the custody group of the replica.
+func (a *App) withCustodySubmissions() web.StartOption {
+	return func(_ *web.App) error {
+		a.custody = newCustodySubmissions(a.state, a.config.CustodyGroup)
+		return nil
+	}
+}
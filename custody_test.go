@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCustodySubmissions(t *testing.T) {
+	t.Parallel()
+
+	store, _ := newTestStateStore(t)
+	a := newCustodySubmissions(store, "group-a")
+	b := newCustodySubmissions(store, "group-b")
+	ctx := context.Background()
+	pod := testPod("vault-0")
+
+	nonce, err := a.Nonce(ctx, pod)
+	assert.NoError(t, err)
+	assert.Empty(t, nonce)
+
+	assert.NoError(t, a.Record(ctx, pod, "nonce-a"))
+	assert.NoError(t, b.Record(ctx, pod, "nonce-b"))
+
+	// Every group only sees its own submissions.
+	nonce, err = a.Nonce(ctx, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, "nonce-a", nonce)
+	nonce, err = b.Nonce(ctx, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, "nonce-b", nonce)
+	nonce, err = a.Nonce(ctx, testPod("vault-1"))
+	assert.NoError(t, err)
+	assert.Empty(t, nonce)
+
+	assert.NoError(t, a.Forget(ctx, pod))
+	nonce, err = a.Nonce(ctx, pod)
+	assert.NoError(t, err)
+	assert.Empty(t, nonce)
+	nonce, err = b.Nonce(ctx, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, "nonce-b", nonce)
+}
+
+func TestCustodySubmissions_Expired(t *testing.T) {
+	t.Parallel()
+
+	store, _ := newTestStateStore(t)
+	value, err := json.Marshal(map[string]map[string]*custodySubmission{
+		"group-a": {"vault/vault-0": {Nonce: "nonce-a", At: time.Now().Add(-custodySubmissionTTL - time.Minute)}},
+	})
+	if err != nil {
+		t.Fatalf("error marshalling custody submissions: %v", err)
+	}
+	err = store.Update(context.Background(), func(data map[string]string) error {
+		data[stateCustodyKey] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error seeding custody submissions: %v", err)
+	}
+
+	nonce, err := newCustodySubmissions(store, "group-a").Nonce(context.Background(), testPod("vault-0"))
+	assert.NoError(t, err)
+	assert.Empty(t, nonce)
+}
+
+func TestNewCustodySubmissions_NoGroup(t *testing.T) {
+	t.Parallel()
+
+	c := newCustodySubmissions(nil, "")
+	assert.Nil(t, c)
+
+	nonce, err := c.Nonce(context.Background(), testPod("vault-0"))
+	assert.NoError(t, err)
+	assert.Empty(t, nonce)
+	assert.NoError(t, c.Record(context.Background(), testPod("vault-0"), "nonce-a"))
+	assert.NoError(t, c.Forget(context.Background(), testPod("vault-0")))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/k8s"
+	"github.com/jacobbrewer1/web/logging"
+	core "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// eventUnsealStarted is recorded when the unseal keys are about to be submitted to a sealed pod.
+	eventUnsealStarted = "UnsealStarted"
+
+	// eventUnsealed is recorded when a pod was unsealed.
+	eventUnsealed = "Unsealed"
+
+	// eventUnsealFailed is recorded when an attempt to unseal a pod failed.
+	eventUnsealFailed = "UnsealFailed"
+
+	// eventUnsealRefused is recorded when a pod could not be verified as a genuine Vault pod and was refused the keys.
+	eventUnsealRefused = "UnsealRefused"
+
+	// eventUnsealSkipped is recorded when a sealed pod was deliberately not unsealed.
+	eventUnsealSkipped = "UnsealSkipped"
+
+	// eventUnsealCircuitOpen is recorded when the unseal circuit breaker tripped and unsealing stopped.
+	eventUnsealCircuitOpen = "UnsealCircuitOpen"
+
+	// eventInitialized is recorded when an uninitialized pod was initialized.
+	eventInitialized = "Initialized"
+
+	// eventInitWriteFailed is recorded when the result of initializing a pod could not be written to the init Secret or
+	// file.
+	eventInitWriteFailed = "InitWriteFailed"
+
+	// eventRaftJoined is recorded when an uninitialized pod joined the Raft cluster of the active pod.
+	eventRaftJoined = "RaftJoined"
+
+	// eventUnsealPendingApproval is recorded when the unseal of a pod needs approval before the keys are submitted.
+	eventUnsealPendingApproval = "UnsealPendingApproval"
+)
+
+// withEventRecorder sets up the recorder of the events on the Vault pods. Events are sent to the Kubernetes API in the
+// background, so the API never holds up unsealing, and repeats of the same event on the same pod increase the count of
+// the existing event instead of creating a new one.
+func (a *App) withEventRecorder() web.StartOption {
+	return func(base *web.App) error {
+		l := logging.LoggerWithComponent(base.Logger(), "event-recorder")
+
+		broadcaster := record.NewBroadcaster()
+		broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+			Interface: base.KubeClient().CoreV1().Events(""),
+		})
+		broadcaster.StartEventWatcher(func(event *core.Event) {
+			l.Debug("Recorded event",
+				slog.String(loggingKeyNamespace, event.InvolvedObject.Namespace),
+				slog.String(loggingKeyPod, event.InvolvedObject.Name),
+				slog.String(loggingKeyReason, event.Reason),
+			)
+		})
+
+		go func() {
+			<-base.Done()
+			broadcaster.Shutdown()
+		}()
+
+		a.events = broadcaster.NewRecorder(scheme.Scheme, core.EventSource{
+			Component: appName,
+			Host:      k8s.NodeName(),
+		})
+		return nil
+	}
+}
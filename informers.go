@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/jacobbrewer1/web"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	kubeCache "k8s.io/client-go/tools/cache"
+)
+
+// informerResync is how often the informers replay every cached object to their handlers.
+const informerResync = 30 * time.Second
+
+// podScope returns the namespace and label selector that every Vault pod of the targets is in. The namespace is empty
+// unless every target is in the same namespace. The selector holds the requirements shared by every target, as a pod
+// matching any target must meet them.
+func (ts vaultTargets) podScope() (namespace string, selector labels.Selector) {
+	selector = labels.NewSelector()
+	if len(ts) == 0 {
+		return "", selector
+	}
+
+	namespace = ts[0].namespace
+	common, _ := ts[0].selector.Requirements()
+	common = slices.Clone(common) // The requirements are shared with the selector of the target.
+	for _, t := range ts[1:] {
+		if t.namespace != namespace {
+			namespace = ""
+		}
+
+		requirements, _ := t.selector.Requirements()
+		common = slices.DeleteFunc(common, func(r labels.Requirement) bool {
+			return !slices.ContainsFunc(requirements, func(other labels.Requirement) bool {
+				return other.String() == r.String()
+			})
+		})
+	}
+
+	return namespace, selector.Add(common...)
+}
+
+// secretRefs returns every distinct Secret read through a Secret informer, which are the unseal keys Secrets outside
+// of custody groups and the CA Secrets of the targets.
+func (ts vaultTargets) secretRefs() []*secretRef {
+	refs := make([]*secretRef, 0, len(ts))
+	seen := make(map[string]struct{}, len(ts))
+	add := func(ref *secretRef) {
+		if _, ok := seen[ref.String()]; ok {
+			return
+		}
+		seen[ref.String()] = struct{}{}
+		refs = append(refs, ref)
+	}
+
+	for _, t := range ts {
+		if t.unsealKeysSecret != nil && t.custodyGroup == "" {
+			add(t.unsealKeysSecret)
+		}
+		if t.tls.caSecret != nil {
+			add(t.tls.caSecret)
+		}
+	}
+	return refs
+}
+
+// withPodInformer sets up the pod informer, listing and watching only the pods that can be Vault pods of the targets.
+func (a *App) withPodInformer() web.StartOption {
+	return func(base *web.App) error {
+		namespace, selector := a.targets.podScope()
+		base.Logger().Info("Scoping pod informer",
+			slog.String(loggingKeyNamespace, namespace),
+			slog.String(loggingKeySelector, selector.String()),
+		)
+
+		return web.WithKubernetesPodInformer(
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+				opts.LabelSelector = selector.String()
+			}),
+		)(base)
+	}
+}
+
+// secretInformer lists and watches a single Secret.
+type secretInformer struct {
+	informer kubeCache.SharedIndexInformer
+	lister   listersv1.SecretLister
+}
+
+// newSecretInformers sets up an informer for every Secret the targets read, each listing and watching only that Secret
+// by name. This lets the Secrets be granted by name, as list and watch can only be granted by name when the request
+// selects a single object. The informers have their own factories, as the factory of the framework is scoped to the
+// Vault pods.
+func (a *App) newSecretInformers(base *web.App) {
+	a.secretInformers = make(map[string]*secretInformer)
+	for _, ref := range a.targets.secretRefs() {
+		base.Logger().Info("Scoping secret informer", slog.String(loggingKeySecret, ref.String()))
+
+		factory := informers.NewSharedInformerFactoryWithOptions(base.KubeClient(), informerResync,
+			informers.WithNamespace(ref.namespace),
+			informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+				opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", ref.name).String()
+			}),
+		)
+
+		secrets := factory.Core().V1().Secrets()
+		a.secretInformers[ref.String()] = &secretInformer{
+			informer: secrets.Informer(),
+			lister:   secrets.Lister(),
+		}
+	}
+}
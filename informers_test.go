@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// testTarget creates a target in the namespace with the selector.
+func testTarget(t *testing.T, namespace, selector string) *vaultTarget {
+	t.Helper()
+
+	s, err := labels.Parse(selector)
+	if err != nil {
+		t.Fatalf("error parsing selector %q: %v", selector, err)
+	}
+	return &vaultTarget{namespace: namespace, selector: s, tls: new(targetTLS)}
+}
+
+func TestVaultTargets_PodScope(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		targets       [][2]string
+		wantNamespace string
+		wantSelector  string
+	}{
+		{
+			name: "no targets",
+		},
+		{
+			name:          "single target",
+			targets:       [][2]string{{"vault", "app=vault,component=server"}},
+			wantNamespace: "vault",
+			wantSelector:  "app=vault,component=server",
+		},
+		{
+			name: "shared requirements",
+			targets: [][2]string{
+				{"vault", "app.kubernetes.io/name=vault,cluster=a"},
+				{"vault", "app.kubernetes.io/name=vault,cluster=b"},
+			},
+			wantNamespace: "vault",
+			wantSelector:  "app.kubernetes.io/name=vault",
+		},
+		{
+			name: "requirements shared by every target",
+			targets: [][2]string{
+				{"vault", "app=vault,component=server,cluster=a"},
+				{"vault", "app=vault,component=server,cluster=b"},
+				{"vault", "app=vault,cluster=c"},
+			},
+			wantNamespace: "vault",
+			wantSelector:  "app=vault",
+		},
+		{
+			name: "no shared requirements",
+			targets: [][2]string{
+				{"vault", "app=vault-a"},
+				{"vault", "app=vault-b"},
+			},
+			wantNamespace: "vault",
+		},
+		{
+			name: "requirements on the same key with other values",
+			targets: [][2]string{
+				{"vault", "app in (vault,vault-a)"},
+				{"vault", "app in (vault,vault-b)"},
+			},
+			wantNamespace: "vault",
+		},
+		{
+			name: "set based requirements",
+			targets: [][2]string{
+				{"vault", "app in (vault),!canary"},
+				{"vault", "app in (vault),tier=prod"},
+			},
+			wantNamespace: "vault",
+			wantSelector:  "app in (vault)",
+		},
+		{
+			name: "different namespaces",
+			targets: [][2]string{
+				{"vault-a", "app=vault,cluster=a"},
+				{"vault-b", "app=vault,cluster=b"},
+			},
+			wantSelector: "app=vault",
+		},
+		{
+			name: "a different namespace after the first two",
+			targets: [][2]string{
+				{"vault-a", "app=vault"},
+				{"vault-a", "app=vault"},
+				{"vault-b", "app=vault"},
+			},
+			wantSelector: "app=vault",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			targets := make(vaultTargets, 0, len(tt.targets))
+			for _, target := range tt.targets {
+				targets = append(targets, testTarget(t, target[0], target[1]))
+			}
+
+			namespace, selector := targets.podScope()
+			assert.Equal(t, tt.wantNamespace, namespace)
+			assert.Equal(t, tt.wantSelector, selector.String())
+
+			// The selectors of the targets are left as they were.
+			for i, target := range tt.targets {
+				want, _ := labels.Parse(target[1])
+				assert.Equal(t, want.String(), targets[i].selector.String())
+			}
+		})
+	}
+}
+
+func TestVaultTargets_SecretRefs(t *testing.T) {
+	t.Parallel()
+
+	a := testTarget(t, "vault-a", "app=vault")
+	a.unsealKeysSecret = &secretRef{namespace: "ops", name: "keys"}
+	a.tls.caSecret = &secretRef{namespace: "vault-a", name: "ca"}
+
+	// Shares the unseal keys Secret of a.
+	b := testTarget(t, "vault-b", "app=vault")
+	b.unsealKeysSecret = &secretRef{namespace: "ops", name: "keys"}
+	b.tls.caSecret = &secretRef{namespace: "vault-b", name: "ca"}
+
+	// Reads its unseal keys Secret for its custody group instead.
+	c := testTarget(t, "vault-c", "app=vault")
+	c.unsealKeysSecret = &secretRef{namespace: "ops", name: "keys-c"}
+	c.custodyGroup = "group-a"
+
+	var got []string
+	for _, ref := range (vaultTargets{a, b, c}).secretRefs() {
+		got = append(got, ref.String())
+	}
+	assert.Equal(t, []string{"ops/keys", "vault-a/ca", "vault-b/ca"}, got)
+}
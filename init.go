@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/jacobbrewer1/web/k8s"
+	core "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// defaultInitSecretShares is the number of unseal key shares Vault is initialized with if none is configured.
+	defaultInitSecretShares = 5
+
+	// defaultInitSecretThreshold is the number of unseal key shares required to unseal Vault if none is configured.
+	defaultInitSecretThreshold = 3
+
+	// initSecretRootTokenKey is the data key in the init Secret holding the root token.
+	initSecretRootTokenKey = "root-token"
+
+	// annotationInitializedPod records the pod that was initialized on the init Secret.
+	annotationInitializedPod = "vault-unseal.io/initialized-pod"
+
+	// skipInitEncrypted is the skip reason when the pod was initialized, but the unseal keys are PGP encrypted so they
+	// cannot be submitted.
+	skipInitEncrypted = "init_encrypted"
+
+	// initWriteAttempts is the number of times writing the result of initializing Vault is attempted before it is
+	// written to the fallback file instead.
+	initWriteAttempts = 5
+
+	// initWriteRetryDelay is the delay before the first retry of writing the result of initializing Vault, doubled on
+	// every retry.
+	initWriteRetryDelay = time.Second
+)
+
+type (
+	// initConfig is the configuration of how a target initializes Vault.
+	initConfig struct {
+		SecretShares    int               `mapstructure:"secret_shares"`
+		SecretThreshold int               `mapstructure:"secret_threshold"`
+		PGPKeys         []string          `mapstructure:"pgp_keys"`
+		RootTokenPGPKey string            `mapstructure:"root_token_pgp_key"`
+		Secret          *initSecretConfig `mapstructure:"secret"`
+		File            string            `mapstructure:"file"`
+		FallbackDir     string            `mapstructure:"fallback_dir"`
+
+		// AllowPlaintextRootToken allows writing to a Secret without root_token_pgp_key, storing the root token in
+		// plaintext.
+		AllowPlaintextRootToken bool `mapstructure:"allow_plaintext_root_token"`
+	}
+
+	// initSecretConfig is the configuration of the Kubernetes Secret the result of initializing Vault is written to.
+	initSecretConfig struct {
+		Name      string `mapstructure:"name"`
+		Namespace string `mapstructure:"namespace"`
+	}
+
+	// targetInit describes how a target initializes Vault, and where the unseal keys and root token are written to.
+	targetInit struct {
+		// request is sent to Vault to initialize it.
+		request *api.InitRequest
+
+		// secret references the Secret the unseal keys and root token are written to.
+		secret *secretRef
+
+		// file is the path of the file the unseal keys and root token are written to.
+		file string
+
+		// fallbackDir is the directory the result is written to if it cannot be written to the Secret or file.
+		fallbackDir string
+
+		// allowPlaintextRootToken allows writing a root token that is not PGP encrypted to the Secret.
+		allowPlaintextRootToken bool
+	}
+
+	// initSink is where the result of initializing Vault is written to. The sink is claimed before Vault is initialized,
+	// so an existing result is never overwritten.
+	initSink interface {
+		// Claim reserves the sink, failing if it already exists.
+		Claim(ctx context.Context, pod *core.Pod) error
+
+		// Write writes the result to the claimed sink.
+		Write(ctx context.Context, resp *api.InitResponse) error
+
+		// Release removes the claimed sink after Vault failed to initialize.
+		Release(ctx context.Context) error
+
+		// String describes the sink in logs and events.
+		String() string
+	}
+
+	// secretInitSink writes the result of initializing Vault to a Kubernetes Secret.
+	secretInitSink struct {
+		client kubernetes.Interface
+		init   *targetInit
+		ref    *secretRef
+		secret *core.Secret
+	}
+
+	// fileInitSink writes the result of initializing Vault to a file as JSON, in the format of
+	// `vault operator init -format=json`.
+	fileInitSink struct {
+		path string
+		file *os.File
+	}
+)
+
+// newTargetInit creates the init settings of a target from its configuration. Nil is returned if the target does not
+// initialize Vault.
+func newTargetInit(cfg *initConfig) (*targetInit, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	req := &api.InitRequest{
+		SecretShares:    cfg.SecretShares,
+		SecretThreshold: cfg.SecretThreshold,
+		PGPKeys:         cfg.PGPKeys,
+		RootTokenPGPKey: cfg.RootTokenPGPKey,
+	}
+	if req.SecretShares == 0 {
+		req.SecretShares = defaultInitSecretShares
+	}
+	if req.SecretThreshold == 0 {
+		req.SecretThreshold = min(defaultInitSecretThreshold, req.SecretShares)
+	}
+
+	switch {
+	case req.SecretThreshold < 1 || req.SecretThreshold > req.SecretShares:
+		return nil, fmt.Errorf("secret_threshold must be between 1 and secret_shares, got %d", req.SecretThreshold)
+	case req.SecretShares > 1 && req.SecretThreshold == 1:
+		return nil, errors.New("secret_threshold must be greater than 1 when there is more than one share")
+	case len(req.PGPKeys) > 0 && len(req.PGPKeys) != req.SecretShares:
+		return nil, fmt.Errorf("got %d pgp_keys, but secret_shares is %d", len(req.PGPKeys), req.SecretShares)
+	}
+
+	t := &targetInit{
+		request:                 req,
+		file:                    cfg.File,
+		fallbackDir:             cfg.FallbackDir,
+		allowPlaintextRootToken: cfg.AllowPlaintextRootToken,
+	}
+	if t.fallbackDir == "" {
+		t.fallbackDir = os.TempDir()
+	}
+
+	if ref := cfg.Secret; ref != nil && ref.Name != "" {
+		t.secret = &secretRef{
+			namespace: ref.Namespace,
+			name:      ref.Name,
+		}
+		if t.secret.namespace == "" {
+			t.secret.namespace = k8s.DeployedNamespace()
+		}
+	}
+
+	if t.secret == nil && t.file == "" {
+		return nil, errors.New("one of secret or file must be provided, so the unseal keys are not lost")
+	} else if t.secret != nil && t.file != "" {
+		return nil, errors.New("only one of secret or file can be provided")
+	} else if t.secret != nil && t.plaintextRootToken() {
+		return nil, errors.New("secret requires root_token_pgp_key, unless allow_plaintext_root_token is set")
+	}
+
+	return t, nil
+}
+
+// plaintextRootToken returns whether the Secret would hold the root token in plaintext without it being allowed. The
+// unseal keys may be stored in plaintext, so the pod can be unsealed with them.
+func (t *targetInit) plaintextRootToken() bool {
+	return !t.allowPlaintextRootToken && t.request.RootTokenPGPKey == ""
+}
+
+// encrypted returns whether the unseal keys are PGP encrypted, so they cannot be submitted to Vault.
+func (t *targetInit) encrypted() bool {
+	return len(t.request.PGPKeys) > 0
+}
+
+// writesTo returns whether the unseal keys are written to the given Secret.
+func (t *targetInit) writesTo(ref *secretRef) bool {
+	return t != nil && t.secret != nil && t.secret.String() == ref.String()
+}
+
+// secretDataKeys returns the data keys in the init Secret holding the unseal keys.
+func (t *targetInit) secretDataKeys() []string {
+	keys := make([]string, 0, t.request.SecretShares)
+	for i := range t.request.SecretShares {
+		keys = append(keys, initSecretKey(i))
+	}
+	return keys
+}
+
+// initSink returns where the result of initializing Vault is written to.
+func (a *App) initSink(t *targetInit) initSink {
+	if t.secret != nil {
+		return &secretInitSink{
+			client: a.base.KubeClient(),
+			init:   t,
+			ref:    t.secret,
+		}
+	}
+	return &fileInitSink{
+		path: t.file,
+	}
+}
+
+// Claim creates the Secret without any data.
+func (s *secretInitSink) Claim(ctx context.Context, pod *core.Pod) error {
+	secret, err := s.client.CoreV1().Secrets(s.ref.namespace).Create(ctx, &core.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.ref.name,
+			Namespace: s.ref.namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": appName,
+			},
+			Annotations: map[string]string{
+				annotationInitializedPod: pod.Namespace + "/" + pod.Name,
+			},
+		},
+		Type: core.SecretTypeOpaque,
+	}, metav1.CreateOptions{})
+	if kubeErrors.IsAlreadyExists(err) {
+		return fmt.Errorf("init secret %s already exists, refusing to overwrite it", s.ref)
+	} else if err != nil {
+		return fmt.Errorf("error creating init secret %s: %w", s.ref, err)
+	}
+
+	s.secret = secret
+	return nil
+}
+
+// Write stores every unseal key and the root token in the Secret, and makes it immutable. The root token is only
+// stored if it is PGP encrypted, or storing it in plaintext is allowed. Write can be retried after it failed.
+func (s *secretInitSink) Write(ctx context.Context, resp *api.InitResponse) error {
+	if s.init.plaintextRootToken() {
+		return fmt.Errorf("refusing to store a plaintext root token in init secret %s", s.ref)
+	}
+
+	data := make(map[string][]byte, len(resp.Keys)+1)
+	for i, key := range resp.Keys {
+		data[initSecretKey(i)] = []byte(key)
+	}
+	data[initSecretRootTokenKey] = []byte(resp.RootToken)
+
+	secret := s.secret.DeepCopy()
+	immutable := true
+	secret.Data = data
+	secret.Immutable = &immutable
+
+	_, err := s.client.CoreV1().Secrets(s.ref.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	if kubeErrors.IsConflict(err) {
+		// An earlier attempt may have been applied without its response arriving.
+		current, getErr := s.client.CoreV1().Secrets(s.ref.namespace).Get(ctx, s.ref.name, metav1.GetOptions{})
+		if getErr == nil && current.UID == s.secret.UID {
+			if maps.EqualFunc(current.Data, data, bytes.Equal) {
+				return nil
+			}
+			s.secret = current
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error updating init secret %s: %w", s.ref, err)
+	}
+	return nil
+}
+
+// Release deletes the Secret if it was not changed since it was claimed.
+func (s *secretInitSink) Release(ctx context.Context) error {
+	err := s.client.CoreV1().Secrets(s.ref.namespace).Delete(ctx, s.ref.name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{
+			UID:             &s.secret.UID,
+			ResourceVersion: &s.secret.ResourceVersion,
+		},
+	})
+	if err != nil && !kubeErrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting init secret %s: %w", s.ref, err)
+	}
+	return nil
+}
+
+// String describes the Secret.
+func (s *secretInitSink) String() string {
+	return "init secret " + s.ref.String()
+}
+
+// initSecretKey returns the data key in the init Secret holding the unseal key with the given index.
+func initSecretKey(i int) string {
+	return "unseal-key-" + strconv.Itoa(i)
+}
+
+// Claim creates the file, which must not exist.
+func (s *fileInitSink) Claim(_ context.Context, _ *core.Pod) error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600) // nolint:gosec
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("init file %s already exists, refusing to overwrite it", s.path)
+	} else if err != nil {
+		return fmt.Errorf("error creating init file %s: %w", s.path, err)
+	}
+
+	s.file = file
+	return nil
+}
+
+// Write writes the result to the file as JSON, replacing anything an earlier attempt wrote.
+func (s *fileInitSink) Write(_ context.Context, resp *api.InitResponse) error {
+	if err := s.file.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating init file %s: %w", s.path, err)
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking init file %s: %w", s.path, err)
+	}
+
+	enc := json.NewEncoder(s.file)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(resp); err != nil {
+		return fmt.Errorf("error writing init file %s: %w", s.path, err)
+	}
+
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing init file %s: %w", s.path, err)
+	}
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("error closing init file %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// Release removes the file.
+func (s *fileInitSink) Release(_ context.Context) error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("error closing init file %s: %w", s.path, err)
+	}
+	if err := os.Remove(s.path); err != nil {
+		return fmt.Errorf("error removing init file %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// String describes the file.
+func (s *fileInitSink) String() string {
+	return "init file " + s.path
+}
+
+// writeInitResponse writes the result of initializing Vault to the sink, retrying with backoff. Vault only returns the
+// unseal keys and root token once, so the same result is written on every attempt.
+func writeInitResponse(ctx context.Context, l *slog.Logger, sink initSink, resp *api.InitResponse) error {
+	delay := initWriteRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := sink.Write(ctx, resp)
+		if err == nil || attempt == initWriteAttempts {
+			return err
+		}
+
+		l.Warn("Error writing result of initializing vault, retrying",
+			slog.Int(loggingKeyAttempt, attempt),
+			slog.String(loggingKeyError, err.Error()),
+		)
+
+		// Not cancelled with the context, as Vault cannot be initialized again.
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// writeInitFallback writes the result of initializing the pod to a new file in the fallback directory, returning the
+// path of the file.
+func writeInitFallback(ctx context.Context, t *targetInit, pod *core.Pod, resp *api.InitResponse) (string, error) {
+	name := fmt.Sprintf("vault-init-%s-%s-%d.json", pod.Namespace, pod.Name, time.Now().Unix())
+	sink := &fileInitSink{
+		path: filepath.Join(t.fallbackDir, name),
+	}
+	if err := sink.Claim(ctx, pod); err != nil {
+		return "", err
+	}
+	if err := sink.Write(ctx, resp); err != nil {
+		return "", err
+	}
+	return sink.path, nil
+}
+
+// initWriteFailed writes the result of initializing the pod to the fallback file after it could not be written to the
+// sink, and escalates to humans, who must move the result somewhere safe before the replica restarts.
+func (a *App) initWriteFailed(
+	ctx context.Context,
+	l *slog.Logger,
+	target *vaultTarget,
+	pod *core.Pod,
+	sink initSink,
+	resp *api.InitResponse,
+	writeErr error,
+) {
+	message := fmt.Sprintf("Vault was initialized, but the result could not be written to %s: %v", sink, writeErr)
+
+	path, err := writeInitFallback(ctx, target.init, pod, resp)
+	if err != nil {
+		l.Error("Error writing result of initializing vault to the fallback file", slog.String(loggingKeyError, err.Error()))
+		message += fmt.Sprintf(", nor to the fallback file: %v", err)
+	} else {
+		l.Error("Result of initializing vault written to the fallback file, move it before the replica restarts",
+			slog.String(loggingKeyFile, path),
+		)
+		message += fmt.Sprintf(". It was written to %s on replica %s instead, move it before the replica restarts",
+			path, k8s.PodName())
+	}
+
+	a.events.Event(pod, core.EventTypeWarning, eventInitWriteFailed, message)
+
+	event := newUnsealEvent(target, pod, 0, time.Now())
+	event.Severity = severityCritical
+	event.Error = message
+	notify(ctx, l, target, event)
+}
+
+// initVaultPod initializes the Vault pod if the target initializes Vault and the pod is not initialized. The unseal
+// keys are returned if Vault was initialized by this call and they are not PGP encrypted, so they can be submitted
+// straight away.
+//
+// Only the first pod of the target, ordered by name, is initialized. The other pods share its storage or join it, and
+// initializing them as well would create separate clusters.
+func (a *App) initVaultPod(
+	ctx context.Context,
+	l *slog.Logger,
+	target *vaultTarget,
+	pod *core.Pod,
+	vc *api.Client,
+	record unsealRecorder,
+) ([]string, error) {
+	if target.init == nil {
+		return nil, nil
+	}
+
+	initialized, err := vaultInitStatus(ctx, vc)
+	if err != nil {
+		return nil, withReason(reasonSealStatus, err)
+	} else if initialized {
+		return nil, nil
+	}
+
+	first, err := a.firstTargetPod(target)
+	if err != nil {
+		return nil, withReason(reasonInit, err)
+	} else if first != pod.Name {
+		return nil, skipUnseal(skipNotInitialized, fmt.Sprintf("vault is not initialized, only %s is initialized", first))
+	}
+
+	sink := a.initSink(target.init)
+	if err := sink.Claim(ctx, pod); err != nil {
+		return nil, withReason(reasonInit, err)
+	}
+
+	l.Info("Uninitialized Vault pod detected, initializing vault",
+		slog.Int(loggingKeyShares, target.init.request.SecretShares),
+		slog.Int(loggingKeyThreshold, target.init.request.SecretThreshold),
+	)
+
+	resp, err := vc.Sys().InitWithContext(ctx, target.init.request)
+	recordErr := record(auditActionInit, 0, nil, err)
+	if err != nil {
+		if releaseErr := sink.Release(context.WithoutCancel(ctx)); releaseErr != nil {
+			l.Error("Error releasing init sink", slog.String(loggingKeyError, releaseErr.Error()))
+		}
+		return nil, withReason(reasonInit, fmt.Errorf("error initializing vault: %w", err))
+	}
+
+	// Vault is initialized now, so the unseal keys must be written even if the unseal was cancelled. If they cannot be,
+	// the pod is still unsealed with them, as they would otherwise only be held in memory.
+	ctx = context.WithoutCancel(ctx)
+	if err := writeInitResponse(ctx, l, sink, resp); err != nil {
+		l.Error("Error writing unseal keys and root token of initialized vault", slog.String(loggingKeyError, err.Error()))
+		a.initWriteFailed(ctx, l, target, pod, sink, resp, err)
+	}
+
+	l.Info("Vault initialized")
+	a.events.Eventf(pod, core.EventTypeNormal, eventInitialized, "Initialized Vault pod with %d unseal key shares and a threshold of %d",
+		target.init.request.SecretShares, target.init.request.SecretThreshold)
+
+	// The unseal keys are written, but not submitted to the pod without a record of the init.
+	if recordErr != nil {
+		return nil, withReason(reasonAudit, recordErr)
+	}
+
+	if target.init.encrypted() {
+		return nil, skipUnseal(skipInitEncrypted, "vault was initialized, but its unseal keys are PGP encrypted")
+	}
+	return resp.Keys, nil
+}
+
+// vaultInitStatus asks the Vault pod whether it is initialized.
+func vaultInitStatus(ctx context.Context, vc *api.Client) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, sealStatusTimeout)
+	defer cancel()
+
+	initialized, err := vc.Sys().InitStatusWithContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error getting init status: %w", err)
+	}
+	return initialized, nil
+}
+
+// firstTargetPod returns the name of the first pod of the target, ordered by name.
+func (a *App) firstTargetPod(target *vaultTarget) (string, error) {
+	pods, err := a.base.PodLister().Pods(target.namespace).List(target.selector)
+	if err != nil {
+		return "", fmt.Errorf("error listing pods: %w", err)
+	} else if len(pods) == 0 {
+		return "", errors.New("no pods found")
+	}
+
+	names := make([]string, 0, len(pods))
+	for _, pod := range pods {
+		names = append(names, pod.Name)
+	}
+	return slices.Min(names), nil
+}
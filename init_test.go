@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+)
+
+var testInitResponse = &api.InitResponse{
+	Keys:      []string{"key-0", "key-1", "key-2"},
+	KeysB64:   []string{"a2V5LTA=", "a2V5LTE=", "a2V5LTI="},
+	RootToken: "root-token",
+}
+
+func TestNewTargetInit(t *testing.T) {
+	t.Parallel()
+
+	secret := &initSecretConfig{Name: "vault-init", Namespace: "vault"}
+	pgpKeys := []string{"pgp-0", "pgp-1", "pgp-2"}
+
+	tests := []struct {
+		name    string
+		cfg     *initConfig
+		wantErr string
+	}{
+		{
+			name: "file",
+			cfg:  &initConfig{File: "/tmp/vault-init.json"},
+		},
+		{
+			name: "secret with every key encrypted",
+			cfg: &initConfig{
+				SecretShares:    3,
+				PGPKeys:         pgpKeys,
+				RootTokenPGPKey: "pgp-root",
+				Secret:          secret,
+			},
+		},
+		{
+			name: "secret with plaintext allowed",
+			cfg:  &initConfig{Secret: secret, AllowPlaintextRootToken: true},
+		},
+		{
+			name: "secret with plaintext unseal keys and an encrypted root token",
+			cfg:  &initConfig{RootTokenPGPKey: "pgp-root", Secret: secret},
+		},
+		{
+			name:    "secret in plaintext",
+			cfg:     &initConfig{Secret: secret},
+			wantErr: "secret requires root_token_pgp_key, unless allow_plaintext_root_token is set",
+		},
+		{
+			name:    "secret with encrypted unseal keys and a plaintext root token",
+			cfg:     &initConfig{SecretShares: 3, PGPKeys: pgpKeys, Secret: secret},
+			wantErr: "secret requires root_token_pgp_key, unless allow_plaintext_root_token is set",
+		},
+		{
+			name:    "no secret or file",
+			cfg:     &initConfig{},
+			wantErr: "one of secret or file must be provided, so the unseal keys are not lost",
+		},
+		{
+			name:    "secret and file",
+			cfg:     &initConfig{Secret: secret, File: "/tmp/vault-init.json", AllowPlaintextRootToken: true},
+			wantErr: "only one of secret or file can be provided",
+		},
+		{
+			name:    "threshold above the shares",
+			cfg:     &initConfig{SecretShares: 3, SecretThreshold: 4, File: "/tmp/vault-init.json"},
+			wantErr: "secret_threshold must be between 1 and secret_shares, got 4",
+		},
+		{
+			name:    "pgp keys not matching the shares",
+			cfg:     &initConfig{PGPKeys: pgpKeys[:2], File: "/tmp/vault-init.json"},
+			wantErr: "got 2 pgp_keys, but secret_shares is 5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := newTargetInit(tt.cfg)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, os.TempDir(), got.fallbackDir)
+			}
+		})
+	}
+}
+
+func TestSecretInitSink_WriteRefusesPlaintextRootToken(t *testing.T) {
+	t.Parallel()
+
+	sink := &secretInitSink{
+		init: &targetInit{request: &api.InitRequest{SecretShares: 3}},
+		ref:  &secretRef{namespace: "vault", name: "vault-init"},
+	}
+	err := sink.Write(context.Background(), testInitResponse)
+	assert.EqualError(t, err, "refusing to store a plaintext root token in init secret vault/vault-init")
+}
+
+// flakyInitSink fails to write the given number of times before writing to the file sink.
+type flakyInitSink struct {
+	*fileInitSink
+	failures int
+	writes   int
+}
+
+func (s *flakyInitSink) Write(ctx context.Context, resp *api.InitResponse) error {
+	s.writes++
+	if s.writes <= s.failures {
+		// Leave part of the result behind, as a write failing half way would.
+		if _, err := s.file.WriteString(`{"keys":`); err != nil {
+			return err
+		}
+		return errors.New("connection reset")
+	}
+	return s.fileInitSink.Write(ctx, resp)
+}
+
+func TestWriteInitResponse_Retries(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "vault-init.json")
+	sink := &flakyInitSink{fileInitSink: &fileInitSink{path: path}, failures: 1}
+	if !assert.NoError(t, sink.Claim(context.Background(), &core.Pod{})) {
+		return
+	}
+
+	err := writeInitResponse(context.Background(), slog.New(slog.DiscardHandler), sink, testInitResponse)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, sink.writes)
+
+	data, err := os.ReadFile(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	got := new(api.InitResponse)
+	if assert.NoError(t, json.Unmarshal(data, got)) {
+		assert.Equal(t, testInitResponse, got)
+	}
+}
+
+func TestWriteInitFallback(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	pod := testPod("vault-0")
+
+	path, err := writeInitFallback(context.Background(), &targetInit{fallbackDir: dir}, pod, testInitResponse)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, dir, filepath.Dir(path))
+	assert.Contains(t, filepath.Base(path), "vault-init-vault-vault-0-")
+
+	info, err := os.Stat(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	data, err := os.ReadFile(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	got := new(api.InitResponse)
+	if assert.NoError(t, json.Unmarshal(data, got)) {
+		assert.Equal(t, testInitResponse, got)
+	}
+
+	missing := &targetInit{fallbackDir: filepath.Join(dir, "missing")}
+	_, err = writeInitFallback(context.Background(), missing, pod, testInitResponse)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/vault/api"
+	core "k8s.io/api/core/v1"
+)
+
+type (
+	// keySource provides the unseal keys that are submitted to a sealed Vault pod.
+	keySource interface {
+		// UnsealKeys returns the unseal keys in the order they should be submitted to Vault.
+		UnsealKeys() ([]string, error)
+	}
+
+	// monitoredKeySource is a keySource that records whether the keys of the target could be read.
+	monitoredKeySource struct {
+		keySource
+		target string
+	}
+
+	// staticKeySource is a keySource backed by the keys listed in the configuration file.
+	staticKeySource []string
+
+	// secretGetter reads the Secret with the given namespace and name.
+	secretGetter func(namespace, name string) (*core.Secret, error)
+
+	// secretKeySource is a keySource backed by a Kubernetes Secret. The Secret is read on every call, so any change to
+	// the Secret is picked up without restarting the application. The keys are only decrypted again when the resource
+	// version of the Secret changes.
+	secretKeySource struct {
+		secrets   secretGetter
+		decrypter *keyDecrypter
+		namespace string
+		name      string
+		dataKeys  []string
+		threshold int
+
+		// partial is set if the Secret only holds the keys of a custody group, which must be fewer than the threshold.
+		partial bool
+
+		// mu guards the keys last read from the Secret, and the resource version they were read from.
+		mu              sync.Mutex
+		resourceVersion string
+		keys            []string
+	}
+)
+
+// newMonitoredKeySource wraps the key source of the target so its health is exported as a metric.
+func newMonitoredKeySource(target string, source keySource) *monitoredKeySource {
+	return &monitoredKeySource{
+		keySource: source,
+		target:    target,
+	}
+}
+
+// UnsealKeys returns the keys of the wrapped source, recording whether they could be read.
+func (s *monitoredKeySource) UnsealKeys() ([]string, error) {
+	keys, err := s.keySource.UnsealKeys()
+	keySourceHealthy.WithLabelValues(s.target).Set(boolToFloat(err == nil))
+	return keys, err
+}
+
+// UnsealKeys returns the keys from the configuration file.
+func (s staticKeySource) UnsealKeys() ([]string, error) {
+	return s, nil
+}
+
+// newSecretKeySource creates a keySource that reads the unseal keys from the given Secret. If no data keys are
+// provided, every entry in the Secret is used, ordered by its data key. Encrypted keys are decrypted with the given
+// decrypter.
+func newSecretKeySource(
+	secrets secretGetter,
+	decrypter *keyDecrypter,
+	namespace, name string,
+	dataKeys []string,
+	threshold int,
+	partial bool,
+) *secretKeySource {
+	return &secretKeySource{
+		secrets:   secrets,
+		decrypter: decrypter,
+		namespace: namespace,
+		name:      name,
+		dataKeys:  dataKeys,
+		threshold: threshold,
+		partial:   partial,
+	}
+}
+
+// UnsealKeys returns the keys currently held in the Secret.
+func (s *secretKeySource) UnsealKeys() ([]string, error) {
+	secret, err := s.secrets(s.namespace, s.name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting unseal keys secret %s/%s: %w", s.namespace, s.name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if secret.ResourceVersion != "" && secret.ResourceVersion == s.resourceVersion {
+		return slices.Clone(s.keys), nil
+	}
+
+	dataKeys := s.dataKeys
+	if len(dataKeys) == 0 {
+		dataKeys = make([]string, 0, len(secret.Data))
+		for k := range secret.Data {
+			dataKeys = append(dataKeys, k)
+		}
+		slices.Sort(dataKeys)
+	}
+
+	keys := make([]string, 0, len(dataKeys))
+	for _, k := range dataKeys {
+		value, ok := secret.Data[k]
+		if !ok {
+			return nil, fmt.Errorf("key %s not found in unseal keys secret %s/%s", k, s.namespace, s.name)
+		}
+
+		key, err := s.decrypter.Decrypt(strings.TrimSpace(string(value)))
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting key %s in unseal keys secret %s/%s: %w", k, s.namespace, s.name, err)
+		}
+		keys = append(keys, key)
+	}
+
+	if err := validateUnsealKeys(keys, s.threshold, s.partial); err != nil {
+		return nil, fmt.Errorf("invalid unseal keys in secret %s/%s: %w", s.namespace, s.name, err)
+	}
+
+	s.resourceVersion = secret.ResourceVersion
+	s.keys = keys
+	return slices.Clone(keys), nil
+}
+
+// validateUnsealKeys checks that unseal keys are provided, and that there are enough keys to meet the threshold if one
+// is configured. Partial keys, held by a custody group, must instead be fewer than the threshold. The keys are checked
+// against the threshold reported by Vault when unsealing.
+func validateUnsealKeys(keys []string, threshold int, partial bool) error {
+	if len(keys) == 0 {
+		return errors.New("no unseal keys provided")
+	}
+
+	if partial {
+		if threshold > 0 && len(keys) >= threshold {
+			return fmt.Errorf("%d unseal keys provided, but a custody group must hold fewer than the threshold of %d",
+				len(keys), threshold)
+		}
+		return nil
+	}
+
+	if threshold > 0 && len(keys) < threshold {
+		return fmt.Errorf("%d unseal keys provided, but the threshold is %d", len(keys), threshold)
+	}
+	return nil
+}
+
+// validateUnsealKeysForStatus checks the unseal keys against the threshold and number of key shares reported by Vault.
+// Partial keys must be fewer than the threshold.
+func validateUnsealKeysForStatus(keys []string, status *api.SealStatusResponse, partial bool) error {
+	if status.T <= 0 {
+		return fmt.Errorf("vault reported an invalid threshold of %d", status.T)
+	}
+
+	if partial && len(keys) >= status.T {
+		return fmt.Errorf("%d unseal keys provided, but a custody group must hold fewer than the %d vault requires",
+			len(keys), status.T)
+	}
+
+	if !partial && len(keys) < status.T {
+		return fmt.Errorf("%d unseal keys provided, but vault requires %d", len(keys), status.T)
+	}
+
+	if status.N > 0 && len(keys) > status.N {
+		return fmt.Errorf("%d unseal keys provided, but vault only has %d key shares", len(keys), status.N)
+	}
+	return nil
+}
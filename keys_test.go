@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// keysSecret creates an unseal keys Secret at the resource version, holding the data.
+func keysSecret(resourceVersion string, data map[string]string) *core.Secret {
+	secret := &core.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "vault-keys", Namespace: "vault", ResourceVersion: resourceVersion},
+		Data:       make(map[string][]byte, len(data)),
+	}
+	for k, v := range data {
+		secret.Data[k] = []byte(v)
+	}
+	return secret
+}
+
+func TestSecretKeySource_UnsealKeys(t *testing.T) {
+	t.Parallel()
+
+	encrypted, err := encryptWithPassphrase("key-1", "passphrase")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		name       string
+		secret     *core.Secret
+		getErr     error
+		passphrase string
+		dataKeys   []string
+		threshold  int
+		partial    bool
+		want       []string
+		wantErr    string
+	}{
+		{
+			name:   "every key ordered by its data key",
+			secret: keysSecret("1", map[string]string{"key-2": "c", "key-0": "a\n", "key-1": "b"}),
+			want:   []string{"a", "b", "c"},
+		},
+		{
+			name:     "data keys in the configured order",
+			secret:   keysSecret("1", map[string]string{"key-0": "a", "key-1": "b", "other": "c"}),
+			dataKeys: []string{"key-1", "key-0"},
+			want:     []string{"b", "a"},
+		},
+		{
+			name:       "encrypted key",
+			secret:     keysSecret("1", map[string]string{"key-0": "a", "key-1": encrypted}),
+			passphrase: "passphrase",
+			want:       []string{"a", "key-1"},
+		},
+		{
+			name:      "custody group",
+			secret:    keysSecret("1", map[string]string{"key-0": "a"}),
+			threshold: 2,
+			partial:   true,
+			want:      []string{"a"},
+		},
+		{
+			name:    "secret not found",
+			getErr:  errors.New(`secret "vault-keys" not found`),
+			wantErr: `error getting unseal keys secret vault/vault-keys: secret "vault-keys" not found`,
+		},
+		{
+			name:     "data key not found",
+			secret:   keysSecret("1", map[string]string{"key-0": "a"}),
+			dataKeys: []string{"key-0", "key-1"},
+			wantErr:  "key key-1 not found in unseal keys secret vault/vault-keys",
+		},
+		{
+			name:   "encrypted key without a passphrase",
+			secret: keysSecret("1", map[string]string{"key-0": encrypted}),
+			wantErr: "error decrypting key key-0 in unseal keys secret vault/vault-keys: " +
+				errNoDecryptionKey.Error(),
+		},
+		{
+			name:      "fewer keys than the threshold",
+			secret:    keysSecret("1", map[string]string{"key-0": "a"}),
+			threshold: 2,
+			wantErr:   "invalid unseal keys in secret vault/vault-keys: 1 unseal keys provided, but the threshold is 2",
+		},
+		{
+			name:    "empty secret",
+			secret:  keysSecret("1", nil),
+			wantErr: "invalid unseal keys in secret vault/vault-keys: no unseal keys provided",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			decrypter := &keyDecrypter{passphrase: tt.passphrase}
+			secrets := func(namespace, name string) (*core.Secret, error) {
+				assert.Equal(t, "vault", namespace)
+				assert.Equal(t, "vault-keys", name)
+				return tt.secret, tt.getErr
+			}
+
+			s := newSecretKeySource(secrets, decrypter, "vault", "vault-keys", tt.dataKeys, tt.threshold, tt.partial)
+			got, err := s.UnsealKeys()
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSecretKeySource_UnsealKeys_Cached(t *testing.T) {
+	t.Parallel()
+
+	secret := keysSecret("1", map[string]string{"key-0": "a"})
+	getErr := error(nil)
+	secrets := func(string, string) (*core.Secret, error) {
+		return secret, getErr
+	}
+	s := newSecretKeySource(secrets, new(keyDecrypter), "vault", "vault-keys", nil, 0, false)
+
+	got, err := s.UnsealKeys()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, got)
+
+	// The keys are not read again while the resource version is unchanged, and callers cannot change the cached keys.
+	got[0] = "changed"
+	secret.Data["key-0"] = []byte("b")
+	got, err = s.UnsealKeys()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, got)
+
+	// A new resource version is read again.
+	secret = keysSecret("2", map[string]string{"key-0": "b"})
+	got, err = s.UnsealKeys()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b"}, got)
+
+	// Invalid keys are not cached, so the previous keys are not returned for the new version.
+	secret = keysSecret("3", nil)
+	_, err = s.UnsealKeys()
+	assert.EqualError(t, err, "invalid unseal keys in secret vault/vault-keys: no unseal keys provided")
+
+	// Errors reading the Secret are always returned.
+	getErr = errors.New("informer not synced")
+	_, err = s.UnsealKeys()
+	assert.EqualError(t, err, "error getting unseal keys secret vault/vault-keys: informer not synced")
+
+	// Secrets without a resource version are never cached.
+	getErr = nil
+	secret = keysSecret("", map[string]string{"key-0": "c"})
+	_, err = s.UnsealKeys()
+	assert.NoError(t, err)
+	secret.Data["key-0"] = []byte("d")
+	got, err = s.UnsealKeys()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"d"}, got)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jacobbrewer1/goredis"
+	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/k8s"
+	"github.com/jacobbrewer1/web/logging"
+	coordination "k8s.io/api/coordination/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// lockBackendLease locks pods with Lease objects in the deployed namespace.
+	lockBackendLease = "lease"
+
+	// lockBackendRedis locks pods with keys in Redis.
+	lockBackendRedis = "redis"
+
+	// lockBackendNone does not lock pods.
+	lockBackendNone = "none"
+
+	// annotationLockedPod records the pod a lock Lease is for, as the name of the Lease is a hash.
+	annotationLockedPod = "vault-unseal.io/pod"
+
+	// lockReleaseTimeout is the maximum time to wait for a lock to be released.
+	lockReleaseTimeout = 5 * time.Second
+)
+
+// redisUnlockScript deletes the lock only if it is still held by the given holder, so an expired lock taken over by
+// another replica is not released.
+const redisUnlockScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+
+type (
+	// podLocker stops two replicas from unsealing the same pod at once. Locks expire after their TTL, so a replica that
+	// crashed while holding a lock does not block the pod forever.
+	podLocker interface {
+		// Lock takes the lock of the pod, in the form namespace/name. If another replica holds the lock, it is not taken
+		// and the holder is returned.
+		Lock(ctx context.Context, pod string) (holder string, err error)
+
+		// Unlock releases the lock of the pod if this replica still holds it.
+		Unlock(ctx context.Context, pod string) error
+	}
+
+	// leaseLocker locks pods with a Lease object per pod.
+	leaseLocker struct {
+		client    kubernetes.Interface
+		namespace string
+		identity  string
+		ttl       time.Duration
+	}
+
+	// redisLocker locks pods with a Redis key per pod.
+	redisLocker struct {
+		pool     goredis.Pool
+		identity string
+		ttl      time.Duration
+	}
+)
+
+// lockName returns the name of the lock of the pod. Pod names can be as long as a Lease name, so the name is hashed.
+func lockName(pod string) string {
+	sum := sha256.Sum256([]byte(pod))
+	return appName + "-lock-" + hex.EncodeToString(sum[:8])
+}
+
+// newLeaseLocker creates a locker that keeps a Lease per pod in the given namespace.
+func newLeaseLocker(client kubernetes.Interface, namespace, identity string, ttl time.Duration) *leaseLocker {
+	return &leaseLocker{
+		client:    client,
+		namespace: namespace,
+		identity:  identity,
+		ttl:       ttl,
+	}
+}
+
+// Lock takes the Lease of the pod, creating it if it does not exist or taking it over if it expired.
+func (l *leaseLocker) Lock(ctx context.Context, pod string) (string, error) {
+	leases := l.client.CoordinationV1().Leases(l.namespace)
+	name := lockName(pod)
+
+	now := metav1.NewMicroTime(time.Now())
+	ttl := int32(l.ttl.Seconds())
+	spec := coordination.LeaseSpec{
+		HolderIdentity:       &l.identity,
+		LeaseDurationSeconds: &ttl,
+		AcquireTime:          &now,
+		RenewTime:            &now,
+	}
+
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	if kubeErrors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordination.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: l.namespace,
+				Labels: map[string]string{
+					"app.kubernetes.io/managed-by": appName,
+				},
+				Annotations: map[string]string{
+					annotationLockedPod: pod,
+				},
+			},
+			Spec: spec,
+		}, metav1.CreateOptions{})
+		if kubeErrors.IsAlreadyExists(err) {
+			return l.holder(ctx, name)
+		} else if err != nil {
+			return "", fmt.Errorf("error creating lock lease %s/%s: %w", l.namespace, name, err)
+		}
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("error getting lock lease %s/%s: %w", l.namespace, name, err)
+	}
+
+	if holder := leaseHolder(lease); holder != "" && holder != l.identity {
+		return holder, nil
+	}
+
+	lease.Spec = spec
+	if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); kubeErrors.IsConflict(err) {
+		return l.holder(ctx, name)
+	} else if err != nil {
+		return "", fmt.Errorf("error updating lock lease %s/%s: %w", l.namespace, name, err)
+	}
+	return "", nil
+}
+
+// holder returns the holder of the Lease after another replica took it first.
+func (l *leaseLocker) holder(ctx context.Context, name string) (string, error) {
+	lease, err := l.client.CoordinationV1().Leases(l.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("error getting lock lease %s/%s: %w", l.namespace, name, err)
+	}
+
+	if holder := leaseHolder(lease); holder != "" {
+		return holder, nil
+	}
+	return "another replica", nil
+}
+
+// leaseHolder returns the holder of the Lease, or an empty string if it is not held or expired.
+func leaseHolder(lease *coordination.Lease) string {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return ""
+	}
+
+	expires := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+	if time.Now().After(expires) {
+		return ""
+	}
+	return *spec.HolderIdentity
+}
+
+// Unlock deletes the Lease of the pod if this replica still holds it.
+func (l *leaseLocker) Unlock(ctx context.Context, pod string) error {
+	leases := l.client.CoordinationV1().Leases(l.namespace)
+	name := lockName(pod)
+
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	if kubeErrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error getting lock lease %s/%s: %w", l.namespace, name, err)
+	}
+
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.identity {
+		return nil
+	}
+
+	err = leases.Delete(ctx, name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{
+			UID:             &lease.UID,
+			ResourceVersion: &lease.ResourceVersion,
+		},
+	})
+	if err != nil && !kubeErrors.IsNotFound(err) && !kubeErrors.IsConflict(err) {
+		return fmt.Errorf("error deleting lock lease %s/%s: %w", l.namespace, name, err)
+	}
+	return nil
+}
+
+// newRedisLocker creates a locker that keeps a key per pod in Redis.
+func newRedisLocker(pool goredis.Pool, identity string, ttl time.Duration) *redisLocker {
+	return &redisLocker{
+		pool:     pool,
+		identity: identity,
+		ttl:      ttl,
+	}
+}
+
+// Lock sets the key of the pod if it is not set.
+func (l *redisLocker) Lock(ctx context.Context, pod string) (string, error) {
+	key := lockName(pod)
+
+	_, err := redis.String(l.pool.DoCtx(ctx, "SET", key, l.identity, "NX", "PX", l.ttl.Milliseconds()))
+	if err == nil {
+		return "", nil
+	} else if !errors.Is(err, redis.ErrNil) {
+		return "", fmt.Errorf("error setting lock key %s: %w", key, err)
+	}
+
+	holder, err := redis.String(l.pool.DoCtx(ctx, "GET", key))
+	if errors.Is(err, redis.ErrNil) {
+		return "another replica", nil // The lock expired in between.
+	} else if err != nil {
+		return "", fmt.Errorf("error getting lock key %s: %w", key, err)
+	}
+	return holder, nil
+}
+
+// Unlock deletes the key of the pod if this replica still holds it.
+func (l *redisLocker) Unlock(ctx context.Context, pod string) error {
+	key := lockName(pod)
+	if _, err := l.pool.DoCtx(ctx, "EVAL", redisUnlockScript, 1, key, l.identity); err != nil {
+		return fmt.Errorf("error deleting lock key %s: %w", key, err)
+	}
+	return nil
+}
+
+// lockPod takes the lock of the pod for the unseal sequence. The returned function releases it.
+func (a *App) lockPod(ctx context.Context, l *slog.Logger, id string) (unlock func(), err error) {
+	if a.locker == nil {
+		return func() {}, nil
+	}
+
+	holder, err := a.locker.Lock(ctx, id)
+	if err != nil {
+		return nil, err
+	} else if holder != "" {
+		return nil, fmt.Errorf("pod is being unsealed by %s", holder)
+	}
+
+	return func() {
+		// Release the lock even if the unseal was cancelled.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lockReleaseTimeout)
+		defer cancel()
+
+		if err := a.locker.Unlock(ctx, id); err != nil {
+			l.Warn("Error releasing unseal lock, it expires after its ttl", slog.String(loggingKeyError, err.Error()))
+		}
+	}, nil
+}
+
+// withUnsealLock sets up the lock held for the duration of an unseal sequence.
+func (a *App) withUnsealLock() web.StartOption {
+	return func(base *web.App) error {
+		if a.config.UnsealLockTTL < time.Second {
+			return errors.New("unseal lock ttl must be at least 1s")
+		}
+
+		switch a.config.UnsealLock {
+		case lockBackendLease:
+			a.locker = newLeaseLocker(base.KubeClient(), k8s.DeployedNamespace(), k8s.PodName(), a.config.UnsealLockTTL)
+		case lockBackendRedis:
+			password, err := valueOrFile(a.config.UnsealLockRedisPassword, a.config.UnsealLockRedisPasswordFile)
+			if err != nil {
+				return fmt.Errorf("error reading redis password: %w", err)
+			}
+
+			pool, err := goredis.NewPool(
+				goredis.WithLogger(logging.LoggerWithComponent(base.Logger(), "goredis")),
+				goredis.WithAddress(a.config.UnsealLockRedisAddr),
+				goredis.WithNetwork(goredis.NetworkTCP),
+				goredis.WithDialOpts(
+					redis.DialPassword(password),
+					redis.DialDatabase(a.config.UnsealLockRedisDB),
+				),
+			)
+			if err != nil {
+				return fmt.Errorf("error creating redis pool: %w", err)
+			}
+			a.locker = newRedisLocker(pool, k8s.PodName(), a.config.UnsealLockTTL)
+		case lockBackendNone:
+			a.locker = nil
+		default:
+			return fmt.Errorf("unknown unseal lock backend %q", a.config.UnsealLock)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	coordination "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	testLockNamespace = "vault-unseal"
+	testLockPod       = "vault/vault-0"
+	testLockTTL       = time.Minute
+)
+
+// fakeLeaseServer is a Kubernetes API server that only serves Leases, rejecting writes of a stale resource version like
+// the real API server. beforeWrite is called before a Lease is created or updated, so a test can make another replica
+// write first.
+type fakeLeaseServer struct {
+	mu          sync.Mutex
+	leases      map[string]*coordination.Lease
+	version     int
+	beforeWrite func(method string)
+}
+
+// newTestLeaseLocker creates a lease locker of the given replica backed by a fakeLeaseServer.
+func newTestLeaseLocker(t *testing.T, identity string) (*leaseLocker, *fakeLeaseServer) {
+	t.Helper()
+
+	fs := &fakeLeaseServer{leases: make(map[string]*coordination.Lease)}
+	client := newTestKubeClient(t, http.HandlerFunc(fs.serveHTTP))
+	return newLeaseLocker(client, testLockNamespace, identity, testLockTTL), fs
+}
+
+func (fs *fakeLeaseServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := "/apis/coordination.k8s.io/v1/namespaces/" + testLockNamespace + "/leases"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeTestStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+	if (r.Method == http.MethodPost || r.Method == http.MethodPut) && fs.beforeWrite != nil {
+		fs.beforeWrite(r.Method)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		lease, ok := fs.leases[name]
+		if !ok {
+			writeTestStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+			return
+		}
+		writeTestObject(w, http.StatusOK, lease)
+	case http.MethodPost, http.MethodPut:
+		lease := new(coordination.Lease)
+		if err := json.NewDecoder(r.Body).Decode(lease); err != nil {
+			writeTestStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest)
+			return
+		}
+
+		existing, ok := fs.leases[lease.Name]
+		switch {
+		case r.Method == http.MethodPost && ok:
+			writeTestStatus(w, http.StatusConflict, metav1.StatusReasonAlreadyExists)
+			return
+		case r.Method == http.MethodPut && !ok:
+			writeTestStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+			return
+		case r.Method == http.MethodPut && existing.ResourceVersion != lease.ResourceVersion:
+			writeTestStatus(w, http.StatusConflict, metav1.StatusReasonConflict)
+			return
+		}
+
+		fs.store(lease)
+		writeTestObject(w, http.StatusOK, lease)
+	case http.MethodDelete:
+		lease, ok := fs.leases[name]
+		if !ok {
+			writeTestStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+			return
+		}
+
+		opts := new(metav1.DeleteOptions)
+		if err := json.NewDecoder(r.Body).Decode(opts); err != nil {
+			writeTestStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest)
+			return
+		}
+		if pre := opts.Preconditions; pre != nil {
+			if (pre.UID != nil && *pre.UID != lease.UID) ||
+				(pre.ResourceVersion != nil && *pre.ResourceVersion != lease.ResourceVersion) {
+				writeTestStatus(w, http.StatusConflict, metav1.StatusReasonConflict)
+				return
+			}
+		}
+
+		delete(fs.leases, name)
+		writeTestStatus(w, http.StatusOK, "")
+	default:
+		writeTestStatus(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed)
+	}
+}
+
+// store saves the Lease with a new resource version. The caller must hold the lock.
+func (fs *fakeLeaseServer) store(lease *coordination.Lease) {
+	fs.version++
+	lease.ResourceVersion = strconv.Itoa(fs.version)
+	if lease.UID == "" {
+		lease.UID = types.UID("uid-" + lease.ResourceVersion)
+	}
+	fs.leases[lease.Name] = lease
+}
+
+// hold stores the Lease of the pod as held by the holder, renewed the given duration ago.
+func (fs *fakeLeaseServer) hold(pod, holder string, ago time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	renewed := metav1.NewMicroTime(time.Now().Add(-ago))
+	ttl := int32(testLockTTL.Seconds())
+
+	lease, ok := fs.leases[lockName(pod)]
+	if !ok {
+		lease = &coordination.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: lockName(pod), Namespace: testLockNamespace},
+		}
+	}
+	lease.Spec = coordination.LeaseSpec{
+		HolderIdentity:       &holder,
+		LeaseDurationSeconds: &ttl,
+		AcquireTime:          &renewed,
+		RenewTime:            &renewed,
+	}
+	fs.store(lease)
+}
+
+// holderOf returns the holder of the Lease of the pod, or an empty string if there is no Lease.
+func (fs *fakeLeaseServer) holderOf(pod string) string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	lease, ok := fs.leases[lockName(pod)]
+	if !ok || lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+func TestLeaseLocker_Lock(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		seed        func(fs *fakeLeaseServer)
+		beforeWrite func(fs *fakeLeaseServer, method string)
+		wantHolder  string
+		wantLease   string
+	}{
+		{
+			name:      "no lease",
+			wantLease: "replica-a",
+		},
+		{
+			name:       "held by another replica",
+			seed:       func(fs *fakeLeaseServer) { fs.hold(testLockPod, "replica-b", 0) },
+			wantHolder: "replica-b",
+			wantLease:  "replica-b",
+		},
+		{
+			name:      "held by this replica",
+			seed:      func(fs *fakeLeaseServer) { fs.hold(testLockPod, "replica-a", 0) },
+			wantLease: "replica-a",
+		},
+		{
+			name:      "expired lease of another replica is taken over",
+			seed:      func(fs *fakeLeaseServer) { fs.hold(testLockPod, "replica-b", testLockTTL+time.Second) },
+			wantLease: "replica-a",
+		},
+		{
+			name: "another replica creates the lease first",
+			beforeWrite: func(fs *fakeLeaseServer, method string) {
+				if method == http.MethodPost {
+					fs.hold(testLockPod, "replica-b", 0)
+				}
+			},
+			wantHolder: "replica-b",
+			wantLease:  "replica-b",
+		},
+		{
+			name: "another replica takes over the expired lease first",
+			seed: func(fs *fakeLeaseServer) { fs.hold(testLockPod, "replica-b", testLockTTL+time.Second) },
+			beforeWrite: func(fs *fakeLeaseServer, method string) {
+				if method == http.MethodPut {
+					fs.hold(testLockPod, "replica-c", 0)
+				}
+			},
+			wantHolder: "replica-c",
+			wantLease:  "replica-c",
+		},
+		{
+			name: "conflict with a lease no longer held",
+			seed: func(fs *fakeLeaseServer) { fs.hold(testLockPod, "replica-b", testLockTTL+time.Second) },
+			beforeWrite: func(fs *fakeLeaseServer, method string) {
+				if method == http.MethodPut {
+					fs.hold(testLockPod, "replica-b", testLockTTL+time.Second)
+				}
+			},
+			wantHolder: "another replica",
+			wantLease:  "replica-b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			locker, fs := newTestLeaseLocker(t, "replica-a")
+			if tt.seed != nil {
+				tt.seed(fs)
+			}
+			if tt.beforeWrite != nil {
+				fs.beforeWrite = func(method string) { tt.beforeWrite(fs, method) }
+			}
+
+			holder, err := locker.Lock(context.Background(), testLockPod)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.wantHolder, holder)
+			assert.Equal(t, tt.wantLease, fs.holderOf(testLockPod))
+		})
+	}
+}
+
+func TestLeaseLocker_LockCreatesLease(t *testing.T) {
+	t.Parallel()
+
+	locker, fs := newTestLeaseLocker(t, "replica-a")
+	holder, err := locker.Lock(context.Background(), testLockPod)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, holder)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	lease, ok := fs.leases[lockName(testLockPod)]
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, testLockPod, lease.Annotations[annotationLockedPod])
+	assert.Equal(t, appName, lease.Labels["app.kubernetes.io/managed-by"])
+	if assert.NotNil(t, lease.Spec.LeaseDurationSeconds) {
+		assert.Equal(t, int32(60), *lease.Spec.LeaseDurationSeconds)
+	}
+}
+
+func TestLeaseLocker_Unlock(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		seed      func(fs *fakeLeaseServer)
+		wantLease string
+	}{
+		{
+			name: "held by this replica",
+			seed: func(fs *fakeLeaseServer) { fs.hold(testLockPod, "replica-a", 0) },
+		},
+		{
+			name:      "held by another replica",
+			seed:      func(fs *fakeLeaseServer) { fs.hold(testLockPod, "replica-b", 0) },
+			wantLease: "replica-b",
+		},
+		{
+			name:      "expired and taken over by another replica",
+			seed:      func(fs *fakeLeaseServer) { fs.hold(testLockPod, "replica-b", testLockTTL+time.Second) },
+			wantLease: "replica-b",
+		},
+		{
+			name: "no lease",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			locker, fs := newTestLeaseLocker(t, "replica-a")
+			if tt.seed != nil {
+				tt.seed(fs)
+			}
+
+			assert.NoError(t, locker.Unlock(context.Background(), testLockPod))
+			assert.Equal(t, tt.wantLease, fs.holderOf(testLockPod))
+		})
+	}
+}
+
+func TestLeaseLocker_Holder(t *testing.T) {
+	t.Parallel()
+
+	locker, fs := newTestLeaseLocker(t, "replica-a")
+	ctx := context.Background()
+	name := lockName(testLockPod)
+
+	_, err := locker.holder(ctx, name)
+	assert.ErrorContains(t, err, "error getting lock lease "+testLockNamespace+"/"+name)
+
+	fs.hold(testLockPod, "replica-b", 0)
+	holder, err := locker.holder(ctx, name)
+	assert.NoError(t, err)
+	assert.Equal(t, "replica-b", holder)
+
+	// An expired lease is reported as held by another replica, as it was taken over but not yet renewed.
+	fs.hold(testLockPod, "replica-b", testLockTTL+time.Second)
+	holder, err = locker.holder(ctx, name)
+	assert.NoError(t, err)
+	assert.Equal(t, "another replica", holder)
+}
+
+// fakeRedisPool is a Redis pool keeping keys in memory, only supporting the commands used by the redis locker. Keys
+// expire against now, so a test can move time forward.
+type fakeRedisPool struct {
+	mu   sync.Mutex
+	keys map[string]*fakeRedisKey
+	now  time.Time
+}
+
+// fakeRedisKey is a key of the fakeRedisPool.
+type fakeRedisKey struct {
+	value   string
+	expires time.Time
+}
+
+func newFakeRedisPool() *fakeRedisPool {
+	return &fakeRedisPool{keys: make(map[string]*fakeRedisKey), now: time.Now()}
+}
+
+func (p *fakeRedisPool) Do(command string, args ...any) (any, error) {
+	return p.DoCtx(context.Background(), command, args...)
+}
+
+func (p *fakeRedisPool) DoCtx(_ context.Context, command string, args ...any) (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, k := range p.keys {
+		if !k.expires.IsZero() && !p.now.Before(k.expires) {
+			delete(p.keys, key)
+		}
+	}
+
+	switch command {
+	case "SET":
+		// SET key value NX PX milliseconds
+		key, value := fmt.Sprint(args[0]), fmt.Sprint(args[1])
+		if _, ok := p.keys[key]; ok {
+			return nil, nil
+		}
+		ms, ok := args[4].(int64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected px %T", args[4])
+		}
+		p.keys[key] = &fakeRedisKey{value: value, expires: p.now.Add(time.Duration(ms) * time.Millisecond)}
+		return "OK", nil
+	case "GET":
+		k, ok := p.keys[fmt.Sprint(args[0])]
+		if !ok {
+			return nil, nil
+		}
+		return []byte(k.value), nil
+	case "EVAL":
+		// EVAL redisUnlockScript 1 key holder
+		key, holder := fmt.Sprint(args[2]), fmt.Sprint(args[3])
+		if k, ok := p.keys[key]; ok && k.value == holder {
+			delete(p.keys, key)
+			return int64(1), nil
+		}
+		return int64(0), nil
+	default:
+		return nil, fmt.Errorf("unsupported command %s", command)
+	}
+}
+
+func (p *fakeRedisPool) Conn() redis.Conn {
+	return nil
+}
+
+// advance moves the time of the pool forward.
+func (p *fakeRedisPool) advance(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.now = p.now.Add(d)
+}
+
+func TestRedisLocker(t *testing.T) {
+	t.Parallel()
+
+	pool := newFakeRedisPool()
+	a := newRedisLocker(pool, "replica-a", testLockTTL)
+	b := newRedisLocker(pool, "replica-b", testLockTTL)
+	ctx := context.Background()
+
+	holder, err := a.Lock(ctx, testLockPod)
+	assert.NoError(t, err)
+	assert.Empty(t, holder)
+
+	// The lock is held until it expires.
+	holder, err = b.Lock(ctx, testLockPod)
+	assert.NoError(t, err)
+	assert.Equal(t, "replica-a", holder)
+
+	pool.advance(testLockTTL - time.Second)
+	holder, err = b.Lock(ctx, testLockPod)
+	assert.NoError(t, err)
+	assert.Equal(t, "replica-a", holder)
+
+	// Once expired, another replica takes the lock, and the replica that held it cannot release it.
+	pool.advance(time.Second)
+	holder, err = b.Lock(ctx, testLockPod)
+	assert.NoError(t, err)
+	assert.Empty(t, holder)
+
+	assert.NoError(t, a.Unlock(ctx, testLockPod))
+	holder, err = a.Lock(ctx, testLockPod)
+	assert.NoError(t, err)
+	assert.Equal(t, "replica-b", holder)
+
+	// Releasing the lock lets another replica take it straight away.
+	assert.NoError(t, b.Unlock(ctx, testLockPod))
+	holder, err = a.Lock(ctx, testLockPod)
+	assert.NoError(t, err)
+	assert.Empty(t, holder)
+}
+
+// failingRedisPool is a Redis pool failing every command.
+type failingRedisPool struct {
+	*fakeRedisPool
+}
+
+func (p *failingRedisPool) DoCtx(context.Context, string, ...any) (any, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestRedisLocker_Errors(t *testing.T) {
+	t.Parallel()
+
+	locker := newRedisLocker(&failingRedisPool{newFakeRedisPool()}, "replica-a", testLockTTL)
+	key := lockName(testLockPod)
+
+	_, err := locker.Lock(context.Background(), testLockPod)
+	assert.EqualError(t, err, "error setting lock key "+key+": connection refused")
+	assert.EqualError(t, locker.Unlock(context.Background(), testLockPod),
+		"error deleting lock key "+key+": connection refused")
+}
@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/caarlos0/env/v10"
 	hashiVault "github.com/hashicorp/vault/api"
 	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/cache"
 	"github.com/jacobbrewer1/web/logging"
+	"k8s.io/client-go/tools/record"
 )
 
 type (
@@ -17,7 +20,108 @@ type (
 		VaultNamespace string `env:"VAULT_NAMESPACE" envDefault:"vault"`
 		TargetService  string `env:"TARGET_SERVICE" envDefault:"vault"`
 
-		unsealKeys []string
+		// VaultLabelSelector selects the Vault pods. If not set, the selector of the target service is used.
+		VaultLabelSelector string `env:"VAULT_LABEL_SELECTOR"`
+
+		// VaultScheme is the scheme used to talk to Vault. Unseal keys are only sent over plain http if AllowPlaintext is
+		// set. This used to default to http, see the upgrade notes in the README.
+		VaultScheme    string `env:"VAULT_SCHEME" envDefault:"https"`
+		AllowPlaintext bool   `env:"ALLOW_PLAINTEXT" envDefault:"false"`
+
+		// VaultCAFile, VaultClientCertFile and VaultClientKeyFile configure how Vault is verified and authenticated to.
+		VaultCAFile         string `env:"VAULT_CA_FILE"`
+		VaultClientCertFile string `env:"VAULT_CLIENT_CERT_FILE"`
+		VaultClientKeyFile  string `env:"VAULT_CLIENT_KEY_FILE"`
+
+		// VaultTLSServerName overrides the name the Vault certificate is verified against, e.g. "{pod}.vault-internal".
+		VaultTLSServerName string `env:"VAULT_TLS_SERVER_NAME"`
+
+		// AttestStatefulSet, AttestServiceAccount and AttestImageDigests describe what a Vault pod must look like before
+		// it is given unseal keys. Empty values are not checked.
+		AttestStatefulSet    string   `env:"ATTEST_STATEFUL_SET"`
+		AttestServiceAccount string   `env:"ATTEST_SERVICE_ACCOUNT"`
+		AttestImageDigests   []string `env:"ATTEST_IMAGE_DIGESTS" envSeparator:","`
+
+		// AttestTLSPublicKeySHA256 pins the public key of the Vault server certificate.
+		AttestTLSPublicKeySHA256 []string `env:"ATTEST_TLS_PUBLIC_KEY_SHA256" envSeparator:","`
+
+		// AttestUnknownImage is what to do with pods running an image digest that is not allowed, either "refuse" or
+		// "approve".
+		AttestUnknownImage string `env:"ATTEST_UNKNOWN_IMAGE" envDefault:"refuse"`
+
+		// SealCheck is how to decide whether a Vault pod is sealed, either "label" or "api".
+		SealCheck string `env:"SEAL_CHECK" envDefault:"label"`
+
+		// InPlaceSeal is what to do with pods sealed without restarting, either "ignore", "unseal" or "approve".
+		InPlaceSeal string `env:"IN_PLACE_SEAL" envDefault:"ignore"`
+
+		// ReconcileInterval is how often every Vault pod is checked for a sealed state. Zero disables the sweep.
+		ReconcileInterval time.Duration `env:"RECONCILE_INTERVAL" envDefault:"1m"`
+
+		// UnsealWorkers is the number of pods that can be unsealed concurrently.
+		UnsealWorkers int `env:"UNSEAL_WORKERS" envDefault:"2"`
+
+		// UnsealMaxRetries is the number of times a failed unseal is retried before giving up.
+		UnsealMaxRetries int `env:"UNSEAL_MAX_RETRIES" envDefault:"5"`
+
+		// UnsealRetryBaseDelay is the delay before the first retry of a failed unseal, doubled on every retry.
+		UnsealRetryBaseDelay time.Duration `env:"UNSEAL_RETRY_BASE_DELAY" envDefault:"1s"`
+
+		// UnsealRetryMaxDelay is the maximum delay between retries of a failed unseal.
+		UnsealRetryMaxDelay time.Duration `env:"UNSEAL_RETRY_MAX_DELAY" envDefault:"1m"`
+
+		// UnsealLimitPerPod and UnsealLimitGlobal are the number of unseals of a single pod and across every pod allowed
+		// within UnsealLimitWindow, after which unsealing stops until reset. Zero disables the limit, which is the
+		// default as resetting the circuit breaker needs the admin API or editing the state ConfigMap.
+		UnsealLimitPerPod int           `env:"UNSEAL_LIMIT_PER_POD" envDefault:"0"`
+		UnsealLimitGlobal int           `env:"UNSEAL_LIMIT_GLOBAL" envDefault:"0"`
+		UnsealLimitWindow time.Duration `env:"UNSEAL_LIMIT_WINDOW" envDefault:"1h"`
+
+		// UnsealLock is where the lock held for the duration of an unseal sequence is kept, either "lease", "redis" or
+		// "none". UnsealLockTTL is how long a lock is held before it expires, and bounds the unseal sequence.
+		UnsealLock    string        `env:"UNSEAL_LOCK" envDefault:"lease"`
+		UnsealLockTTL time.Duration `env:"UNSEAL_LOCK_TTL" envDefault:"1m"`
+
+		// UnsealLockRedisAddr, UnsealLockRedisDB and the password configure the Redis server the locks are kept in.
+		UnsealLockRedisAddr         string `env:"UNSEAL_LOCK_REDIS_ADDR"`
+		UnsealLockRedisDB           int    `env:"UNSEAL_LOCK_REDIS_DB" envDefault:"0"`
+		UnsealLockRedisPassword     string `env:"UNSEAL_LOCK_REDIS_PASSWORD"`
+		UnsealLockRedisPasswordFile string `env:"UNSEAL_LOCK_REDIS_PASSWORD_FILE"`
+
+		// AuditLogFile is the file the audit log of released unseal keys is appended to.
+		AuditLogFile string `env:"AUDIT_LOG_FILE"`
+
+		// AuditLogStdout writes the audit log to stdout alongside the application logs.
+		AuditLogStdout bool `env:"AUDIT_LOG_STDOUT" envDefault:"false"`
+
+		// AuditWebhookURL is the URL every audit log entry is forwarded to.
+		AuditWebhookURL     string `env:"AUDIT_WEBHOOK_URL"`
+		AuditWebhookURLFile string `env:"AUDIT_WEBHOOK_URL_FILE"`
+
+		// AuditHMACKey is the key the audit log entries are chained with. It is required if any audit sink is set.
+		AuditHMACKey     string `env:"AUDIT_HMAC_KEY"`
+		AuditHMACKeyFile string `env:"AUDIT_HMAC_KEY_FILE"`
+
+		// ShardingMode is how the Vault pods are shared out across the replicas, either "hash-bucket" or
+		// "leader-election".
+		ShardingMode string `env:"SHARDING_MODE" envDefault:"hash-bucket"`
+
+		// CustodyGroup is the custody group of the replica. Each group only holds some of the unseal keys, and every group
+		// submits its keys to every sealed pod, so no replica holds enough keys to unseal Vault on its own.
+		CustodyGroup string `env:"CUSTODY_GROUP"`
+
+		// StateConfigMap is the ConfigMap in the deployed namespace holding the runtime state shared by every replica.
+		StateConfigMap string `env:"STATE_CONFIGMAP" envDefault:"vault-unseal-state"`
+
+		// AdminAddr is the address the admin server listens on. The server is only started if an admin token is set.
+		AdminAddr      string `env:"ADMIN_ADDR" envDefault:":8081"`
+		AdminToken     string `env:"ADMIN_TOKEN"`
+		AdminTokenFile string `env:"ADMIN_TOKEN_FILE"`
+
+		UnsealKeysIdentity       string `env:"UNSEAL_KEYS_IDENTITY"`
+		UnsealKeysIdentityFile   string `env:"UNSEAL_KEYS_IDENTITY_FILE"`
+		UnsealKeysPassphrase     string `env:"UNSEAL_KEYS_PASSPHRASE"`
+		UnsealKeysPassphraseFile string `env:"UNSEAL_KEYS_PASSPHRASE_FILE"`
 	}
 
 	App struct {
@@ -25,6 +129,19 @@ type (
 		base   *web.App
 
 		vaultClient *hashiVault.Client
+		decrypter   *keyDecrypter
+		targets     vaultTargets
+		unsealQueue *unsealQueue
+		shard       cache.HashBucket
+		locker      podLocker
+		events      record.EventRecorder
+		audit       *auditLog
+		state       *stateStore
+		breaker     *circuitBreaker
+		custody     *custodySubmissions
+		approvals   *approvals
+
+		secretInformers map[string]*secretInformer
 	}
 )
 
@@ -52,23 +169,16 @@ func (a *App) Start() error {
 			a.base.Shutdown() // Reboot the app if the config changes
 		}),
 		web.WithInClusterKubeClient(),
-		web.WithKubernetesPodInformer(),
-		web.WithServiceEndpointHashBucket(appName),
-		web.WithDependencyBootstrap(func(ctx context.Context) error {
-			vip := a.base.Viper()
-			a.config.unsealKeys = vip.GetStringSlice("unseal_keys")
-			switch len(a.config.unsealKeys) {
-			case 0:
-				return fmt.Errorf("no unseal keys provided")
-			case 1, 2:
-				return fmt.Errorf("not enough unseal keys provided")
-			case 3, 4, 5:
-				// Valid range, do nothing
-			default:
-				return fmt.Errorf("too many unseal keys provided")
-			}
-			return nil
-		}),
+		web.WithMetricsEnabled(true),
+		web.WithDependencyBootstrap(a.loadTargets),
+		a.withStateStore(),
+		a.withCircuitBreaker(),
+		a.withCustodySubmissions(),
+		a.withApprovals(),
+		a.withUnsealLock(),
+		a.withPodInformer(),
+		a.withUnsealKeySources(),
+		a.withSharding(),
 		web.WithDependencyBootstrap(func(ctx context.Context) error {
 			vaultClient, err := hashiVault.NewClient(hashiVault.DefaultConfig())
 			if err != nil {
@@ -77,9 +187,15 @@ func (a *App) Start() error {
 			a.vaultClient = vaultClient
 			return nil
 		}),
+		a.withEventRecorder(),
+		a.withAuditLog(),
+		a.withUnsealQueue(),
 		web.WithIndefiniteAsyncTask("unseal-vault", a.watchVaultPods(
 			logging.LoggerWithComponent(a.base.Logger(), "watch-new-pods"),
 		)),
+		a.withUnsealKeysSecretWatcher(),
+		a.withReconcileLoop(),
+		a.withAdminServer(),
 	); err != nil {
 		return fmt.Errorf("failed to start web app: %w", err)
 	}
@@ -92,6 +208,16 @@ func (a *App) WaitForEnd() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		ok, err := runCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+			os.Exit(1)
+		} else if ok {
+			return
+		}
+	}
+
 	l := logging.NewLogger(
 		logging.WithAppName(appName),
 	)
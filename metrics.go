@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	metricsNamespace = "vault_unseal"
+
+	// reasonAttestation is the failure reason when the pod could not be verified as a genuine Vault pod.
+	reasonAttestation = "attestation"
+
+	// reasonKeySource is the failure reason when the unseal keys could not be read.
+	reasonKeySource = "key_source"
+
+	// reasonVaultClient is the failure reason when no client could be created for the pod.
+	reasonVaultClient = "vault_client"
+
+	// reasonSealStatus is the failure reason when the pod did not report its seal status.
+	reasonSealStatus = "seal_status"
+
+	// reasonInvalidKeys is the failure reason when the unseal keys do not match the threshold reported by the pod.
+	reasonInvalidKeys = "invalid_keys"
+
+	// reasonReset is the failure reason when a stale unseal could not be reset.
+	reasonReset = "reset"
+
+	// reasonUnseal is the failure reason when the pod rejected an unseal key.
+	reasonUnseal = "unseal"
+
+	// reasonStillSealed is the failure reason when the pod is still sealed after every key was submitted.
+	reasonStillSealed = "still_sealed"
+
+	// reasonInit is the failure reason when the pod could not be initialized.
+	reasonInit = "init"
+
+	// reasonRaftJoin is the failure reason when the pod could not join the Raft cluster of the active pod.
+	reasonRaftJoin = "raft_join"
+
+	// reasonAudit is the failure reason when an action could not be recorded in the audit log, so the unseal stopped.
+	reasonAudit = "audit"
+
+	// reasonUnknown is the failure reason when the failure was not classified.
+	reasonUnknown = "unknown"
+)
+
+var (
+	unsealAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "attempts_total",
+		Help:      "The number of attempts to unseal a Vault pod.",
+	}, []string{"target", "namespace"})
+
+	unsealSuccesses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "successes_total",
+		Help:      "The number of Vault pods that were unsealed.",
+	}, []string{"target", "namespace"})
+
+	unsealFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "failures_total",
+		Help:      "The number of failed attempts to unseal a Vault pod, by reason.",
+	}, []string{"target", "namespace", "reason"})
+
+	unsealSkips = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "skips_total",
+		Help:      "The number of sealed Vault pods that were deliberately not unsealed, by reason.",
+	}, []string{"target", "namespace", "reason"})
+
+	policyDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "policy_decisions_total",
+		Help:      "The number of unseal policy decisions, by matched rule and action.",
+	}, []string{"target", "namespace", "rule", "action"})
+
+	breakerTrips = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_trips_total",
+		Help:      "The number of times the unseal circuit breaker tripped, by scope.",
+	}, []string{"target", "namespace", "scope"})
+
+	sealedToUnsealedSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sealed_to_unsealed_seconds",
+		Help:      "The time from a Vault pod first being seen sealed to it being unsealed.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"target", "namespace"})
+
+	sealedPods = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "sealed_pods",
+		Help:      "The number of Vault pods currently known to be sealed.",
+	}, []string{"target", "namespace"})
+
+	sealProgress = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "seal_progress",
+		Help:      "The number of unseal keys a sealed Vault pod has accepted.",
+	}, []string{"target", "namespace", "pod"})
+
+	isLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader",
+		Help:      "Whether the replica is the elected leader unsealing every Vault pod.",
+	})
+
+	keySourceHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "key_source_healthy",
+		Help:      "Whether the unseal keys of the target could be read the last time they were needed.",
+	}, []string{"target"})
+
+	auditWebhookFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_webhook_failures_total",
+		Help:      "The number of audit log entries that were not forwarded to the webhook, by reason.",
+	}, []string{"reason"})
+)
+
+// unsealFailure is an error that failed an unseal for the given reason.
+type unsealFailure struct {
+	reason string
+	err    error
+}
+
+// withReason wraps the error with the reason the unseal failed.
+func withReason(reason string, err error) error {
+	return &unsealFailure{
+		reason: reason,
+		err:    err,
+	}
+}
+
+// Error returns the wrapped error message.
+func (e *unsealFailure) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e *unsealFailure) Unwrap() error {
+	return e.err
+}
+
+// failureReason returns the reason the unseal failed with the error.
+func failureReason(err error) string {
+	var failure *unsealFailure
+	if errors.As(err, &failure) {
+		return failure.reason
+	}
+	return reasonUnknown
+}
+
+// boolToFloat converts the boolean to a gauge value.
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
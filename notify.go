@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	core "k8s.io/api/core/v1"
+)
+
+const (
+	// notifierWebhook posts the unseal event as JSON to a URL.
+	notifierWebhook = "webhook"
+
+	// notifierSlack posts a message to a Slack compatible incoming webhook.
+	notifierSlack = "slack"
+
+	// notifierSMTP sends an email through an SMTP server.
+	notifierSMTP = "smtp"
+
+	// defaultSMTPPort is the port used to talk to the SMTP server when none is configured.
+	defaultSMTPPort = 587
+
+	// notifyTimeout is the maximum time a notifier has to deliver a notification.
+	notifyTimeout = 10 * time.Second
+)
+
+type (
+	// notifierConfig is the configuration of a single notifier in the configuration file.
+	notifierConfig struct {
+		Type         string            `mapstructure:"type"`
+		URL          string            `mapstructure:"url"`
+		URLFile      string            `mapstructure:"url_file"`
+		Headers      map[string]string `mapstructure:"headers"`
+		Host         string            `mapstructure:"host"`
+		Port         int               `mapstructure:"port"`
+		Username     string            `mapstructure:"username"`
+		Password     string            `mapstructure:"password"`
+		PasswordFile string            `mapstructure:"password_file"`
+		From         string            `mapstructure:"from"`
+		To           []string          `mapstructure:"to"`
+	}
+
+	// notifier delivers unseal events to humans.
+	notifier interface {
+		// Notify delivers the event.
+		Notify(ctx context.Context, event *unsealEvent) error
+	}
+
+	// unsealEvent describes an attempt to unseal a Vault pod.
+	unsealEvent struct {
+		Target    string        `json:"target"`
+		Namespace string        `json:"namespace"`
+		Pod       string        `json:"pod"`
+		Node      string        `json:"node"`
+		Restarts  int32         `json:"restarts"`
+		Attempt   int           `json:"attempt"`
+		Unsealed  bool          `json:"unsealed"`
+		Error     string        `json:"error,omitempty"`
+		Progress  int           `json:"progress"`
+		Threshold int           `json:"threshold"`
+		StartedAt time.Time     `json:"started_at"`
+		Duration  time.Duration `json:"duration_ns"`
+
+		// Severity is set on events that need a human to act, e.g. "critical".
+		Severity string `json:"severity,omitempty"`
+
+		// ApprovalURL links to the approval request of the unseal.
+		ApprovalURL string `json:"approval_url,omitempty"`
+	}
+
+	// webhookNotifier posts the event as JSON to a URL.
+	webhookNotifier struct {
+		client  *http.Client
+		url     string
+		headers map[string]string
+	}
+
+	// slackNotifier posts the event as a message to a Slack compatible incoming webhook.
+	slackNotifier struct {
+		client *http.Client
+		url    string
+	}
+
+	// smtpNotifier sends the event as an email.
+	smtpNotifier struct {
+		addr string
+		auth smtp.Auth
+		from string
+		to   []string
+	}
+)
+
+// newUnsealEvent creates the event for an unseal attempt of the pod that started at the given time.
+func newUnsealEvent(target *vaultTarget, pod *core.Pod, attempt int, startedAt time.Time) *unsealEvent {
+	restarts := int32(0)
+	for _, status := range pod.Status.ContainerStatuses {
+		restarts += status.RestartCount
+	}
+
+	return &unsealEvent{
+		Target:    target.name,
+		Namespace: pod.Namespace,
+		Pod:       pod.Name,
+		Node:      pod.Spec.NodeName,
+		Restarts:  restarts,
+		Attempt:   attempt,
+		StartedAt: startedAt,
+	}
+}
+
+// String returns a human readable summary of the event.
+func (e *unsealEvent) String() string {
+	if e.Severity != "" {
+		return fmt.Sprintf(
+			"[%s] Vault pod %s/%s of target %s on node %s was not unsealed: %s (%d restarts)",
+			strings.ToUpper(e.Severity), e.Namespace, e.Pod, e.Target, e.Node, e.Error, e.Restarts,
+		)
+	}
+
+	result := "was unsealed"
+	if !e.Unsealed {
+		result = "could not be unsealed: " + e.Error
+	}
+
+	return fmt.Sprintf(
+		"Vault pod %s/%s of target %s on node %s %s (attempt %d, progress %d/%d, %d restarts, took %s)",
+		e.Namespace, e.Pod, e.Target, e.Node, result, e.Attempt, e.Progress, e.Threshold, e.Restarts,
+		e.Duration.Round(time.Millisecond),
+	)
+}
+
+// newNotifier creates a notifier from its configuration.
+func newNotifier(cfg *notifierConfig) (notifier, error) {
+	switch cfg.Type {
+	case notifierWebhook, notifierSlack:
+		url, err := valueOrFile(cfg.URL, cfg.URLFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading url: %w", err)
+		} else if url == "" {
+			return nil, errors.New("no url provided")
+		}
+
+		client := &http.Client{Timeout: notifyTimeout}
+		if cfg.Type == notifierSlack {
+			return &slackNotifier{client: client, url: url}, nil
+		}
+		return &webhookNotifier{client: client, url: url, headers: cfg.Headers}, nil
+	case notifierSMTP:
+		if cfg.Host == "" {
+			return nil, errors.New("no host provided")
+		}
+		if cfg.From == "" || len(cfg.To) == 0 {
+			return nil, errors.New("both from and to must be provided")
+		}
+
+		port := cfg.Port
+		if port == 0 {
+			port = defaultSMTPPort
+		}
+
+		n := &smtpNotifier{
+			addr: net.JoinHostPort(cfg.Host, strconv.Itoa(port)),
+			from: cfg.From,
+			to:   cfg.To,
+		}
+
+		password, err := valueOrFile(cfg.Password, cfg.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading password: %w", err)
+		}
+		if cfg.Username != "" {
+			n.auth = smtp.PlainAuth("", cfg.Username, password, cfg.Host)
+		}
+		return n, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier type %q", cfg.Type)
+	}
+}
+
+// newNotifiers creates the notifiers from their configuration.
+func newNotifiers(configs []*notifierConfig) ([]notifier, error) {
+	notifiers := make([]notifier, 0, len(configs))
+	for i, cfg := range configs {
+		n, err := newNotifier(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid notifier %d: %w", i, err)
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
+
+// Notify posts the event as JSON.
+func (n *webhookNotifier) Notify(ctx context.Context, event *unsealEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error marshalling event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.headers {
+		req.Header.Set(k, v)
+	}
+
+	return doNotifyRequest(n.client, req)
+}
+
+// Notify posts the event as a Slack message.
+func (n *slackNotifier) Notify(ctx context.Context, event *unsealEvent) error {
+	body, err := json.Marshal(map[string]string{"text": event.String()})
+	if err != nil {
+		return fmt.Errorf("error marshalling message: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return doNotifyRequest(n.client, req)
+}
+
+// doNotifyRequest sends the request and checks the response was successful.
+func doNotifyRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending notification: %w", err)
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Notify sends the event as an email. The SMTP client does not take a context, so the send is abandoned, but not
+// cancelled, when the context is done.
+func (n *smtpNotifier) Notify(ctx context.Context, event *unsealEvent) error {
+	subject := fmt.Sprintf("[%s] Vault pod %s/%s unsealed", appName, event.Namespace, event.Pod)
+	if !event.Unsealed {
+		subject = fmt.Sprintf("[%s] Vault pod %s/%s could not be unsealed", appName, event.Namespace, event.Pod)
+	}
+	if event.Severity != "" {
+		subject = fmt.Sprintf("[%s] [%s] Vault pod %s/%s was not unsealed",
+			appName, strings.ToUpper(event.Severity), event.Namespace, event.Pod)
+	}
+
+	msg := new(strings.Builder)
+	fmt.Fprintf(msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(msg, "%s\r\n", event.String())
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- smtp.SendMail(n.addr, n.auth, n.from, n.to, []byte(msg.String()))
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return fmt.Errorf("error sending email: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notify delivers the event to every notifier of the target in the background, so a slow notifier does not hold up
+// unsealing other pods.
+func notify(ctx context.Context, l *slog.Logger, target *vaultTarget, event *unsealEvent) {
+	for _, n := range target.notifiers {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notifyTimeout)
+			defer cancel()
+
+			if err := n.Notify(ctx, event); err != nil {
+				l.Error("Error sending unseal notification", slog.String(loggingKeyError, err.Error()))
+			}
+		}()
+	}
+}
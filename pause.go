@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// annotationPaused pauses unsealing of a pod when set to "true" on the pod or its StatefulSet.
+	annotationPaused = "vault-unseal.io/paused"
+
+	// statePausedKey is the key in the state ConfigMap that pauses unsealing of every target.
+	statePausedKey = "paused"
+
+	// statePausedTargetPrefix prefixes the key in the state ConfigMap that pauses unsealing of a single target.
+	statePausedTargetPrefix = "paused."
+
+	// skipPaused is the skip reason when unsealing of the pod is paused.
+	skipPaused = "paused"
+)
+
+// pauseRecord describes why unsealing was paused through the admin endpoint.
+type pauseRecord struct {
+	Target string    `json:"target,omitempty"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// statePauseKey returns the key in the state ConfigMap that pauses the given target, or every target if empty.
+func statePauseKey(target string) string {
+	if target == "" {
+		return statePausedKey
+	}
+	return statePausedTargetPrefix + target
+}
+
+// pausedBy returns why unsealing of the pod is paused, or an empty string if it is not. Unsealing is paused by the
+// configuration file, the pause annotation on the pod or its StatefulSet, or a pause set through the admin endpoint.
+func (a *App) pausedBy(ctx context.Context, target *vaultTarget, pod *core.Pod) (string, error) {
+	if a.base.Viper().GetBool("paused") {
+		return "paused in the configuration file", nil
+	}
+	if target.paused {
+		return "target paused in the configuration file", nil
+	}
+
+	if isPausedAnnotation(pod.Annotations) {
+		return "pod annotated " + annotationPaused, nil
+	}
+
+	if owner := metav1.GetControllerOf(pod); owner != nil && owner.Kind == "StatefulSet" {
+		sts, err := a.base.KubeClient().AppsV1().StatefulSets(pod.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil && !kubeErrors.IsNotFound(err) {
+			return "", fmt.Errorf("error getting stateful set %s: %w", owner.Name, err)
+		}
+		if err == nil && isPausedAnnotation(sts.Annotations) {
+			return "stateful set annotated " + annotationPaused, nil
+		}
+	}
+
+	state, err := a.state.Get(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range []string{statePauseKey(""), statePauseKey(target.name)} {
+		value, ok := state[key]
+		if !ok {
+			continue
+		}
+
+		record := new(pauseRecord)
+		if err := json.Unmarshal([]byte(value), record); err != nil {
+			return "paused by the admin endpoint", nil
+		}
+		return "paused by the admin endpoint: " + record.Reason, nil
+	}
+
+	return "", nil
+}
+
+// isPausedAnnotation checks if the annotations pause unsealing.
+func isPausedAnnotation(annotations map[string]string) bool {
+	paused, err := strconv.ParseBool(annotations[annotationPaused])
+	return err == nil && paused
+}
+
+// pause pauses unsealing of the given target, or every target if empty, for every replica.
+func (a *App) pause(ctx context.Context, record *pauseRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error marshalling pause: %w", err)
+	}
+
+	return a.state.Update(ctx, func(data map[string]string) error {
+		data[statePauseKey(record.Target)] = string(value)
+		return nil
+	})
+}
+
+// resume resumes unsealing of the given target, or lifts the global pause if empty.
+func (a *App) resume(ctx context.Context, target string) error {
+	return a.state.Update(ctx, func(data map[string]string) error {
+		delete(data, statePauseKey(target))
+		return nil
+	})
+}
+
+// pauses returns every pause set through the admin endpoint.
+func (a *App) pauses(ctx context.Context) ([]*pauseRecord, error) {
+	state, err := a.state.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*pauseRecord, 0)
+	for key, value := range state {
+		if key != statePausedKey && !strings.HasPrefix(key, statePausedTargetPrefix) {
+			continue
+		}
+
+		record := new(pauseRecord)
+		if err := json.Unmarshal([]byte(value), record); err != nil {
+			return nil, fmt.Errorf("error parsing pause %s: %w", key, err)
+		}
+		records = append(records, record)
+	}
+
+	slices.SortFunc(records, func(a, b *pauseRecord) int {
+		return strings.Compare(a.Target, b.Target)
+	})
+	return records, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	_ "time/tzdata" // The container image does not ship the timezone database.
+)
+
+const (
+	// policyAllow unseals the pod automatically.
+	policyAllow = "allow"
+
+	// policyDeny leaves the pod sealed.
+	policyDeny = "deny"
+
+	// policyEscalate unseals the pod once enough operators approved it.
+	policyEscalate = "escalate"
+
+	// policyDefaultRule is the rule name recorded when no rule of the policy matched.
+	policyDefaultRule = "default"
+
+	// maxPolicyWindow is the longest window a policy rule can open. Windows are checked minute by minute.
+	maxPolicyWindow = 31 * 24 * time.Hour
+
+	// skipPolicyDenied is the skip reason when the unseal policy of the target denies unsealing the pod.
+	skipPolicyDenied = "policy_denied"
+)
+
+type (
+	// policyConfig is the configuration of when pods of a target are unsealed automatically.
+	policyConfig struct {
+		Timezone string              `mapstructure:"timezone"`
+		Default  string              `mapstructure:"default"`
+		Rules    []*policyRuleConfig `mapstructure:"rules"`
+	}
+
+	// policyRuleConfig is the configuration of a single window of a policy.
+	policyRuleConfig struct {
+		Name     string        `mapstructure:"name"`
+		Schedule string        `mapstructure:"schedule"`
+		Duration time.Duration `mapstructure:"duration"`
+		Action   string        `mapstructure:"action"`
+	}
+
+	// unsealPolicy decides what to do with a sealed pod depending on the time. The first rule whose window is open
+	// decides, or the default action if none is.
+	unsealPolicy struct {
+		location      *time.Location
+		defaultAction string
+		rules         []*policyRule
+	}
+
+	// policyRule applies its action for the duration after every time its schedule fires.
+	policyRule struct {
+		name     string
+		schedule *cronSchedule
+		duration time.Duration
+		action   string
+	}
+
+	// policyDecision is the outcome of evaluating a policy.
+	policyDecision struct {
+		rule   string
+		action string
+	}
+)
+
+// newUnsealPolicy creates the policy from its configuration, or returns nil if no policy is configured.
+func newUnsealPolicy(cfg *policyConfig) (*unsealPolicy, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	p := &unsealPolicy{
+		location:      time.UTC,
+		defaultAction: cfg.Default,
+		rules:         make([]*policyRule, 0, len(cfg.Rules)),
+	}
+	if p.defaultAction == "" {
+		p.defaultAction = policyAllow
+	}
+	if err := validatePolicyAction(p.defaultAction); err != nil {
+		return nil, fmt.Errorf("invalid default: %w", err)
+	}
+
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone: %w", err)
+		}
+		p.location = loc
+	}
+
+	for i, rc := range cfg.Rules {
+		rule := &policyRule{
+			name:     rc.Name,
+			duration: rc.Duration,
+			action:   rc.Action,
+		}
+		if rule.name == "" {
+			rule.name = fmt.Sprintf("rule-%d", i)
+		}
+		if err := validatePolicyAction(rule.action); err != nil {
+			return nil, fmt.Errorf("invalid rule %s: %w", rule.name, err)
+		}
+		if rule.duration < time.Minute || rule.duration > maxPolicyWindow {
+			return nil, fmt.Errorf("invalid rule %s: duration must be between 1m and %s", rule.name, maxPolicyWindow)
+		}
+
+		schedule, err := parseCron(rc.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %s: invalid schedule: %w", rule.name, err)
+		}
+		if err := schedule.validate(); err != nil {
+			return nil, fmt.Errorf("invalid rule %s: %w", rule.name, err)
+		}
+		rule.schedule = schedule
+
+		p.rules = append(p.rules, rule)
+	}
+
+	return p, nil
+}
+
+// validatePolicyAction checks the action is known.
+func validatePolicyAction(action string) error {
+	switch action {
+	case policyAllow, policyDeny, policyEscalate:
+		return nil
+	case "":
+		return errors.New("no action provided")
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+}
+
+// Evaluate decides what to do with a sealed pod at the given time. A nil policy allows every unseal without recording a
+// decision.
+func (p *unsealPolicy) Evaluate(now time.Time) *policyDecision {
+	if p == nil {
+		return nil
+	}
+
+	for _, rule := range p.rules {
+		if rule.schedule.firedWithin(now, rule.duration, p.location) {
+			return &policyDecision{rule: rule.name, action: rule.action}
+		}
+	}
+	return &policyDecision{rule: policyDefaultRule, action: p.defaultAction}
+}
+
+// escalates checks if any outcome of the policy needs approval.
+func (p *unsealPolicy) escalates() bool {
+	if p == nil {
+		return false
+	}
+
+	if p.defaultAction == policyEscalate {
+		return true
+	}
+	for _, rule := range p.rules {
+		if rule.action == policyEscalate {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a human readable description of the decision.
+func (d *policyDecision) String() string {
+	return fmt.Sprintf("unseal policy rule %s decided %s", d.rule, d.action)
+}
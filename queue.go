@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/logging"
+	core "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	kubeCache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+type (
+	// podKey identifies a Vault pod in the unseal queue. Pods are keyed by UID so a replaced pod with the same name is
+	// treated as new work, while rapid events for the same pod are deduplicated.
+	podKey struct {
+		uid       types.UID
+		namespace string
+		name      string
+	}
+
+	// unsealQueue is a rate limited work queue of Vault pods waiting to be unsealed. The queue never hands the same
+	// pod to two workers at once, so overlapping unseal sequences for a pod cannot happen.
+	unsealQueue struct {
+		queue      workqueue.TypedRateLimitingInterface[podKey]
+		workers    int
+		maxRetries int
+
+		// sealed holds the pods currently known to be sealed.
+		sealed   map[podKey]*sealedPod
+		sealedMu sync.Mutex
+	}
+
+	// sealedPod records when a pod was first seen sealed, and why unsealing it was last skipped.
+	sealedPod struct {
+		target string
+		since  time.Time
+		skip   unsealSkip
+	}
+)
+
+// newPodKey creates the queue key for the pod.
+func newPodKey(pod *core.Pod) podKey {
+	return podKey{
+		uid:       pod.UID,
+		namespace: pod.Namespace,
+		name:      pod.Name,
+	}
+}
+
+// newUnsealQueue creates an unseal queue that retries failed unseals with exponential backoff between the base and max
+// delay, up to maxRetries times.
+func newUnsealQueue(workers, maxRetries int, baseDelay, maxDelay time.Duration) *unsealQueue {
+	return &unsealQueue{
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.NewTypedItemExponentialFailureRateLimiter[podKey](baseDelay, maxDelay),
+			workqueue.TypedRateLimitingQueueConfig[podKey]{
+				Name: "unseal",
+			},
+		),
+		workers:    workers,
+		maxRetries: maxRetries,
+		sealed:     make(map[podKey]*sealedPod),
+	}
+}
+
+// Add queues the pod to be unsealed.
+func (q *unsealQueue) Add(pod *core.Pod) {
+	q.queue.Add(newPodKey(pod))
+}
+
+// Forget stops tracking the pod as sealed, e.g. because it was deleted.
+func (q *unsealQueue) Forget(pod *core.Pod) {
+	q.markUnsealed(newPodKey(pod))
+}
+
+// markSealed records the pod of the target as sealed, if it is not already.
+func (q *unsealQueue) markSealed(key podKey, target string) {
+	q.sealedMu.Lock()
+	defer q.sealedMu.Unlock()
+
+	if _, ok := q.sealed[key]; ok {
+		return
+	}
+
+	q.sealed[key] = &sealedPod{
+		target: target,
+		since:  time.Now(),
+	}
+	sealedPods.WithLabelValues(target, key.namespace).Inc()
+}
+
+// markSkipped records that unsealing the sealed pod was skipped, returning whether it was skipped for another reason
+// than last time. Pods that are not tracked as sealed are always reported as skipped for a new reason.
+func (q *unsealQueue) markSkipped(key podKey, skip *unsealSkip) bool {
+	q.sealedMu.Lock()
+	defer q.sealedMu.Unlock()
+
+	pod, ok := q.sealed[key]
+	if !ok {
+		return true
+	}
+
+	if pod.skip == *skip {
+		return false
+	}
+	pod.skip = *skip
+	return true
+}
+
+// clearSkipped forgets why unsealing the pod was last skipped, so the next skip is reported again.
+func (q *unsealQueue) clearSkipped(key podKey) {
+	q.sealedMu.Lock()
+	defer q.sealedMu.Unlock()
+
+	if pod, ok := q.sealed[key]; ok {
+		pod.skip = unsealSkip{}
+	}
+}
+
+// markUnsealed stops tracking the pod as sealed, returning when the pod was first seen sealed.
+func (q *unsealQueue) markUnsealed(key podKey) (time.Time, bool) {
+	q.sealedMu.Lock()
+	defer q.sealedMu.Unlock()
+
+	pod, ok := q.sealed[key]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	delete(q.sealed, key)
+	sealedPods.WithLabelValues(pod.target, key.namespace).Dec()
+	sealProgress.DeleteLabelValues(pod.target, key.namespace, key.name)
+	return pod.since, true
+}
+
+// runUnsealWorkers starts the workers that process the unseal queue and blocks until the context is done.
+func (a *App) runUnsealWorkers(
+	l *slog.Logger,
+) web.AsyncTaskFunc {
+	return func(ctx context.Context) {
+		defer a.unsealQueue.queue.ShutDown()
+
+		if !kubeCache.WaitForCacheSync(ctx.Done(), a.base.PodInformer().HasSynced) {
+			l.Error("Timed out waiting for pod cache to sync")
+			return
+		}
+
+		for i := range a.unsealQueue.workers {
+			go a.unsealWorker(ctx, l.With(slog.Int(loggingKeyWorker, i)))
+		}
+
+		<-ctx.Done()
+	}
+}
+
+// unsealWorker processes pods from the unseal queue until the queue is shut down.
+func (a *App) unsealWorker(ctx context.Context, l *slog.Logger) {
+	for a.processNextPod(ctx, l) {
+	}
+}
+
+// processNextPod unseals the next pod in the queue, requeueing it with backoff if the unseal fails. It returns false
+// when the queue has been shut down.
+func (a *App) processNextPod(ctx context.Context, l *slog.Logger) bool {
+	return a.unsealQueue.processNext(ctx, l, a.unsealPod)
+}
+
+// processNext hands the next pod in the queue to unseal, requeueing it with backoff if unseal fails and forgetting it
+// once unseal succeeds or every retry failed. It returns false when the queue has been shut down.
+func (q *unsealQueue) processNext(
+	ctx context.Context,
+	l *slog.Logger,
+	unseal func(ctx context.Context, l *slog.Logger, key podKey) error,
+) bool {
+	key, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(key)
+
+	l = l.With(
+		slog.String(loggingKeyNamespace, key.namespace),
+		slog.String(loggingKeyPod, key.name),
+	)
+
+	err := unseal(ctx, l, key)
+	switch {
+	case err == nil:
+		q.queue.Forget(key)
+	case q.queue.NumRequeues(key) < q.maxRetries:
+		l.Warn("Error unsealing vault, retrying",
+			slog.Int(loggingKeyAttempt, q.queue.NumRequeues(key)+1),
+			slog.String(loggingKeyError, err.Error()),
+		)
+		q.queue.AddRateLimited(key)
+	default:
+		l.Error("Error unsealing vault, giving up",
+			slog.Int(loggingKeyAttempt, q.queue.NumRequeues(key)+1),
+			slog.String(loggingKeyError, err.Error()),
+		)
+		q.queue.Forget(key)
+	}
+
+	return true
+}
+
+// unsealPod unseals the queued pod if it still exists and is still sealed.
+func (a *App) unsealPod(ctx context.Context, l *slog.Logger, key podKey) error {
+	pod, err := a.base.PodLister().Pods(key.namespace).Get(key.name)
+	if kubeErrors.IsNotFound(err) {
+		a.unsealQueue.markUnsealed(key)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error getting pod: %w", err)
+	}
+
+	if pod.UID != key.uid {
+		l.Debug("Pod has been replaced, skipping unseal")
+		a.unsealQueue.markUnsealed(key)
+		return nil
+	}
+
+	// The pod may have moved to another replica, e.g. because this replica is no longer the leader.
+	if !a.shard.InBucket(pod.Namespace + "/" + pod.Name) {
+		l.Debug("Pod is no longer owned by this replica, skipping unseal")
+		a.unsealQueue.markUnsealed(key)
+		return nil
+	}
+
+	target := a.targets.ForPod(pod)
+	if target == nil {
+		a.unsealQueue.markUnsealed(key)
+		return nil
+	}
+
+	l = l.With(
+		slog.String(loggingKeyTarget, target.name),
+	)
+
+	sealed, err := isPodSealed(ctx, l, target, pod)
+	if err != nil {
+		return fmt.Errorf("error checking seal status: %w", err)
+	} else if !sealed {
+		a.markPodUnsealed(ctx, l, key, pod)
+		return nil
+	}
+	a.unsealQueue.markSealed(key, target.name)
+
+	if target.inPlaceSeal == inPlaceSealIgnore && isInPlaceSeal(pod) {
+		a.skipPod(l, target, pod, &unsealSkip{
+			reason:  skipInPlaceSeal,
+			message: "vault was sealed without restarting, e.g. by an operator",
+		})
+		return nil
+	}
+
+	pausedBy, err := a.pausedBy(ctx, target, pod)
+	if err != nil {
+		return fmt.Errorf("error checking if unsealing is paused: %w", err)
+	} else if pausedBy != "" {
+		a.skipPod(l, target, pod, &unsealSkip{
+			reason:  skipPaused,
+			message: "unsealing is paused, " + pausedBy,
+		})
+		return nil
+	}
+
+	trip, tripped, err := a.breaker.Check(ctx, target, pod)
+	if err != nil {
+		return fmt.Errorf("error checking unseal circuit breaker: %w", err)
+	} else if trip != nil {
+		if tripped {
+			a.breakerTripped(ctx, l, target, pod, trip)
+		}
+		a.skipPod(l, target, pod, &unsealSkip{
+			reason:  skipBreakerOpen,
+			message: trip.String(),
+		})
+		return nil
+	}
+
+	decision := target.policy.Evaluate(time.Now())
+	if decision != nil {
+		l = l.With(
+			slog.String(loggingKeyRule, decision.rule),
+			slog.String(loggingKeyAction, decision.action),
+		)
+		l.Info("Unseal policy evaluated")
+		policyDecisions.WithLabelValues(target.name, pod.Namespace, decision.rule, decision.action).Inc()
+
+		if decision.action == policyDeny {
+			a.skipPod(l, target, pod, &unsealSkip{
+				reason:  skipPolicyDenied,
+				message: decision.String(),
+			})
+			return nil
+		}
+	}
+
+	reason := approvalReason(target, pod)
+	if reason == "" && decision != nil && decision.action == policyEscalate {
+		reason = decision.String()
+	}
+	if reason != "" {
+		approved, err := a.checkApproval(ctx, l, target, pod, reason)
+		if err != nil {
+			return fmt.Errorf("error checking unseal approval: %w", err)
+		} else if !approved {
+			return nil
+		}
+	}
+
+	// Hold the lock of the pod for the whole unseal sequence, which must finish before the lock expires.
+	unlock, err := a.lockPod(ctx, l, breakerPodID(pod))
+	if err != nil {
+		return fmt.Errorf("error locking pod: %w", err)
+	}
+	defer unlock()
+
+	unsealCtx, cancel := context.WithTimeout(ctx, a.config.UnsealLockTTL)
+	defer cancel()
+
+	a.unsealQueue.clearSkipped(key)
+	l.Info("Sealed Vault pod detected, attempting to unseal vault")
+	if decision != nil {
+		a.events.Eventf(pod, core.EventTypeNormal, eventUnsealStarted, "Unsealing Vault pod of target %s, %s", target.name, decision)
+	} else {
+		a.events.Eventf(pod, core.EventTypeNormal, eventUnsealStarted, "Unsealing Vault pod of target %s", target.name)
+	}
+
+	event := newUnsealEvent(target, pod, a.unsealQueue.queue.NumRequeues(key)+1, time.Now())
+	status, err := a.unsealVaultPod(unsealCtx, l, target, pod)
+
+	var skip *unsealSkip
+	if errors.As(err, &skip) {
+		a.skipPod(l, target, pod, skip)
+		switch skip.reason {
+		case skipAlreadyUnsealed:
+			a.markPodUnsealed(ctx, l, key, pod)
+		case skipAwaitingCustodians:
+			sealProgress.WithLabelValues(target.name, pod.Namespace, pod.Name).Set(float64(status.Progress))
+		}
+		return nil
+	}
+
+	event.Duration = time.Since(event.StartedAt)
+	event.Unsealed = err == nil
+	if err != nil {
+		event.Error = err.Error()
+	}
+	if status != nil {
+		event.Progress = status.Progress
+		event.Threshold = status.T
+		event.Unsealed = event.Unsealed && !status.Sealed
+
+		// Vault resets the progress once unsealed, so report every share as submitted.
+		if event.Unsealed {
+			event.Progress = status.T
+		}
+	}
+	notify(ctx, l, target, event)
+
+	unsealAttempts.WithLabelValues(target.name, pod.Namespace).Inc()
+	switch {
+	case event.Unsealed:
+		a.events.Eventf(pod, core.EventTypeNormal, eventUnsealed, "Unsealed Vault pod in %s", event.Duration.Round(time.Millisecond))
+		unsealSuccesses.WithLabelValues(target.name, pod.Namespace).Inc()
+		if since, ok := a.unsealQueue.markUnsealed(key); ok {
+			sealedToUnsealedSeconds.WithLabelValues(target.name, pod.Namespace).Observe(time.Since(since).Seconds())
+		}
+		a.markPodUnsealed(ctx, l, key, pod)
+		if err := a.approvals.Complete(ctx, pod); err != nil {
+			l.Warn("Error completing unseal approval", slog.String(loggingKeyError, err.Error()))
+		}
+	case failureReason(err) == reasonAttestation:
+		a.events.Eventf(pod, core.EventTypeWarning, eventUnsealRefused, "Refused to unseal pod: %s", err)
+		unsealFailures.WithLabelValues(target.name, pod.Namespace, reasonAttestation).Inc()
+	case err != nil:
+		a.events.Eventf(pod, core.EventTypeWarning, eventUnsealFailed, "Failed to unseal Vault pod (%s): %s", failureReason(err), err)
+		unsealFailures.WithLabelValues(target.name, pod.Namespace, failureReason(err)).Inc()
+	}
+	if status != nil && status.Sealed {
+		sealProgress.WithLabelValues(target.name, pod.Namespace, pod.Name).Set(float64(status.Progress))
+	}
+
+	return err
+}
+
+// skipPod records that the sealed pod was deliberately not unsealed. As a pod is skipped on every reconcile until it
+// can be unsealed, it is only logged and an Event emitted when it is skipped for another reason than last time.
+func (a *App) skipPod(l *slog.Logger, target *vaultTarget, pod *core.Pod, skip *unsealSkip) {
+	unsealSkips.WithLabelValues(target.name, pod.Namespace, skip.reason).Inc()
+	if !a.unsealQueue.markSkipped(newPodKey(pod), skip) {
+		l.Debug("Skipping unseal", slog.String(loggingKeyReason, skip.message))
+		return
+	}
+
+	l.Info("Skipping unseal", slog.String(loggingKeyReason, skip.message))
+	a.events.Eventf(pod, core.EventTypeNormal, eventUnsealSkipped, "Skipped unsealing Vault pod: %s", skip.message)
+}
+
+// markPodUnsealed stops tracking the pod as sealed and records its running Vault container, so a later in-place seal
+// can be told apart from a restart.
+func (a *App) markPodUnsealed(ctx context.Context, l *slog.Logger, key podKey, pod *core.Pod) {
+	a.unsealQueue.markUnsealed(key)
+
+	if err := a.recordUnsealedContainer(ctx, pod); err != nil {
+		l.Warn("Error recording unsealed vault container", slog.String(loggingKeyError, err.Error()))
+	}
+}
+
+// unsealVaultPod submits the unseal keys of the target to the pod, returning the last seal status reported by the pod.
+func (a *App) unsealVaultPod(
+	ctx context.Context,
+	l *slog.Logger,
+	target *vaultTarget,
+	pod *core.Pod,
+) (*api.SealStatusResponse, error) {
+	if err := target.attestation.attestPod(ctx, a.base.KubeClient(), pod); err != nil {
+		l.Error("Refusing to unseal pod that failed attestation", slog.String(loggingKeyError, err.Error()))
+		return nil, withReason(reasonAttestation, fmt.Errorf("attestation failed: %w", err))
+	}
+
+	vc, err := newPodVaultClient(target, pod)
+	if err != nil {
+		return nil, withReason(reasonVaultClient, fmt.Errorf("error creating vault client: %w", err))
+	}
+
+	record := a.audit.recorder(target, pod)
+	joined, err := a.joinRaftPod(ctx, l, target, pod, vc, record)
+	if err != nil {
+		return nil, err
+	}
+
+	// A pod that joined the Raft cluster is unsealed with the keys of the cluster, so it must not be initialized.
+	var unsealKeys []string
+	if !joined {
+		unsealKeys, err = a.initVaultPod(ctx, l, target, pod, vc, record)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The keys of a pod that was just initialized are not in the key source yet.
+	if unsealKeys == nil {
+		unsealKeys, err = target.keys.UnsealKeys()
+		if err != nil {
+			return nil, withReason(reasonKeySource, fmt.Errorf("error getting unseal keys: %w", err))
+		}
+	}
+
+	submitted, err := a.custody.Nonce(ctx, pod)
+	if err != nil {
+		return nil, fmt.Errorf("error getting the unseal the custody group submitted its keys to: %w", err)
+	}
+
+	// Count the attempt towards the circuit breaker limits once keys were released to the pod, keeping the nonce of the
+	// unseal they were added to. Vault stops reporting the nonce once unsealed, so the last one reported is kept.
+	released, nonce := false, ""
+	recordNonce := func(action string, keyIndex int, status *api.SealStatusResponse, err error) error {
+		released = released || action == auditActionSubmit
+		if status != nil && status.Nonce != "" {
+			nonce = status.Nonce
+		}
+		return record(action, keyIndex, status, err)
+	}
+	status, err := unsealNewVaultPod(ctx, l, vc, unsealKeys, target.custodyGroup != "", submitted, recordNonce)
+	if released {
+		if err := a.breaker.Record(ctx, pod, nonce); err != nil {
+			l.Error("Error recording unseal for the circuit breaker", slog.String(loggingKeyError, err.Error()))
+		}
+	}
+
+	var skip *unsealSkip
+	switch {
+	case released && errors.As(err, &skip) && skip.reason == skipAwaitingCustodians:
+		if err := a.custody.Record(ctx, pod, nonce); err != nil {
+			l.Warn("Error recording the unseal the custody group submitted its keys to",
+				slog.String(loggingKeyError, err.Error()),
+			)
+		}
+	case err == nil && status != nil && !status.Sealed:
+		if err := a.custody.Forget(ctx, pod); err != nil {
+			l.Warn("Error forgetting the unseal the custody group submitted its keys to",
+				slog.String(loggingKeyError, err.Error()),
+			)
+		}
+	}
+	return status, err
+}
+
+// withUnsealQueue sets up the unseal queue and registers the workers that process it.
+func (a *App) withUnsealQueue() web.StartOption {
+	return func(base *web.App) error {
+		a.unsealQueue = newUnsealQueue(
+			a.config.UnsealWorkers,
+			a.config.UnsealMaxRetries,
+			a.config.UnsealRetryBaseDelay,
+			a.config.UnsealRetryMaxDelay,
+		)
+
+		return web.WithIndefiniteAsyncTask("unseal-workers", a.runUnsealWorkers(
+			logging.LoggerWithComponent(base.Logger(), "unseal-workers"),
+		))(base)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubeCache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// queuedPod creates a pod with a UID, as the queue keys pods by UID.
+func queuedPod(name string) *core.Pod {
+	pod := testPod(name)
+	pod.UID = types.UID(name + "-uid")
+	return pod
+}
+
+func TestUnsealQueue_ProcessNext(t *testing.T) {
+	t.Parallel()
+
+	errUnseal := errors.New("connection refused")
+
+	tests := []struct {
+		name       string
+		maxRetries int
+		results    []error
+
+		// wantRequeues is the number of requeues of the pod after each result.
+		wantRequeues []int
+	}{
+		{
+			name:         "unsealed or skipped",
+			maxRetries:   2,
+			results:      []error{nil},
+			wantRequeues: []int{0},
+		},
+		{
+			name:         "requeued on error",
+			maxRetries:   2,
+			results:      []error{errUnseal, errUnseal, nil},
+			wantRequeues: []int{1, 2, 0},
+		},
+		{
+			name:         "given up after every retry failed",
+			maxRetries:   1,
+			results:      []error{errUnseal, errUnseal},
+			wantRequeues: []int{1, 0},
+		},
+		{
+			name:         "no retries",
+			results:      []error{errUnseal},
+			wantRequeues: []int{0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			q := newUnsealQueue(1, tt.maxRetries, time.Millisecond, time.Millisecond)
+			t.Cleanup(q.queue.ShutDown)
+
+			pod := queuedPod("vault-0")
+			key := newPodKey(pod)
+			q.Add(pod)
+
+			calls := 0
+			unseal := func(_ context.Context, _ *slog.Logger, got podKey) error {
+				assert.Equal(t, key, got)
+				err := tt.results[calls]
+				calls++
+				return err
+			}
+
+			for i, want := range tt.wantRequeues {
+				if !assert.True(t, q.processNext(context.Background(), slog.New(slog.DiscardHandler), unseal)) {
+					return
+				}
+				assert.Equal(t, i+1, calls)
+				assert.Equal(t, want, q.queue.NumRequeues(key))
+			}
+
+			// Once forgotten, the pod is not handed out again.
+			assert.Zero(t, q.queue.Len())
+		})
+	}
+}
+
+func TestUnsealQueue_ProcessNext_Shutdown(t *testing.T) {
+	t.Parallel()
+
+	q := newUnsealQueue(1, 1, time.Millisecond, time.Millisecond)
+	q.queue.ShutDown()
+
+	unseal := func(context.Context, *slog.Logger, podKey) error {
+		t.Error("unseal called after the queue was shut down")
+		return nil
+	}
+	assert.False(t, q.processNext(context.Background(), slog.New(slog.DiscardHandler), unseal))
+}
+
+func TestUnsealQueue_Add(t *testing.T) {
+	t.Parallel()
+
+	q := newUnsealQueue(1, 1, time.Millisecond, time.Millisecond)
+	t.Cleanup(q.queue.ShutDown)
+
+	// Events for the same pod are deduplicated, while a replaced pod of the same name is queued on its own.
+	pod := queuedPod("vault-0")
+	q.Add(pod)
+	q.Add(pod)
+	replaced := queuedPod("vault-0")
+	replaced.UID = "replaced-uid"
+	q.Add(replaced)
+	assert.Equal(t, 2, q.queue.Len())
+}
+
+func TestUnsealQueue_MarkSealed(t *testing.T) {
+	t.Parallel()
+
+	q := newUnsealQueue(1, 1, time.Millisecond, time.Millisecond)
+	key := newPodKey(queuedPod("vault-0"))
+
+	q.markSealed(key, "vault")
+	first := q.sealed[key].since
+	q.markSealed(key, "vault")
+	assert.Equal(t, first, q.sealed[key].since, "the time the pod was first seen sealed is kept")
+
+	since, ok := q.markUnsealed(key)
+	assert.True(t, ok)
+	assert.Equal(t, first, since)
+
+	_, ok = q.markUnsealed(key)
+	assert.False(t, ok)
+}
+
+func TestApp_SkipPod(t *testing.T) {
+	t.Parallel()
+
+	events := record.NewFakeRecorder(10)
+	a := &App{
+		events:      events,
+		unsealQueue: newUnsealQueue(1, 1, time.Millisecond, time.Millisecond),
+	}
+	target := testTarget(t, "vault", "app=vault")
+	pod := queuedPod("vault-0")
+	key := newPodKey(pod)
+
+	paused := &unsealSkip{reason: skipPaused, message: "unsealing is paused"}
+	breakerOpen := &unsealSkip{reason: skipBreakerOpen, message: "unseal circuit breaker open"}
+
+	steps := []struct {
+		name   string
+		before func()
+		skip   *unsealSkip
+		want   string
+	}{
+		{
+			name: "pod not tracked as sealed",
+			skip: paused,
+			want: "Normal UnsealSkipped Skipped unsealing Vault pod: unsealing is paused",
+		},
+		{
+			name:   "first skip",
+			before: func() { a.unsealQueue.markSealed(key, target.name) },
+			skip:   paused,
+			want:   "Normal UnsealSkipped Skipped unsealing Vault pod: unsealing is paused",
+		},
+		{
+			name: "same reason",
+			skip: paused,
+		},
+		{
+			name: "another reason",
+			skip: breakerOpen,
+			want: "Normal UnsealSkipped Skipped unsealing Vault pod: unseal circuit breaker open",
+		},
+		{
+			name: "previous reason",
+			skip: paused,
+			want: "Normal UnsealSkipped Skipped unsealing Vault pod: unsealing is paused",
+		},
+		{
+			name:   "after an unseal attempt",
+			before: func() { a.unsealQueue.clearSkipped(key) },
+			skip:   paused,
+			want:   "Normal UnsealSkipped Skipped unsealing Vault pod: unsealing is paused",
+		},
+		{
+			name: "same reason after an unseal attempt",
+			skip: paused,
+		},
+		{
+			name: "sealed again",
+			before: func() {
+				a.unsealQueue.markUnsealed(key)
+				a.unsealQueue.markSealed(key, target.name)
+			},
+			skip: paused,
+			want: "Normal UnsealSkipped Skipped unsealing Vault pod: unsealing is paused",
+		},
+	}
+
+	for _, step := range steps {
+		if step.before != nil {
+			step.before()
+		}
+		a.skipPod(slog.New(slog.DiscardHandler), target, pod, step.skip)
+
+		var got string
+		select {
+		case got = <-events.Events:
+		default:
+		}
+		assert.Equal(t, step.want, got, step.name)
+	}
+}
+
+func TestDeletePodHandler(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		deleted func(pod *core.Pod) any
+	}{
+		{
+			name:    "pod",
+			deleted: func(pod *core.Pod) any { return pod },
+		},
+		{
+			name: "tombstone",
+			deleted: func(pod *core.Pod) any {
+				return kubeCache.DeletedFinalStateUnknown{Key: pod.Namespace + "/" + pod.Name, Obj: pod}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			q := newUnsealQueue(1, 1, time.Millisecond, time.Millisecond)
+			pod := queuedPod("vault-0")
+			other := queuedPod("vault-1")
+			q.markSealed(newPodKey(pod), "vault")
+			q.markSealed(newPodKey(other), "vault")
+
+			deletePodHandler(q)(tt.deleted(pod))
+
+			_, ok := q.sealed[newPodKey(pod)]
+			assert.False(t, ok, "the deleted pod is no longer tracked as sealed")
+			_, ok = q.sealed[newPodKey(other)]
+			assert.True(t, ok, "other pods are still tracked as sealed")
+		})
+	}
+}
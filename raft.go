@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	core "k8s.io/api/core/v1"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+)
+
+// storageTypeRaft is the storage type reported by Vault pods using integrated storage.
+const storageTypeRaft = "raft"
+
+type (
+	// raftJoinConfig is the configuration of how uninitialized pods of a target join the Raft cluster.
+	raftJoinConfig struct {
+		LeaderAPIAddr        string `mapstructure:"leader_api_addr"`
+		LeaderCAFile         string `mapstructure:"leader_ca_file"`
+		LeaderClientCertFile string `mapstructure:"leader_client_cert_file"`
+		LeaderClientKeyFile  string `mapstructure:"leader_client_key_file"`
+		NonVoter             bool   `mapstructure:"non_voter"`
+	}
+
+	// targetRaftJoin describes how uninitialized pods of a target join the Raft cluster of the active pod.
+	targetRaftJoin struct {
+		// leaderAPIAddr is the address the pod joins the active pod on. The placeholders {pod} and {namespace} are
+		// replaced with the name and namespace of the active pod. If empty, the address reported by the active pod is
+		// used.
+		leaderAPIAddr string
+
+		// leaderCAFile is the path to the CA bundle the pod verifies the active pod with. If empty, the CA bundle of the
+		// target is used.
+		leaderCAFile string
+
+		// leaderClientCertFile is the path to the client certificate the pod presents to the active pod. If empty, the
+		// client certificate of the target is used.
+		leaderClientCertFile string
+
+		// leaderClientKeyFile is the path to the key of the client certificate.
+		leaderClientKeyFile string
+
+		// nonVoter joins the pod as a non-voting member.
+		nonVoter bool
+	}
+)
+
+// newTargetRaftJoin creates the Raft join settings of a target from its configuration. Nil is returned if the pods of
+// the target do not join the Raft cluster.
+func newTargetRaftJoin(cfg *raftJoinConfig) (*targetRaftJoin, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	if (cfg.LeaderClientCertFile == "") != (cfg.LeaderClientKeyFile == "") {
+		return nil, errors.New("both leader_client_cert_file and leader_client_key_file must be provided")
+	}
+
+	return &targetRaftJoin{
+		leaderAPIAddr:        cfg.LeaderAPIAddr,
+		leaderCAFile:         cfg.LeaderCAFile,
+		leaderClientCertFile: cfg.LeaderClientCertFile,
+		leaderClientKeyFile:  cfg.LeaderClientKeyFile,
+		nonVoter:             cfg.NonVoter,
+	}, nil
+}
+
+// request creates the request that joins a pod of the target to the active pod, reachable on the given address.
+func (j *targetRaftJoin) request(target *vaultTarget, leader *core.Pod, leaderAddr string) (*api.RaftJoinRequest, error) {
+	req := &api.RaftJoinRequest{
+		LeaderAPIAddr: leaderAddr,
+		NonVoter:      j.nonVoter,
+	}
+	if j.leaderAPIAddr != "" {
+		req.LeaderAPIAddr = strings.NewReplacer(
+			"{pod}", leader.Name,
+			"{namespace}", leader.Namespace,
+		).Replace(j.leaderAPIAddr)
+	}
+
+	if target.scheme != schemeHTTPS {
+		return req, nil
+	}
+
+	ca, err := j.leaderCA(target, leader)
+	if err != nil {
+		return nil, err
+	}
+	req.LeaderCACert = ca
+
+	certFile, keyFile := j.leaderClientCertFile, j.leaderClientKeyFile
+	if certFile == "" {
+		certFile, keyFile = target.tls.clientCertFile, target.tls.clientKeyFile
+	}
+	if certFile != "" {
+		cert, err := os.ReadFile(certFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading leader client certificate: %w", err)
+		}
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading leader client key: %w", err)
+		}
+		req.LeaderClientCert = string(cert)
+		req.LeaderClientKey = string(key)
+	}
+
+	return req, nil
+}
+
+// leaderCA returns the CA bundle the joining pod verifies the active pod with, or an empty string to use the system
+// roots of the pod.
+func (j *targetRaftJoin) leaderCA(target *vaultTarget, leader *core.Pod) (string, error) {
+	caFile := j.leaderCAFile
+	if caFile == "" {
+		cfg, err := target.tls.vaultTLSConfig(leader)
+		if err != nil {
+			return "", fmt.Errorf("error creating tls config: %w", err)
+		} else if len(cfg.CACertBytes) > 0 {
+			return string(cfg.CACertBytes), nil
+		}
+		caFile = cfg.CACert
+	}
+
+	if caFile == "" {
+		return "", nil
+	}
+
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return "", fmt.Errorf("error reading leader ca: %w", err)
+	}
+	return string(ca), nil
+}
+
+// joinRaftPod joins the pod to the Raft cluster of the active pod of the target, if the target joins pods to it and
+// the pod is an uninitialized Raft pod. It returns whether the pod joined. A pod that joined is initialized, and is
+// unsealed with the keys of the cluster it joined.
+func (a *App) joinRaftPod(
+	ctx context.Context,
+	l *slog.Logger,
+	target *vaultTarget,
+	pod *core.Pod,
+	vc *api.Client,
+	record unsealRecorder,
+) (bool, error) {
+	if target.raftJoin == nil {
+		return false, nil
+	}
+
+	status, err := vaultSealStatus(ctx, vc)
+	if err != nil {
+		return false, withReason(reasonSealStatus, err)
+	} else if status.Initialized || status.StorageType != storageTypeRaft {
+		return false, nil
+	}
+
+	leader, leaderAddr := raftLeader(ctx, l, a.base.PodLister(), target, pod)
+	if leader == nil {
+		l.Debug("No active Vault pod found to join")
+		return false, nil
+	}
+
+	l = l.With(slog.String(loggingKeyLeader, leader.Name))
+
+	req, err := target.raftJoin.request(target, leader, leaderAddr)
+	if err != nil {
+		return false, withReason(reasonRaftJoin, fmt.Errorf("error creating raft join request: %w", err))
+	}
+
+	l.Info("Uninitialized Raft pod detected, joining the active Vault pod")
+
+	resp, err := vc.Sys().RaftJoinWithContext(ctx, req)
+	if recordErr := record(auditActionRaftJoin, 0, nil, err); recordErr != nil {
+		return false, withReason(reasonAudit, recordErr)
+	}
+	if err != nil {
+		return false, withReason(reasonRaftJoin, fmt.Errorf("error joining raft cluster: %w", err))
+	} else if !resp.Joined {
+		return false, withReason(reasonRaftJoin, fmt.Errorf("vault did not join the raft cluster of %s", leader.Name))
+	}
+
+	l.Info("Vault joined the Raft cluster")
+	a.events.Eventf(pod, core.EventTypeNormal, eventRaftJoined, "Joined the Raft cluster of active Vault pod %s", leader.Name)
+	return true, nil
+}
+
+// raftLeader asks every other running pod of the target which pod is active, returning the active pod and the address
+// it advertises. Nil is returned if no pod is active.
+func raftLeader(
+	ctx context.Context,
+	l *slog.Logger,
+	lister listersv1.PodLister,
+	target *vaultTarget,
+	pod *core.Pod,
+) (*core.Pod, string) {
+	pods, err := lister.Pods(target.namespace).List(target.selector)
+	if err != nil {
+		l.Warn("Error listing Vault pods", slog.String(loggingKeyError, err.Error()))
+		return nil, ""
+	}
+
+	slices.SortFunc(pods, func(x, y *core.Pod) int {
+		return strings.Compare(x.Name, y.Name)
+	})
+
+	for _, other := range pods {
+		if other.UID == pod.UID || other.Status.Phase != core.PodRunning || other.Status.PodIP == "" {
+			continue
+		}
+
+		leader, err := vaultLeader(ctx, target, other)
+		if err != nil {
+			l.Debug("Error asking Vault pod for the leader",
+				slog.String(loggingKeyLeader, other.Name),
+				slog.String(loggingKeyError, err.Error()),
+			)
+			continue
+		}
+
+		if leader.IsSelf && leader.LeaderAddress != "" {
+			return other, leader.LeaderAddress
+		}
+	}
+	return nil, ""
+}
+
+// vaultLeader asks the Vault pod of the target for the leader of its cluster.
+func vaultLeader(ctx context.Context, target *vaultTarget, pod *core.Pod) (*api.LeaderResponse, error) {
+	vc, err := newPodVaultClient(target, pod)
+	if err != nil {
+		return nil, fmt.Errorf("error creating vault client: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sealStatusTimeout)
+	defer cancel()
+
+	leader, err := vc.Sys().LeaderWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting leader: %w", err)
+	}
+	return leader, nil
+}
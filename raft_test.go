@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	kubeCache "k8s.io/client-go/tools/cache"
+)
+
+// writeTestFile writes the contents to a new file, returning its path.
+func writeTestFile(t *testing.T, name, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("error writing %s: %v", name, err)
+	}
+	return path
+}
+
+func TestNewTargetRaftJoin(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		cfg     *raftJoinConfig
+		wantNil bool
+		wantErr string
+	}{
+		{
+			name:    "no config",
+			wantNil: true,
+		},
+		{
+			name: "defaults",
+			cfg:  &raftJoinConfig{},
+		},
+		{
+			name: "client certificate and key",
+			cfg:  &raftJoinConfig{LeaderClientCertFile: "/tls/tls.crt", LeaderClientKeyFile: "/tls/tls.key"},
+		},
+		{
+			name:    "client certificate without its key",
+			cfg:     &raftJoinConfig{LeaderClientCertFile: "/tls/tls.crt"},
+			wantErr: "both leader_client_cert_file and leader_client_key_file must be provided",
+		},
+		{
+			name:    "client key without its certificate",
+			cfg:     &raftJoinConfig{LeaderClientKeyFile: "/tls/tls.key"},
+			wantErr: "both leader_client_cert_file and leader_client_key_file must be provided",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := newTargetRaftJoin(tt.cfg)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.wantNil, got == nil)
+			}
+		})
+	}
+}
+
+func TestTargetRaftJoin_Request(t *testing.T) {
+	t.Parallel()
+
+	leaderCA := writeTestFile(t, "leader-ca.crt", "leader ca")
+	leaderCert := writeTestFile(t, "leader.crt", "leader cert")
+	leaderKey := writeTestFile(t, "leader.key", "leader key")
+	targetCert := writeTestFile(t, "target.crt", "target cert")
+	targetKey := writeTestFile(t, "target.key", "target key")
+
+	leader := testPod("vault-1")
+	const leaderAddr = "https://10.0.0.1:8200"
+
+	tests := []struct {
+		name    string
+		join    *targetRaftJoin
+		scheme  string
+		tls     *targetTLS
+		want    *api.RaftJoinRequest
+		wantErr string
+	}{
+		{
+			name: "advertised address",
+			join: &targetRaftJoin{nonVoter: true},
+			tls:  new(targetTLS),
+			want: &api.RaftJoinRequest{LeaderAPIAddr: leaderAddr, NonVoter: true},
+		},
+		{
+			name: "address of the active pod",
+			join: &targetRaftJoin{leaderAPIAddr: "https://{pod}.vault-internal.{namespace}.svc:8200"},
+			tls:  new(targetTLS),
+			want: &api.RaftJoinRequest{LeaderAPIAddr: "https://vault-1.vault-internal.vault.svc:8200"},
+		},
+		{
+			name: "leader ca and client certificate",
+			join: &targetRaftJoin{
+				leaderCAFile:         leaderCA,
+				leaderClientCertFile: leaderCert,
+				leaderClientKeyFile:  leaderKey,
+			},
+			tls: &targetTLS{clientCertFile: targetCert, clientKeyFile: targetKey},
+			want: &api.RaftJoinRequest{
+				LeaderAPIAddr:    leaderAddr,
+				LeaderCACert:     "leader ca",
+				LeaderClientCert: "leader cert",
+				LeaderClientKey:  "leader key",
+			},
+		},
+		{
+			name: "client certificate of the target",
+			join: &targetRaftJoin{},
+			tls:  &targetTLS{clientCertFile: targetCert, clientKeyFile: targetKey},
+			want: &api.RaftJoinRequest{
+				LeaderAPIAddr:    leaderAddr,
+				LeaderClientCert: "target cert",
+				LeaderClientKey:  "target key",
+			},
+		},
+		{
+			name: "http omits the ca and client certificate",
+			join: &targetRaftJoin{
+				leaderAPIAddr:        "http://{pod}.vault-internal:8200",
+				leaderCAFile:         leaderCA,
+				leaderClientCertFile: leaderCert,
+				leaderClientKeyFile:  leaderKey,
+			},
+			scheme: "http",
+			tls:    &targetTLS{clientCertFile: targetCert, clientKeyFile: targetKey},
+			want:   &api.RaftJoinRequest{LeaderAPIAddr: "http://vault-1.vault-internal:8200"},
+		},
+		{
+			name:    "missing leader ca",
+			join:    &targetRaftJoin{leaderCAFile: filepath.Join(t.TempDir(), "missing.crt")},
+			tls:     new(targetTLS),
+			wantErr: "error reading leader ca: ",
+		},
+		{
+			name:    "missing client key",
+			join:    &targetRaftJoin{leaderClientCertFile: leaderCert, leaderClientKeyFile: "/missing/tls.key"},
+			tls:     new(targetTLS),
+			wantErr: "error reading leader client key: ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			target := &vaultTarget{scheme: schemeHTTPS, tls: tt.tls}
+			if tt.scheme != "" {
+				target.scheme = tt.scheme
+			}
+
+			got, err := tt.join.request(target, leader, leaderAddr)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTargetRaftJoin_LeaderCA(t *testing.T) {
+	t.Parallel()
+
+	leaderCA := writeTestFile(t, "leader-ca.crt", "leader ca")
+	targetCA := writeTestFile(t, "target-ca.crt", "target ca")
+	secrets := testSecretLister(t, &core.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "vault-ca", Namespace: "vault"},
+		Data:       map[string][]byte{defaultCASecretKey: []byte("secret ca")},
+	})
+	caSecret := &secretRef{namespace: "vault", name: "vault-ca", dataKeys: []string{defaultCASecretKey}}
+
+	tests := []struct {
+		name    string
+		join    *targetRaftJoin
+		tls     *targetTLS
+		want    string
+		wantErr string
+	}{
+		{
+			name: "leader ca",
+			join: &targetRaftJoin{leaderCAFile: leaderCA},
+			tls:  &targetTLS{caFile: targetCA, caSecret: caSecret, secrets: secrets},
+			want: "leader ca",
+		},
+		{
+			name: "ca file of the target",
+			join: &targetRaftJoin{},
+			tls:  &targetTLS{caFile: targetCA},
+			want: "target ca",
+		},
+		{
+			name: "ca secret of the target",
+			join: &targetRaftJoin{},
+			tls:  &targetTLS{caFile: targetCA, caSecret: caSecret, secrets: secrets},
+			want: "secret ca",
+		},
+		{
+			name: "system roots",
+			join: &targetRaftJoin{},
+			tls:  new(targetTLS),
+		},
+		{
+			name: "ca secret not found",
+			join: &targetRaftJoin{},
+			tls: &targetTLS{
+				caSecret: &secretRef{namespace: "vault", name: "missing", dataKeys: []string{defaultCASecretKey}},
+				secrets:  secrets,
+			},
+			wantErr: "error creating tls config: error getting ca secret vault/missing: ",
+		},
+		{
+			name:    "missing ca file",
+			join:    &targetRaftJoin{},
+			tls:     &targetTLS{caFile: "/missing/ca.crt"},
+			wantErr: "error reading leader ca: ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := tt.join.leaderCA(&vaultTarget{scheme: schemeHTTPS, tls: tt.tls}, testPod("vault-1"))
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+// raftPod describes a pod of the target in TestRaftLeader, and what its Vault reports as the leader.
+type raftPod struct {
+	name    string
+	phase   core.PodPhase
+	noIP    bool
+	isSelf  bool
+	offline bool
+}
+
+func TestRaftLeader(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		pods       []raftPod
+		wantLeader string
+	}{
+		{
+			name: "active pod",
+			pods: []raftPod{
+				{name: "vault-0"},
+				{name: "vault-1", phase: core.PodRunning},
+				{name: "vault-2", phase: core.PodRunning, isSelf: true},
+			},
+			wantLeader: "vault-2",
+		},
+		{
+			name: "skips itself",
+			pods: []raftPod{
+				{name: "vault-0", isSelf: true},
+				{name: "vault-1", phase: core.PodRunning, isSelf: true},
+			},
+			wantLeader: "vault-1",
+		},
+		{
+			name: "skips pods that are not running",
+			pods: []raftPod{
+				{name: "vault-0"},
+				{name: "vault-1", phase: core.PodPending, isSelf: true},
+				{name: "vault-2", phase: core.PodRunning, noIP: true, isSelf: true},
+				{name: "vault-3", phase: core.PodRunning, isSelf: true},
+			},
+			wantLeader: "vault-3",
+		},
+		{
+			name: "skips pods that cannot be reached",
+			pods: []raftPod{
+				{name: "vault-0"},
+				{name: "vault-1", phase: core.PodRunning, isSelf: true, offline: true},
+				{name: "vault-2", phase: core.PodRunning, isSelf: true},
+			},
+			wantLeader: "vault-2",
+		},
+		{
+			name: "no active pod",
+			pods: []raftPod{
+				{name: "vault-0"},
+				{name: "vault-1", phase: core.PodRunning},
+				{name: "vault-2", phase: core.PodPending, isSelf: true},
+			},
+		},
+		{
+			name: "only itself",
+			pods: []raftPod{{name: "vault-0", phase: core.PodRunning, isSelf: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			target := testTarget(t, "vault", "app=vault")
+			target.scheme = "http"
+
+			indexer := kubeCache.NewIndexer(kubeCache.MetaNamespaceKeyFunc, kubeCache.Indexers{})
+			addrs := make(map[string]string)
+			for _, p := range tt.pods {
+				pod := newRaftPod(t, p)
+				addrs[pod.Name] = generateVaultAddress(target, pod.Spec.Containers[0].Ports, pod.Status.PodIP)
+				if err := indexer.Add(pod); err != nil {
+					t.Fatalf("error adding pod: %v", err)
+				}
+			}
+
+			// The joining pod is the first pod.
+			self, err := listersv1.NewPodLister(indexer).Pods("vault").Get(tt.pods[0].name)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			leader, addr := raftLeader(context.Background(), slog.New(slog.DiscardHandler),
+				listersv1.NewPodLister(indexer), target, self)
+			if tt.wantLeader == "" {
+				assert.Nil(t, leader)
+				assert.Empty(t, addr)
+				return
+			}
+			if assert.NotNil(t, leader) {
+				assert.Equal(t, tt.wantLeader, leader.Name)
+				assert.Equal(t, addrs[tt.wantLeader], addr)
+			}
+		})
+	}
+}
+
+// newRaftPod creates the pod, served by a Vault that reports the leader as described. Every Vault advertises its own
+// address as the leader address when it is the leader.
+func newRaftPod(t *testing.T, p raftPod) *core.Pod {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/sys/leader" {
+			http.NotFound(w, r)
+			return
+		}
+		resp := &api.LeaderResponse{HAEnabled: true, IsSelf: p.isSelf}
+		if p.isSelf {
+			resp.LeaderAddress = "http://" + r.Host
+		}
+		writeTestObject(w, http.StatusOK, resp)
+	}))
+	t.Cleanup(srv.Close)
+	if p.offline {
+		srv.Close()
+	}
+
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("error parsing address: %v", err)
+	}
+	containerPort, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("error parsing port: %v", err)
+	}
+
+	pod := testPod(p.name)
+	pod.UID = types.UID(p.name + "-uid")
+	pod.Labels = map[string]string{"app": "vault"}
+	pod.Spec.Containers = []core.Container{{
+		Name:  "vault",
+		Ports: []core.ContainerPort{{Name: "http", ContainerPort: int32(containerPort)}}, // nolint:gosec // Ports fit.
+	}}
+	pod.Status.Phase = p.phase
+	if !p.noIP {
+		pod.Status.PodIP = host
+	}
+	return pod
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/logging"
+	kubeCache "k8s.io/client-go/tools/cache"
+)
+
+// reconcileVaultPods periodically sweeps every Vault pod of every target and re-queues any pod that is still sealed.
+// This retries unseals that failed in the informer handlers without waiting for the pod to change.
+func (a *App) reconcileVaultPods(
+	l *slog.Logger,
+	interval time.Duration,
+) web.AsyncTaskFunc {
+	return func(ctx context.Context) {
+		if !kubeCache.WaitForCacheSync(ctx.Done(), a.base.PodInformer().HasSynced) {
+			l.Error("Timed out waiting for pod cache to sync")
+			return
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				a.reconcileTargets(l)
+			}
+		}
+	}
+}
+
+// reconcileTargets queues every Vault pod of every target that may be sealed.
+func (a *App) reconcileTargets(l *slog.Logger) {
+	for _, target := range a.targets {
+		pods, err := a.base.PodLister().Pods(target.namespace).List(target.selector)
+		if err != nil {
+			l.Error("Error listing vault pods",
+				slog.String(loggingKeyTarget, target.name),
+				slog.String(loggingKeyError, err.Error()),
+			)
+			continue
+		}
+
+		for _, pod := range pods {
+			enqueueVaultPod(a.shard, a.targets, a.unsealQueue, pod)
+		}
+	}
+}
+
+// withReconcileLoop registers the reconcile loop if a reconcile interval is configured.
+func (a *App) withReconcileLoop() web.StartOption {
+	return func(base *web.App) error {
+		if a.config.ReconcileInterval <= 0 {
+			return nil
+		}
+
+		return web.WithIndefiniteAsyncTask("reconcile-vault-pods", a.reconcileVaultPods(
+			logging.LoggerWithComponent(base.Logger(), "reconcile-vault-pods"),
+			a.config.ReconcileInterval,
+		))(base)
+	}
+}
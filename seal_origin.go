@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// annotationUnsealedContainer records the ID of the Vault container that was last seen unsealed. A sealed pod
+	// still running that container was sealed in place, e.g. by `vault operator seal`, rather than by a restart.
+	annotationUnsealedContainer = "vault-unseal.io/unsealed-container"
+
+	// inPlaceSealIgnore leaves pods that were sealed in place sealed.
+	inPlaceSealIgnore = "ignore"
+
+	// inPlaceSealUnseal unseals pods that were sealed in place, like any other sealed pod.
+	inPlaceSealUnseal = "unseal"
+
+	// inPlaceSealApprove unseals pods that were sealed in place once enough operators approved it.
+	inPlaceSealApprove = "approve"
+
+	// skipInPlaceSeal is the skip reason when the pod was sealed in place and the target leaves such pods sealed.
+	skipInPlaceSeal = "in_place_seal"
+)
+
+// vaultContainerID returns the ID of the running Vault container of the pod, which changes every time the container
+// restarts.
+func vaultContainerID(pod *core.Pod) string {
+	if len(pod.Spec.Containers) == 0 {
+		return ""
+	}
+
+	name := pod.Spec.Containers[0].Name
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == name && status.State.Running != nil {
+			return status.ContainerID
+		}
+	}
+	return ""
+}
+
+// isInPlaceSeal checks if the pod was sealed without its Vault container restarting since it was last seen unsealed.
+func isInPlaceSeal(pod *core.Pod) bool {
+	id := vaultContainerID(pod)
+	return id != "" && pod.Annotations[annotationUnsealedContainer] == id
+}
+
+// needsUnsealedContainer checks if the pod is unsealed but has not been annotated with its running Vault container.
+func needsUnsealedContainer(pod *core.Pod) bool {
+	id := vaultContainerID(pod)
+	return id != "" && pod.Annotations[annotationUnsealedContainer] != id
+}
+
+// recordUnsealedContainer annotates the pod with its running Vault container, so a later seal of the same container
+// is recognised as an in-place seal.
+func (a *App) recordUnsealedContainer(ctx context.Context, pod *core.Pod) error {
+	if !needsUnsealedContainer(pod) {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				annotationUnsealedContainer: vaultContainerID(pod),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error marshalling pod patch: %w", err)
+	}
+
+	if _, err := a.base.KubeClient().CoreV1().Pods(pod.Namespace).Patch(
+		ctx,
+		pod.Name,
+		types.MergePatchType,
+		patch,
+		metav1.PatchOptions{},
+	); err != nil {
+		return fmt.Errorf("error annotating pod: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+)
+
+// containerPod creates a pod whose Vault container has the given ID, running if running is set. An empty annotation is
+// not set.
+func containerPod(containerID string, running bool, annotation string) *core.Pod {
+	pod := testPod("vault-0")
+	pod.Spec.Containers = []core.Container{{Name: "vault"}, {Name: "sidecar"}}
+
+	status := core.ContainerStatus{Name: "vault", ContainerID: containerID}
+	if running {
+		status.State.Running = new(core.ContainerStateRunning)
+	} else {
+		status.State.Waiting = &core.ContainerStateWaiting{Reason: "CrashLoopBackOff"}
+	}
+	sidecar := core.ContainerStatus{Name: "sidecar", ContainerID: "containerd://sidecar"}
+	sidecar.State.Running = new(core.ContainerStateRunning)
+	pod.Status.ContainerStatuses = []core.ContainerStatus{sidecar, status}
+
+	if annotation != "" {
+		pod.Annotations = map[string]string{annotationUnsealedContainer: annotation}
+	}
+	return pod
+}
+
+func TestSealOrigin(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name                       string
+		pod                        *core.Pod
+		wantContainerID            string
+		wantInPlaceSeal            bool
+		wantNeedsUnsealedContainer bool
+	}{
+		{
+			name:            "unchanged container",
+			pod:             containerPod("containerd://a", true, "containerd://a"),
+			wantContainerID: "containerd://a",
+			wantInPlaceSeal: true,
+		},
+		{
+			name:                       "container restarted",
+			pod:                        containerPod("containerd://b", true, "containerd://a"),
+			wantContainerID:            "containerd://b",
+			wantNeedsUnsealedContainer: true,
+		},
+		{
+			name:                       "missing annotation",
+			pod:                        containerPod("containerd://a", true, ""),
+			wantContainerID:            "containerd://a",
+			wantNeedsUnsealedContainer: true,
+		},
+		{
+			name: "container not running",
+			pod:  containerPod("containerd://a", false, "containerd://a"),
+		},
+		{
+			name: "container not started",
+			pod:  containerPod("", true, ""),
+		},
+		{
+			name: "no container status",
+			pod: func() *core.Pod {
+				pod := containerPod("containerd://a", true, "containerd://a")
+				pod.Status.ContainerStatuses = nil
+				return pod
+			}(),
+		},
+		{
+			name: "no containers",
+			pod:  testPod("vault-0"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.wantContainerID, vaultContainerID(tt.pod))
+			assert.Equal(t, tt.wantInPlaceSeal, isInPlaceSeal(tt.pod))
+			assert.Equal(t, tt.wantNeedsUnsealedContainer, needsUnsealedContainer(tt.pod))
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/logging"
+	kubeCache "k8s.io/client-go/tools/cache"
+)
+
+const (
+	// shardingHashBucket shares the Vault pods out across the replicas by the endpoints of the service.
+	shardingHashBucket = "hash-bucket"
+
+	// shardingLeaderElection gives every Vault pod to the elected leader, while the other replicas wait to take over.
+	shardingLeaderElection = "leader-election"
+)
+
+// leaderBucket puts every Vault pod in the bucket of the elected leader.
+type leaderBucket struct {
+	base *web.App
+}
+
+// InBucket checks if the replica is the leader.
+func (b *leaderBucket) InBucket(string) bool {
+	return b.base.IsLeader()
+}
+
+// shardName returns the name of the service whose endpoints the Vault pods are shared out across, or of the lease the
+// leader is elected with. Every custody group must submit its keys to every pod, so each group shards the pods across
+// its own replicas.
+func (c *AppConfig) shardName() string {
+	if c.CustodyGroup == "" {
+		return appName
+	}
+	return appName + "-" + c.CustodyGroup
+}
+
+// watchLeaderChange queues every sealed Vault pod when the replica becomes the leader, as the pods were ignored while
+// it was a follower.
+func (a *App) watchLeaderChange(
+	l *slog.Logger,
+) web.AsyncTaskFunc {
+	return func(ctx context.Context) {
+		if !kubeCache.WaitForCacheSync(ctx.Done(), a.base.PodInformer().HasSynced) {
+			l.Error("Timed out waiting for pod cache to sync")
+			return
+		}
+
+		// The replica may have become the leader while the cache was syncing.
+		leader := a.base.IsLeader()
+		isLeader.Set(boolToFloat(leader))
+		if leader {
+			a.reconcileTargets(l)
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-a.base.LeaderChange():
+				leader := a.base.IsLeader()
+				isLeader.Set(boolToFloat(leader))
+				if leader {
+					l.Info("Elected leader, queueing every sealed vault pod")
+					a.reconcileTargets(l)
+				}
+			}
+		}
+	}
+}
+
+// withSharding decides which Vault pods the replica unseals, either sharding them across every replica or giving them
+// all to the elected leader.
+func (a *App) withSharding() web.StartOption {
+	return func(base *web.App) error {
+		switch a.config.ShardingMode {
+		case shardingHashBucket:
+			if err := web.WithServiceEndpointHashBucket(a.config.shardName())(base); err != nil {
+				return err
+			}
+			a.shard = base.ServiceEndpointHashBucket()
+			return nil
+		case shardingLeaderElection:
+			if err := web.WithLeaderElection(a.config.shardName())(base); err != nil {
+				return err
+			}
+			a.shard = &leaderBucket{base: base}
+
+			return web.WithIndefiniteAsyncTask("watch-leader-change", a.watchLeaderChange(
+				logging.LoggerWithComponent(base.Logger(), "watch-leader-change"),
+			))(base)
+		default:
+			return fmt.Errorf("unknown sharding mode %q", a.config.ShardingMode)
+		}
+	}
+}
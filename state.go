@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	core "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/k8s"
+)
+
+// maxStateUpdateAttempts is the number of times an update of the state ConfigMap is retried when another replica
+// updated it at the same time.
+const maxStateUpdateAttempts = 5
+
+// errStateUnchanged is returned by a state change that left the state as it was, so there is nothing to write.
+var errStateUnchanged = errors.New("state unchanged")
+
+// stateStore keeps the runtime state shared by every replica in a ConfigMap, so a change made through one replica is
+// seen by all of them and survives restarts.
+type stateStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// newStateStore creates a state store backed by the given ConfigMap.
+func newStateStore(client kubernetes.Interface, namespace, name string) *stateStore {
+	return &stateStore{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+// Get returns the current state. A missing ConfigMap is an empty state.
+func (s *stateStore) Get(ctx context.Context) (map[string]string, error) {
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if kubeErrors.IsNotFound(err) {
+		return make(map[string]string), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting state configmap %s/%s: %w", s.namespace, s.name, err)
+	}
+
+	if cm.Data == nil {
+		return make(map[string]string), nil
+	}
+	return cm.Data, nil
+}
+
+// Update applies the change to the current state, creating the ConfigMap if it does not exist. The change is retried
+// against the latest state if another replica updated it at the same time, so it must be safe to call more than once.
+// The change returns errStateUnchanged to skip the write.
+func (s *stateStore) Update(ctx context.Context, change func(data map[string]string) error) error {
+	var err error
+	for range maxStateUpdateAttempts {
+		err = s.update(ctx, change)
+		if !kubeErrors.IsConflict(err) && !kubeErrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("error updating state configmap %s/%s: %w", s.namespace, s.name, err)
+}
+
+// update applies the change to the current state once.
+func (s *stateStore) update(ctx context.Context, change func(data map[string]string) error) error {
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if kubeErrors.IsNotFound(err) {
+		cm = &core.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.name,
+				Namespace: s.namespace,
+				Labels: map[string]string{
+					"app.kubernetes.io/managed-by": appName,
+				},
+			},
+		}
+	} else if err != nil {
+		return fmt.Errorf("error getting state configmap %s/%s: %w", s.namespace, s.name, err)
+	}
+
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	if err := change(cm.Data); errors.Is(err, errStateUnchanged) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if cm.ResourceVersion == "" {
+		_, err = s.client.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{})
+	} else {
+		_, err = s.client.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// withStateStore sets up the store of the runtime state shared by every replica.
+func (a *App) withStateStore() web.StartOption {
+	return func(base *web.App) error {
+		a.state = newStateStore(base.KubeClient(), k8s.DeployedNamespace(), a.config.StateConfigMap)
+		return nil
+	}
+}
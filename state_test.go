@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	testStateNamespace = "vault-unseal"
+	testStateName      = "vault-unseal-state"
+)
+
+// fakeConfigMapServer is a Kubernetes API server that only serves ConfigMaps, rejecting updates of a stale resource
+// version like the real API server.
+type fakeConfigMapServer struct {
+	mu         sync.Mutex
+	configMaps map[string]*core.ConfigMap
+	version    int
+}
+
+// newTestStateStore creates a state store backed by a fakeConfigMapServer.
+func newTestStateStore(t *testing.T) (*stateStore, *fakeConfigMapServer) {
+	t.Helper()
+
+	fs := &fakeConfigMapServer{configMaps: make(map[string]*core.ConfigMap)}
+	client := newTestKubeClient(t, http.HandlerFunc(fs.serveHTTP))
+	return newStateStore(client, testStateNamespace, testStateName), fs
+}
+
+// newTestKubeClient creates a Kubernetes client talking to a fake API server serving the handler.
+func newTestKubeClient(t *testing.T, handler http.Handler) kubernetes.Interface {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	client, err := kubernetes.NewForConfig(&rest.Config{
+		Host: srv.URL,
+		ContentConfig: rest.ContentConfig{
+			ContentType: "application/json",
+		},
+	})
+	if err != nil {
+		t.Fatalf("error creating kubernetes client: %v", err)
+	}
+	return client
+}
+
+func (fs *fakeConfigMapServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	prefix := "/api/v1/namespaces/" + testStateNamespace + "/configmaps"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeTestStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+	switch r.Method {
+	case http.MethodGet:
+		cm, ok := fs.configMaps[name]
+		if !ok {
+			writeTestStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+			return
+		}
+		writeTestObject(w, http.StatusOK, cm)
+	case http.MethodPost, http.MethodPut:
+		cm := new(core.ConfigMap)
+		if err := json.NewDecoder(r.Body).Decode(cm); err != nil {
+			writeTestStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest)
+			return
+		}
+
+		existing, ok := fs.configMaps[cm.Name]
+		switch {
+		case r.Method == http.MethodPost && ok:
+			writeTestStatus(w, http.StatusConflict, metav1.StatusReasonAlreadyExists)
+			return
+		case r.Method == http.MethodPut && !ok:
+			writeTestStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+			return
+		case r.Method == http.MethodPut && existing.ResourceVersion != cm.ResourceVersion:
+			writeTestStatus(w, http.StatusConflict, metav1.StatusReasonConflict)
+			return
+		}
+
+		fs.version++
+		cm.ResourceVersion = strconv.Itoa(fs.version)
+		fs.configMaps[cm.Name] = cm
+		writeTestObject(w, http.StatusOK, cm)
+	default:
+		writeTestStatus(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed)
+	}
+}
+
+// writeTestObject writes the object as the response of a fake API server.
+func writeTestObject(w http.ResponseWriter, code int, obj any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(obj)
+}
+
+// writeTestStatus writes the failure as the response of a fake API server.
+func writeTestStatus(w http.ResponseWriter, code int, reason metav1.StatusReason) {
+	writeTestObject(w, code, &metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Code:     int32(code), // nolint:gosec // HTTP status codes fit.
+		Reason:   reason,
+	})
+}
+
+// bumpVersion changes the resource version of the ConfigMap, as another replica updating it would.
+func (fs *fakeConfigMapServer) bumpVersion(name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.version++
+	fs.configMaps[name].ResourceVersion = strconv.Itoa(fs.version)
+}
+
+func TestStateStore_Update(t *testing.T) {
+	t.Parallel()
+
+	store, fs := newTestStateStore(t)
+	ctx := context.Background()
+
+	data, err := store.Get(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+
+	// The first update creates the ConfigMap.
+	assert.NoError(t, store.Update(ctx, func(data map[string]string) error {
+		data["key"] = "first"
+		return nil
+	}))
+
+	// A change racing with another replica is retried against the latest state.
+	calls := 0
+	assert.NoError(t, store.Update(ctx, func(data map[string]string) error {
+		calls++
+		if calls == 1 {
+			fs.bumpVersion(testStateName)
+		}
+		data["key"] = "second"
+		return nil
+	}))
+	assert.Equal(t, 2, calls)
+
+	// An unchanged state is not written.
+	version := fs.configMaps[testStateName].ResourceVersion
+	assert.NoError(t, store.Update(ctx, func(map[string]string) error {
+		return errStateUnchanged
+	}))
+	assert.Equal(t, version, fs.configMaps[testStateName].ResourceVersion)
+
+	data, err = store.Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"key": "second"}, data)
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/k8s"
+	"github.com/jacobbrewer1/web/logging"
+	"github.com/spf13/viper"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// defaultVaultScheme is the scheme used to talk to Vault when a target does not configure one.
+	defaultVaultScheme = schemeHTTPS
+
+	// sealCheckLabel decides whether a pod is sealed from the vault-sealed label written by Vault's Kubernetes service
+	// registration.
+	sealCheckLabel = "label"
+
+	// sealCheckAPI decides whether a pod is sealed by asking the pod for its seal status. The vault-sealed label is only
+	// used as a hint.
+	sealCheckAPI = "api"
+
+	// defaultVaultPort is the port used to talk to Vault when a target does not configure one and the pod has no
+	// container port named after the scheme.
+	defaultVaultPort = 8200
+)
+
+type (
+	// targetConfig is the configuration of a single Vault cluster in the configuration file.
+	targetConfig struct {
+		Name             string             `mapstructure:"name"`
+		Namespace        string             `mapstructure:"namespace"`
+		Service          string             `mapstructure:"service"`
+		LabelSelector    string             `mapstructure:"label_selector"`
+		Scheme           string             `mapstructure:"scheme"`
+		Port             int                `mapstructure:"port"`
+		Threshold        int                `mapstructure:"threshold"`
+		SealCheck        string             `mapstructure:"seal_check"`
+		InPlaceSeal      string             `mapstructure:"in_place_seal"`
+		Paused           bool               `mapstructure:"paused"`
+		TLS              *tlsConfig         `mapstructure:"tls"`
+		AllowPlaintext   bool               `mapstructure:"allow_plaintext"`
+		UnsealKeys       []string           `mapstructure:"unseal_keys"`
+		UnsealKeysSecret *secretRefConfig   `mapstructure:"unseal_keys_secret"`
+		Notifiers        []*notifierConfig  `mapstructure:"notifiers"`
+		Attestation      *attestationConfig `mapstructure:"attestation"`
+		Policy           *policyConfig      `mapstructure:"policy"`
+		Init             *initConfig        `mapstructure:"init"`
+		RaftJoin         *raftJoinConfig    `mapstructure:"raft_join"`
+	}
+
+	// secretRefConfig is the configuration of the Kubernetes Secret that holds the unseal keys.
+	secretRefConfig struct {
+		Name      string   `mapstructure:"name"`
+		Namespace string   `mapstructure:"namespace"`
+		Keys      []string `mapstructure:"keys"`
+	}
+
+	// secretRef references the Kubernetes Secret that holds the unseal keys.
+	secretRef struct {
+		namespace string
+		name      string
+		dataKeys  []string
+	}
+
+	// vaultTarget describes a Vault cluster whose pods are watched and unsealed.
+	vaultTarget struct {
+		// name identifies the target in logs.
+		name string
+
+		// namespace is the namespace the Vault pods run in.
+		namespace string
+
+		// selector matches the labels of the Vault pods.
+		selector labels.Selector
+
+		// scheme is the scheme used to talk to the Vault pods.
+		scheme string
+
+		// port is the port used to talk to the Vault pods. If zero, the container port named after the scheme is used.
+		port int
+
+		// threshold is the number of unseal keys required to unseal the cluster.
+		threshold int
+
+		// sealCheck is how the target decides whether a pod is sealed, either sealCheckLabel or sealCheckAPI.
+		sealCheck string
+
+		// inPlaceSeal is what to do with pods that were sealed without restarting, either inPlaceSealIgnore,
+		// inPlaceSealUnseal or inPlaceSealApprove.
+		inPlaceSeal string
+
+		// paused stops the pods of the target from being unsealed.
+		paused bool
+
+		// tls describes how the Vault pods are verified when talking to them over TLS.
+		tls *targetTLS
+
+		// attestation describes what a pod must look like before it is given unseal keys.
+		attestation *attestation
+
+		// unsealKeys are the keys listed in the configuration file. Only used if unsealKeysSecret is nil.
+		unsealKeys []string
+
+		// unsealKeysSecret references the Secret holding the unseal keys.
+		unsealKeysSecret *secretRef
+
+		// custodyGroup is the custody group of the replica. If set, the replica only holds some of the unseal keys and
+		// the other groups submit the rest.
+		custodyGroup string
+
+		// keys provides the unseal keys for the target.
+		keys keySource
+
+		// notifiers are told about every attempt to unseal a pod of the target.
+		notifiers []notifier
+
+		// policy decides when pods of the target are unsealed automatically. Nil unseals them at any time.
+		policy *unsealPolicy
+
+		// init describes how an uninitialized Vault is initialized. Nil leaves uninitialized pods alone.
+		init *targetInit
+
+		// raftJoin describes how uninitialized Raft pods join the active pod. Nil leaves them alone.
+		raftJoin *targetRaftJoin
+	}
+
+	// vaultTargets are all the Vault clusters guarded by the application.
+	vaultTargets []*vaultTarget
+)
+
+// String returns the namespaced name of the Secret.
+func (r *secretRef) String() string {
+	return r.namespace + "/" + r.name
+}
+
+// Matches checks if the pod belongs to the target.
+func (t *vaultTarget) Matches(pod *core.Pod) bool {
+	return pod.GetNamespace() == t.namespace && t.selector.Matches(labels.Set(pod.Labels))
+}
+
+// ForPod returns the target the pod belongs to, or nil if the pod is not a Vault pod of any target.
+func (ts vaultTargets) ForPod(pod *core.Pod) *vaultTarget {
+	for _, t := range ts {
+		if t.Matches(pod) {
+			return t
+		}
+	}
+	return nil
+}
+
+// has checks if there is a target with the given name.
+func (ts vaultTargets) has(name string) bool {
+	for _, t := range ts {
+		if t.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// needsApproval checks if unsealing pods of the target can need approval.
+func (t *vaultTarget) needsApproval() bool {
+	return t.inPlaceSeal == inPlaceSealApprove || t.attestation.unknownImage == unknownImageApprove || t.policy.escalates()
+}
+
+// usesSecrets checks if any target reads its unseal keys or CA bundle from a Kubernetes Secret.
+func (ts vaultTargets) usesSecrets() bool {
+	for _, t := range ts {
+		if (t.unsealKeysSecret != nil && t.custodyGroup == "") || t.tls.caSecret != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// loadTargets reads the Vault clusters to guard from the configuration file.
+func (a *App) loadTargets(ctx context.Context) error {
+	return a.loadTargetsFrom(ctx, a.base.Viper())
+}
+
+// loadTargetsFrom reads the Vault clusters to guard from the configuration. If no targets are configured, a single
+// target is created from the environment and the top level unseal keys for backwards compatibility.
+func (a *App) loadTargetsFrom(ctx context.Context, vip *viper.Viper) error {
+	if a.config.CustodyGroup != "" {
+		if err := validateCustodyGroup(a.config.CustodyGroup); err != nil {
+			return err
+		}
+	}
+
+	decrypter, err := newKeyDecrypter(a.config)
+	if err != nil {
+		return fmt.Errorf("failed to create unseal key decrypter: %w", err)
+	}
+	a.decrypter = decrypter
+
+	configs := make([]*targetConfig, 0)
+	if vip.IsSet("targets") {
+		if err := vip.UnmarshalKey("targets", &configs); err != nil {
+			return fmt.Errorf("failed to parse targets: %w", err)
+		}
+		if len(configs) == 0 {
+			return errors.New("no targets provided")
+		}
+	} else {
+		legacy := &targetConfig{
+			Name:          a.config.TargetService,
+			Namespace:     a.config.VaultNamespace,
+			Service:       a.config.TargetService,
+			LabelSelector: a.config.VaultLabelSelector,
+			SealCheck:     a.config.SealCheck,
+			InPlaceSeal:   a.config.InPlaceSeal,
+			Scheme:        a.config.VaultScheme,
+			TLS: &tlsConfig{
+				CAFile:         a.config.VaultCAFile,
+				ClientCertFile: a.config.VaultClientCertFile,
+				ClientKeyFile:  a.config.VaultClientKeyFile,
+				ServerName:     a.config.VaultTLSServerName,
+			},
+			AllowPlaintext: a.config.AllowPlaintext,
+			Attestation: &attestationConfig{
+				StatefulSet:        a.config.AttestStatefulSet,
+				ServiceAccount:     a.config.AttestServiceAccount,
+				ImageDigests:       a.config.AttestImageDigests,
+				TLSPublicKeySHA256: a.config.AttestTLSPublicKeySHA256,
+				UnknownImage:       a.config.AttestUnknownImage,
+			},
+			UnsealKeys: vip.GetStringSlice("unseal_keys"),
+		}
+		if vip.IsSet("notifiers") {
+			if err := vip.UnmarshalKey("notifiers", &legacy.Notifiers); err != nil {
+				return fmt.Errorf("failed to parse notifiers: %w", err)
+			}
+		}
+		if vip.IsSet("init") {
+			legacy.Init = new(initConfig)
+			if err := vip.UnmarshalKey("init", legacy.Init); err != nil {
+				return fmt.Errorf("failed to parse init: %w", err)
+			}
+		}
+		if vip.IsSet("raft_join") {
+			legacy.RaftJoin = new(raftJoinConfig)
+			if err := vip.UnmarshalKey("raft_join", legacy.RaftJoin); err != nil {
+				return fmt.Errorf("failed to parse raft_join: %w", err)
+			}
+		}
+		if vip.IsSet("unseal_keys_secret") {
+			legacy.UnsealKeysSecret = &secretRefConfig{
+				Name:      vip.GetString("unseal_keys_secret.name"),
+				Namespace: vip.GetString("unseal_keys_secret.namespace"),
+				Keys:      vip.GetStringSlice("unseal_keys_secret.keys"),
+			}
+		}
+		configs = append(configs, legacy)
+	}
+
+	// The top level policy applies to every target without its own.
+	if vip.IsSet("policy") {
+		policy := new(policyConfig)
+		if err := vip.UnmarshalKey("policy", policy); err != nil {
+			return fmt.Errorf("failed to parse policy: %w", err)
+		}
+		for _, cfg := range configs {
+			if cfg.Policy == nil {
+				cfg.Policy = policy
+			}
+		}
+	}
+
+	targets := make(vaultTargets, 0, len(configs))
+	names := make(map[string]struct{})
+	for i, cfg := range configs {
+		target, err := a.newVaultTarget(ctx, cfg)
+		if err != nil {
+			return fmt.Errorf("invalid target %d: %w", i, err)
+		}
+
+		if _, ok := names[target.name]; ok {
+			return fmt.Errorf("duplicate target name %s", target.name)
+		}
+		names[target.name] = struct{}{}
+
+		targets = append(targets, target)
+	}
+
+	a.targets = targets
+	return nil
+}
+
+// newVaultTarget creates a target from its configuration.
+func (a *App) newVaultTarget(ctx context.Context, cfg *targetConfig) (*vaultTarget, error) {
+	target := &vaultTarget{
+		name:        cfg.Name,
+		namespace:   cfg.Namespace,
+		scheme:      cfg.Scheme,
+		port:        cfg.Port,
+		threshold:   cfg.Threshold,
+		sealCheck:   cfg.SealCheck,
+		inPlaceSeal: cfg.InPlaceSeal,
+		paused:      cfg.Paused,
+
+		custodyGroup: a.config.CustodyGroup,
+	}
+
+	if target.namespace == "" {
+		return nil, errors.New("no namespace provided")
+	}
+	if target.name == "" {
+		target.name = target.namespace
+	}
+	if target.scheme == "" {
+		target.scheme = defaultVaultScheme
+	}
+	if target.scheme != schemeHTTPS && !cfg.AllowPlaintext {
+		return nil, errPlaintextNotAllowed
+	}
+
+	tls, err := newTargetTLS(cfg.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tls config: %w", err)
+	}
+	target.tls = tls
+
+	target.attestation = newAttestation(cfg.Attestation)
+	if len(target.attestation.publicKeyPins) > 0 && target.scheme != schemeHTTPS {
+		return nil, errors.New("tls_public_key_sha256 requires the https scheme")
+	}
+	switch target.attestation.unknownImage {
+	case unknownImageRefuse, unknownImageApprove:
+		// Valid, do nothing
+	default:
+		return nil, fmt.Errorf("unknown unknown_image policy %q", target.attestation.unknownImage)
+	}
+
+	switch target.sealCheck {
+	case "":
+		target.sealCheck = sealCheckLabel
+	case sealCheckLabel, sealCheckAPI:
+		// Valid, do nothing
+	default:
+		return nil, fmt.Errorf("unknown seal check %q", target.sealCheck)
+	}
+
+	switch target.inPlaceSeal {
+	case "":
+		target.inPlaceSeal = inPlaceSealIgnore
+	case inPlaceSealIgnore, inPlaceSealUnseal, inPlaceSealApprove:
+		// Valid, do nothing
+	default:
+		return nil, fmt.Errorf("unknown in place seal policy %q", target.inPlaceSeal)
+	}
+
+	target.notifiers, err = newNotifiers(cfg.Notifiers)
+	if err != nil {
+		return nil, err
+	}
+
+	target.policy, err = newUnsealPolicy(cfg.Policy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+
+	target.init, err = newTargetInit(cfg.Init)
+	if err != nil {
+		return nil, fmt.Errorf("invalid init config: %w", err)
+	}
+
+	target.raftJoin, err = newTargetRaftJoin(cfg.RaftJoin)
+	if err != nil {
+		return nil, fmt.Errorf("invalid raft_join config: %w", err)
+	}
+
+	if target.custodyGroup != "" {
+		if err := validateCustody(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	selector, err := a.targetSelector(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	target.selector = selector
+
+	if ref := cfg.UnsealKeysSecret; ref != nil && ref.Name != "" {
+		if target.custodyGroup == "" && strings.Contains(ref.Name, custodyGroupPlaceholder) {
+			return nil, fmt.Errorf("unseal_keys_secret name contains %s, but no custody group is set", custodyGroupPlaceholder)
+		}
+
+		target.unsealKeysSecret = &secretRef{
+			namespace: ref.Namespace,
+			name:      strings.ReplaceAll(ref.Name, custodyGroupPlaceholder, target.custodyGroup),
+			dataKeys:  ref.Keys,
+		}
+		if target.unsealKeysSecret.namespace == "" {
+			target.unsealKeysSecret.namespace = k8s.DeployedNamespace()
+		}
+
+		// The init Secret also holds the root token, which must not be submitted as an unseal key.
+		if target.init.writesTo(target.unsealKeysSecret) && len(target.unsealKeysSecret.dataKeys) == 0 {
+			target.unsealKeysSecret.dataKeys = target.init.secretDataKeys()
+		}
+		return target, nil
+	}
+
+	target.unsealKeys, err = a.decrypter.DecryptAll(cfg.UnsealKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt unseal keys: %w", err)
+	}
+	if err := validateUnsealKeys(target.unsealKeys, target.threshold, false); err != nil {
+		return nil, err
+	}
+
+	return target, nil
+}
+
+// targetSelector determines which pods are Vault pods for the target. An explicit label selector takes precedence,
+// otherwise the selector of the target service is used.
+func (a *App) targetSelector(ctx context.Context, cfg *targetConfig) (labels.Selector, error) {
+	if cfg.LabelSelector != "" {
+		selector, err := labels.Parse(cfg.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label selector: %w", err)
+		}
+		return selector, nil
+	}
+
+	if cfg.Service == "" {
+		return nil, errors.New("one of label_selector or service must be provided")
+	}
+
+	svc, err := a.base.KubeClient().CoreV1().Services(cfg.Namespace).Get(ctx, cfg.Service, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target service %s/%s: %w", cfg.Namespace, cfg.Service, err)
+	}
+
+	if len(svc.Spec.Selector) == 0 {
+		return nil, fmt.Errorf("target service %s/%s has no selector, set a label selector instead", cfg.Namespace, cfg.Service)
+	}
+
+	return labels.SelectorFromSet(svc.Spec.Selector), nil
+}
+
+// withUnsealKeySources sets up the key source for every target, registering an informer for every Kubernetes Secret the
+// targets read their keys or CA bundle from. Custody groups read their keys from the API server instead.
+func (a *App) withUnsealKeySources() web.StartOption {
+	return func(base *web.App) error {
+		if a.targets.usesSecrets() {
+			a.newSecretInformers(base)
+		}
+
+		for _, t := range a.targets {
+			if t.tls.caSecret != nil {
+				t.tls.secrets = a.secretInformers[t.tls.caSecret.String()].lister
+			}
+
+			ref := t.unsealKeysSecret
+			if ref == nil {
+				t.keys = newMonitoredKeySource(t.name, staticKeySource(t.unsealKeys))
+				keySourceHealthy.WithLabelValues(t.name).Set(1)
+				continue
+			}
+
+			secrets := secretGetter(func(namespace, name string) (*core.Secret, error) {
+				return a.secretInformers[ref.String()].lister.Secrets(namespace).Get(name)
+			})
+			if t.custodyGroup != "" {
+				secrets = custodySecretGetter(base.KubeClient())
+			}
+
+			t.keys = newMonitoredKeySource(t.name, newSecretKeySource(
+				secrets,
+				a.decrypter,
+				ref.namespace,
+				ref.name,
+				ref.dataKeys,
+				t.threshold,
+				t.custodyGroup != "",
+			))
+		}
+		return nil
+	}
+}
+
+// withUnsealKeysSecretWatcher registers the task that keeps the unseal keys Secret cache up to date when any target
+// reads its keys from a Kubernetes Secret.
+func (a *App) withUnsealKeysSecretWatcher() web.StartOption {
+	return func(base *web.App) error {
+		if !a.targets.usesSecrets() {
+			return nil
+		}
+
+		return web.WithIndefiniteAsyncTask("watch-unseal-keys-secret", a.watchUnsealKeysSecret(
+			logging.LoggerWithComponent(base.Logger(), "watch-unseal-keys-secret"),
+		))(base)
+	}
+}
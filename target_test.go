@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+)
+
+// testViper creates a viper instance holding the YAML configuration.
+func testViper(t *testing.T, config string) *viper.Viper {
+	t.Helper()
+
+	vip := viper.New()
+	vip.SetConfigType("yaml")
+	if err := vip.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatalf("error reading config: %v", err)
+	}
+	return vip
+}
+
+func TestVaultTargets_ForPod(t *testing.T) {
+	t.Parallel()
+
+	// The first two targets overlap, as every pod of a is also matched by b.
+	a := testTarget(t, "vault", "app=vault,cluster=a")
+	a.name = "a"
+	b := testTarget(t, "vault", "app=vault")
+	b.name = "b"
+	c := testTarget(t, "vault-c", "app=vault")
+	c.name = "c"
+	targets := vaultTargets{a, b, c}
+
+	tests := []struct {
+		name      string
+		namespace string
+		labels    map[string]string
+		want      string
+	}{
+		{
+			name:      "only target matching",
+			namespace: "vault",
+			labels:    map[string]string{"app": "vault", "cluster": "b"},
+			want:      "b",
+		},
+		{
+			name:      "overlapping selectors pick the first target",
+			namespace: "vault",
+			labels:    map[string]string{"app": "vault", "cluster": "a"},
+			want:      "a",
+		},
+		{
+			name:      "same labels in another namespace",
+			namespace: "vault-c",
+			labels:    map[string]string{"app": "vault", "cluster": "a"},
+			want:      "c",
+		},
+		{
+			name:      "namespace mismatch",
+			namespace: "default",
+			labels:    map[string]string{"app": "vault"},
+		},
+		{
+			name:      "labels not matching",
+			namespace: "vault",
+			labels:    map[string]string{"app": "other"},
+		},
+		{
+			name:      "no labels",
+			namespace: "vault",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			pod := testPod("vault-0")
+			pod.Namespace = tt.namespace
+			pod.Labels = tt.labels
+
+			got := targets.ForPod(pod)
+			if tt.want == "" {
+				assert.Nil(t, got)
+				return
+			}
+			if assert.NotNil(t, got) {
+				assert.Equal(t, tt.want, got.name)
+			}
+		})
+	}
+
+	assert.Nil(t, vaultTargets(nil).ForPod(&core.Pod{}))
+}
+
+func TestApp_LoadTargets(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		config  string
+		app     *AppConfig
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "targets",
+			config: `
+targets:
+  - name: a
+    namespace: vault-a
+    label_selector: app=vault
+    unseal_keys: [key-0, key-1]
+    threshold: 2
+  - namespace: vault-b
+    label_selector: app=vault
+    scheme: http
+    allow_plaintext: true
+    seal_check: api
+    in_place_seal: unseal
+    unseal_keys: [key-0]
+`,
+			want: []string{
+				"a vault-a app=vault https label ignore",
+				"vault-b vault-b app=vault http api unseal",
+			},
+		},
+		{
+			name:   "environment without targets",
+			config: `unseal_keys: [key-0]`,
+			app: &AppConfig{
+				TargetService:      "vault",
+				VaultNamespace:     "vault-ns",
+				VaultLabelSelector: "app.kubernetes.io/name=vault",
+				SealCheck:          sealCheckAPI,
+			},
+			want: []string{"vault vault-ns app.kubernetes.io/name=vault https api ignore"},
+		},
+		{
+			name:    "empty targets",
+			config:  `targets: []`,
+			wantErr: "no targets provided",
+		},
+		{
+			name: "no namespace",
+			config: `
+targets:
+  - label_selector: app=vault
+    unseal_keys: [key-0]
+`,
+			wantErr: "invalid target 0: no namespace provided",
+		},
+		{
+			name: "duplicate name",
+			config: `
+targets:
+  - namespace: vault
+    label_selector: app=vault
+    unseal_keys: [key-0]
+  - name: vault
+    namespace: vault-b
+    label_selector: app=vault
+    unseal_keys: [key-0]
+`,
+			wantErr: "duplicate target name vault",
+		},
+		{
+			name: "plaintext not allowed",
+			config: `
+targets:
+  - namespace: vault
+    scheme: http
+    label_selector: app=vault
+    unseal_keys: [key-0]
+`,
+			wantErr: "invalid target 0: " + errPlaintextNotAllowed.Error(),
+		},
+		{
+			name: "pinned keys over plaintext",
+			config: `
+targets:
+  - namespace: vault
+    scheme: http
+    allow_plaintext: true
+    label_selector: app=vault
+    unseal_keys: [key-0]
+    attestation:
+      tls_public_key_sha256: [cGlu]
+`,
+			wantErr: "invalid target 0: tls_public_key_sha256 requires the https scheme",
+		},
+		{
+			name: "unknown seal check",
+			config: `
+targets:
+  - namespace: vault
+    label_selector: app=vault
+    seal_check: guess
+    unseal_keys: [key-0]
+`,
+			wantErr: `invalid target 0: unknown seal check "guess"`,
+		},
+		{
+			name: "unknown in place seal policy",
+			config: `
+targets:
+  - namespace: vault
+    label_selector: app=vault
+    in_place_seal: maybe
+    unseal_keys: [key-0]
+`,
+			wantErr: `invalid target 0: unknown in place seal policy "maybe"`,
+		},
+		{
+			name: "unknown image policy",
+			config: `
+targets:
+  - namespace: vault
+    label_selector: app=vault
+    unseal_keys: [key-0]
+    attestation:
+      unknown_image: allow
+`,
+			wantErr: `invalid target 0: unknown unknown_image policy "allow"`,
+		},
+		{
+			name: "client certificate without its key",
+			config: `
+targets:
+  - namespace: vault
+    label_selector: app=vault
+    unseal_keys: [key-0]
+    tls:
+      client_cert_file: /tls/tls.crt
+`,
+			wantErr: "invalid target 0: invalid tls config: both client_cert_file and client_key_file must be provided",
+		},
+		{
+			name: "invalid label selector",
+			config: `
+targets:
+  - namespace: vault
+    label_selector: "app in (vault"
+    unseal_keys: [key-0]
+`,
+			wantErr: "invalid target 0: failed to parse label selector: ",
+		},
+		{
+			name: "no selector or service",
+			config: `
+targets:
+  - namespace: vault
+    unseal_keys: [key-0]
+`,
+			wantErr: "invalid target 0: one of label_selector or service must be provided",
+		},
+		{
+			name: "fewer keys than the threshold",
+			config: `
+targets:
+  - namespace: vault
+    label_selector: app=vault
+    unseal_keys: [key-0]
+    threshold: 2
+`,
+			wantErr: "invalid target 0: 1 unseal keys provided, but the threshold is 2",
+		},
+		{
+			name: "no unseal keys",
+			config: `
+targets:
+  - namespace: vault
+    label_selector: app=vault
+`,
+			wantErr: "invalid target 0: no unseal keys provided",
+		},
+		{
+			name: "custody group placeholder without a custody group",
+			config: `
+targets:
+  - namespace: vault
+    label_selector: app=vault
+    unseal_keys_secret:
+      name: keys-{group}
+`,
+			wantErr: "invalid target 0: unseal_keys_secret name contains {group}, but no custody group is set",
+		},
+		{
+			name: "second target invalid",
+			config: `
+targets:
+  - namespace: vault
+    label_selector: app=vault
+    unseal_keys: [key-0]
+  - namespace: vault-b
+    label_selector: app=vault
+`,
+			wantErr: "invalid target 1: no unseal keys provided",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			config := tt.app
+			if config == nil {
+				config = new(AppConfig)
+			}
+			a := &App{config: config}
+
+			err := a.loadTargetsFrom(context.Background(), testViper(t, tt.config))
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				assert.Nil(t, a.targets, "no targets are loaded from an invalid config")
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			got := make([]string, 0, len(a.targets))
+			for _, target := range a.targets {
+				got = append(got, strings.Join([]string{
+					target.name,
+					target.namespace,
+					target.selector.String(),
+					target.scheme,
+					target.sealCheck,
+					target.inPlaceSeal,
+				}, " "))
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
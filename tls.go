@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/jacobbrewer1/web/k8s"
+	core "k8s.io/api/core/v1"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	// schemeHTTPS is the scheme used to talk to Vault over TLS.
+	schemeHTTPS = "https"
+
+	// defaultCASecretKey is the data key in the CA Secret holding the CA bundle if none is configured.
+	defaultCASecretKey = "ca.crt"
+)
+
+var (
+	// errPlaintextNotAllowed is returned when a target talks to Vault over plain HTTP without explicitly allowing it.
+	errPlaintextNotAllowed = errors.New("refusing to send unseal keys over plaintext, set allow_plaintext to allow it")
+)
+
+type (
+	// tlsConfig is the configuration of how a target talks to Vault over TLS.
+	tlsConfig struct {
+		CAFile         string           `mapstructure:"ca_file"`
+		CASecret       *secretRefConfig `mapstructure:"ca_secret"`
+		ClientCertFile string           `mapstructure:"client_cert_file"`
+		ClientKeyFile  string           `mapstructure:"client_key_file"`
+		ServerName     string           `mapstructure:"server_name"`
+	}
+
+	// targetTLS describes how a target verifies and authenticates to the Vault pods.
+	targetTLS struct {
+		// caFile is the path to the CA bundle used to verify the Vault pods.
+		caFile string
+
+		// caSecret references the Secret holding the CA bundle used to verify the Vault pods. The first data key is the
+		// key holding the bundle.
+		caSecret *secretRef
+
+		// clientCertFile is the path to the client certificate presented to the Vault pods.
+		clientCertFile string
+
+		// clientKeyFile is the path to the key of the client certificate.
+		clientKeyFile string
+
+		// serverName is the name the certificate of the Vault pod is verified against. The placeholders {pod} and
+		// {namespace} are replaced with the name and namespace of the pod.
+		serverName string
+
+		// secrets reads the CA Secret.
+		secrets listersv1.SecretLister
+	}
+)
+
+// newTargetTLS creates the TLS settings of a target from its configuration.
+func newTargetTLS(cfg *tlsConfig) (*targetTLS, error) {
+	if cfg == nil {
+		return new(targetTLS), nil
+	}
+
+	if (cfg.ClientCertFile == "") != (cfg.ClientKeyFile == "") {
+		return nil, errors.New("both client_cert_file and client_key_file must be provided")
+	}
+
+	t := &targetTLS{
+		caFile:         cfg.CAFile,
+		clientCertFile: cfg.ClientCertFile,
+		clientKeyFile:  cfg.ClientKeyFile,
+		serverName:     cfg.ServerName,
+	}
+
+	if ref := cfg.CASecret; ref != nil && ref.Name != "" {
+		key := defaultCASecretKey
+		if len(ref.Keys) > 0 {
+			key = ref.Keys[0]
+		}
+
+		t.caSecret = &secretRef{
+			namespace: ref.Namespace,
+			name:      ref.Name,
+			dataKeys:  []string{key},
+		}
+		if t.caSecret.namespace == "" {
+			t.caSecret.namespace = k8s.DeployedNamespace()
+		}
+	}
+
+	return t, nil
+}
+
+// vaultTLSConfig returns the TLS configuration used to talk to the given pod.
+func (t *targetTLS) vaultTLSConfig(pod *core.Pod) (*api.TLSConfig, error) {
+	cfg := &api.TLSConfig{
+		CACert:     t.caFile,
+		ClientCert: t.clientCertFile,
+		ClientKey:  t.clientKeyFile,
+	}
+
+	if t.serverName != "" {
+		cfg.TLSServerName = strings.NewReplacer(
+			"{pod}", pod.Name,
+			"{namespace}", pod.Namespace,
+		).Replace(t.serverName)
+	}
+
+	if t.caSecret != nil {
+		secret, err := t.secrets.Secrets(t.caSecret.namespace).Get(t.caSecret.name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting ca secret %s: %w", t.caSecret, err)
+		}
+
+		ca, ok := secret.Data[t.caSecret.dataKeys[0]]
+		if !ok {
+			return nil, fmt.Errorf("key %s not found in ca secret %s", t.caSecret.dataKeys[0], t.caSecret)
+		}
+		cfg.CACert = ""
+		cfg.CACertBytes = ca
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/jacobbrewer1/web/k8s"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	kubeCache "k8s.io/client-go/tools/cache"
+)
+
+// testSecretLister creates a Secret lister holding the Secrets.
+func testSecretLister(t *testing.T, secrets ...*core.Secret) listersv1.SecretLister {
+	t.Helper()
+
+	indexer := kubeCache.NewIndexer(kubeCache.MetaNamespaceKeyFunc, kubeCache.Indexers{})
+	for _, secret := range secrets {
+		if err := indexer.Add(secret); err != nil {
+			t.Fatalf("error adding secret: %v", err)
+		}
+	}
+	return listersv1.NewSecretLister(indexer)
+}
+
+func TestNewTargetTLS(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		cfg          *tlsConfig
+		wantCASecret *secretRef
+		wantErr      string
+	}{
+		{
+			name: "no config",
+		},
+		{
+			name: "client certificate and key",
+			cfg:  &tlsConfig{ClientCertFile: "/tls/tls.crt", ClientKeyFile: "/tls/tls.key"},
+		},
+		{
+			name:    "client certificate without its key",
+			cfg:     &tlsConfig{ClientCertFile: "/tls/tls.crt"},
+			wantErr: "both client_cert_file and client_key_file must be provided",
+		},
+		{
+			name:    "client key without its certificate",
+			cfg:     &tlsConfig{ClientKeyFile: "/tls/tls.key"},
+			wantErr: "both client_cert_file and client_key_file must be provided",
+		},
+		{
+			name:         "ca secret",
+			cfg:          &tlsConfig{CASecret: &secretRefConfig{Name: "vault-ca", Namespace: "vault"}},
+			wantCASecret: &secretRef{namespace: "vault", name: "vault-ca", dataKeys: []string{defaultCASecretKey}},
+		},
+		{
+			name: "ca secret with a key in the deployed namespace",
+			cfg:  &tlsConfig{CASecret: &secretRefConfig{Name: "vault-ca", Keys: []string{"bundle.pem", "other"}}},
+			wantCASecret: &secretRef{
+				namespace: k8s.DeployedNamespace(),
+				name:      "vault-ca",
+				dataKeys:  []string{"bundle.pem"},
+			},
+		},
+		{
+			name: "ca secret without a name",
+			cfg:  &tlsConfig{CASecret: &secretRefConfig{Namespace: "vault"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := newTargetTLS(tt.cfg)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.wantCASecret, got.caSecret)
+			}
+		})
+	}
+}
+
+func TestTargetTLS_VaultTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	secrets := testSecretLister(t,
+		&core.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "vault-ca", Namespace: "vault"},
+			Data:       map[string][]byte{defaultCASecretKey: []byte("ca from secret")},
+		},
+	)
+
+	pod := testPod("vault-0")
+
+	tests := []struct {
+		name    string
+		tls     *targetTLS
+		want    *api.TLSConfig
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			tls:  new(targetTLS),
+			want: new(api.TLSConfig),
+		},
+		{
+			name: "ca file and client certificate",
+			tls: &targetTLS{
+				caFile:         "/tls/ca.crt",
+				clientCertFile: "/tls/tls.crt",
+				clientKeyFile:  "/tls/tls.key",
+			},
+			want: &api.TLSConfig{CACert: "/tls/ca.crt", ClientCert: "/tls/tls.crt", ClientKey: "/tls/tls.key"},
+		},
+		{
+			name: "server name of the pod",
+			tls:  &targetTLS{serverName: "{pod}.vault-internal.{namespace}.svc"},
+			want: &api.TLSConfig{TLSServerName: "vault-0.vault-internal.vault.svc"},
+		},
+		{
+			name: "fixed server name",
+			tls:  &targetTLS{serverName: "vault.example.com"},
+			want: &api.TLSConfig{TLSServerName: "vault.example.com"},
+		},
+		{
+			name: "ca secret takes precedence over the ca file",
+			tls: &targetTLS{
+				caFile:   "/tls/ca.crt",
+				caSecret: &secretRef{namespace: "vault", name: "vault-ca", dataKeys: []string{defaultCASecretKey}},
+				secrets:  secrets,
+			},
+			want: &api.TLSConfig{CACertBytes: []byte("ca from secret")},
+		},
+		{
+			name: "ca secret not found",
+			tls: &targetTLS{
+				caSecret: &secretRef{namespace: "vault", name: "missing", dataKeys: []string{defaultCASecretKey}},
+				secrets:  secrets,
+			},
+			wantErr: `error getting ca secret vault/missing: secret "missing" not found`,
+		},
+		{
+			name: "key not found in the ca secret",
+			tls: &targetTLS{
+				caSecret: &secretRef{namespace: "vault", name: "vault-ca", dataKeys: []string{"bundle.pem"}},
+				secrets:  secrets,
+			},
+			wantErr: "key bundle.pem not found in ca secret vault/vault-ca",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := tt.tls.vaultTLSConfig(pod)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
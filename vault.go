@@ -2,46 +2,196 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log/slog"
+	"net/http"
 
 	"github.com/hashicorp/vault/api"
 	core "k8s.io/api/core/v1"
 )
 
-func unsealNewVaultPod(ctx context.Context, l *slog.Logger, target string, keys []string) error {
-	vc, err := newVaultClient(target)
+const (
+	// skipAlreadyUnsealed is the skip reason when the pod was unsealed before any keys were submitted.
+	skipAlreadyUnsealed = "already_unsealed"
+
+	// skipNotInitialized is the skip reason when Vault has not been initialized, so there is nothing to unseal.
+	skipNotInitialized = "not_initialized"
+)
+
+// unsealRecorder is told about every action taken against a Vault pod while unsealing it. keyIndex is the index of the
+// submitted key in the keys of the target. An error means the action could not be recorded, and nothing more may be
+// done to the pod.
+type unsealRecorder func(action string, keyIndex int, status *api.SealStatusResponse, err error) error
+
+// unsealSkip is an error that deliberately skips unsealing a pod for the given reason.
+type unsealSkip struct {
+	reason  string
+	message string
+}
+
+// skipUnseal returns an error that skips unsealing the pod.
+func skipUnseal(reason, message string) error {
+	return &unsealSkip{
+		reason:  reason,
+		message: message,
+	}
+}
+
+// Error returns the reason the unseal was skipped.
+func (e *unsealSkip) Error() string {
+	return e.message
+}
+
+// unsealNewVaultPod unseals the Vault pod using as many of the keys as the pod's reported threshold requires. A partial
+// unseal left behind by an earlier attempt is reset first, as the keys it was given are unknown. Every reset and key
+// submission is passed to record, and the intent to submit a key is recorded before the key is sent. The unseal stops if
+// anything cannot be recorded, so no key is released without a record of it. The last seal status reported by the pod
+// is returned.
+//
+// If the keys are partial, i.e. held by a custody group, every key is added to the progress submitted by the other
+// groups, and the unseal is skipped if the pod still needs their keys. The keys are not submitted again while the
+// unseal with the submitted nonce, the one the group last gave its keys to, is still in progress.
+func unsealNewVaultPod(
+	ctx context.Context,
+	l *slog.Logger,
+	vc *api.Client,
+	keys []string,
+	partial bool,
+	submitted string,
+	record unsealRecorder,
+) (*api.SealStatusResponse, error) {
+	status, err := vaultSealStatus(ctx, vc)
 	if err != nil {
-		return fmt.Errorf("error creating vault client: %w", err)
+		return nil, withReason(reasonSealStatus, err)
 	}
 
-	for _, key := range keys {
+	if !status.Initialized {
+		return status, skipUnseal(skipNotInitialized, "vault is not initialized")
+	}
+
+	if !status.Sealed {
+		return status, skipUnseal(skipAlreadyUnsealed, "vault is already unsealed")
+	}
+
+	if err := validateUnsealKeysForStatus(keys, status, partial); err != nil {
+		return status, withReason(reasonInvalidKeys, err)
+	}
+
+	if partial && submitted != "" && status.Progress > 0 && status.Nonce == submitted {
+		return status, skipUnseal(skipAwaitingCustodians, fmt.Sprintf(
+			"unseal keys already submitted, waiting for other custody groups to submit %d more",
+			status.T-status.Progress,
+		))
+	}
+
+	if status.Progress > 0 && !partial {
+		l.Warn("Resetting stale unseal progress",
+			slog.String(loggingKeyProgress, fmt.Sprintf("%d/%d", status.Progress, status.T)),
+		)
+
+		status, err = vc.Sys().ResetUnsealProcessWithContext(ctx)
+		if recordErr := record(auditActionReset, 0, status, err); recordErr != nil {
+			return status, withReason(reasonAudit, recordErr)
+		}
+		if err != nil {
+			return nil, withReason(reasonReset, fmt.Errorf("error resetting unseal progress: %w", err))
+		}
+	}
+
+	if !partial {
+		keys = keys[:status.T]
+	}
+
+	for i, key := range keys {
+		if err := record(auditActionIntent, i, status, nil); err != nil {
+			return status, withReason(reasonAudit, err)
+		}
+
 		resp, err := vc.Sys().UnsealWithContext(ctx, key)
+		if recordErr := record(auditActionSubmit, i, resp, err); recordErr != nil {
+			return status, withReason(reasonAudit, recordErr)
+		}
 		if err != nil {
-			return fmt.Errorf("error unsealing vault: %w", err)
+			return status, withReason(reasonUnseal, fmt.Errorf("error unsealing vault: %w", err))
 		}
+		status = resp
 
 		l.Debug(
 			"Unsealing vault",
-			slog.Bool(loggingKeySealed, resp.Sealed),
-			slog.String(loggingKeyProgress, fmt.Sprintf("%d/%d", resp.Progress, resp.T)),
+			slog.Bool(loggingKeySealed, status.Sealed),
+			slog.String(loggingKeyProgress, fmt.Sprintf("%d/%d", status.Progress, status.T)),
 		)
 
-		if resp.Sealed {
-			continue
+		if !status.Sealed {
+			l.Debug("Vault unsealed")
+			return status, nil
 		}
+	}
+
+	if partial {
+		return status, skipUnseal(skipAwaitingCustodians, fmt.Sprintf(
+			"submitted %d unseal keys, waiting for other custody groups to submit %d more",
+			len(keys), status.T-status.Progress,
+		))
+	}
+
+	return status, withReason(reasonStillSealed, fmt.Errorf("vault still sealed after submitting %d unseal keys", status.T))
+}
+
+// vaultSealStatus asks the Vault pod for its seal status.
+func vaultSealStatus(ctx context.Context, vc *api.Client) (*api.SealStatusResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, sealStatusTimeout)
+	defer cancel()
+
+	status, err := vc.Sys().SealStatusWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting seal status: %w", err)
+	}
 
-		l.Debug("Vault unsealed")
-		break
+	return status, nil
+}
+
+// newPodVaultClient creates a client that talks to the given Vault pod of the target. Clients for targets using plain
+// http are only created if the target explicitly allows it.
+func newPodVaultClient(target *vaultTarget, pod *core.Pod) (*api.Client, error) {
+	addr := generateVaultAddress(target, pod.Spec.Containers[0].Ports, pod.Status.PodIP)
+	if target.scheme != schemeHTTPS {
+		return newVaultClient(addr, nil, nil)
 	}
 
-	return nil
+	tlsConfig, err := target.tls.vaultTLSConfig(pod)
+	if err != nil {
+		return nil, fmt.Errorf("error creating tls config: %w", err)
+	}
+
+	return newVaultClient(addr, tlsConfig, target.attestation.verifyConnection())
 }
 
-func newVaultClient(addr string) (*api.Client, error) {
+// newVaultClient creates a client that talks to Vault at the given address. If verifyConnection is set, it is called
+// after the server certificate has been verified on every connection.
+func newVaultClient(
+	addr string,
+	tlsConfig *api.TLSConfig,
+	verifyConnection func(tls.ConnectionState) error,
+) (*api.Client, error) {
 	config := api.DefaultConfig()
 	config.Address = addr
 
+	if tlsConfig != nil {
+		if err := config.ConfigureTLS(tlsConfig); err != nil {
+			return nil, fmt.Errorf("error configuring tls: %w", err)
+		}
+	}
+
+	if verifyConnection != nil {
+		transport, ok := config.HttpClient.Transport.(*http.Transport)
+		if !ok {
+			return nil, fmt.Errorf("unsupported transport type %T", config.HttpClient.Transport)
+		}
+		transport.TLSClientConfig.VerifyConnection = verifyConnection
+	}
+
 	client, err := api.NewClient(config)
 	if err != nil {
 		return nil, fmt.Errorf("error creating vault client: %w", err)
@@ -50,12 +200,17 @@ func newVaultClient(addr string) (*api.Client, error) {
 	return client, nil
 }
 
-func generateVaultAddress(ports []core.ContainerPort, ip string) string {
-	const targetScheme = "http"
+// generateVaultAddress generates the address of the Vault pod for the target. The port configured on the target takes
+// precedence over the container port named after the scheme.
+func generateVaultAddress(target *vaultTarget, ports []core.ContainerPort, ip string) string {
+	if target.port != 0 {
+		return fmt.Sprintf("%s://%s:%d", target.scheme, ip, target.port)
+	}
+
 	for _, port := range ports {
-		if port.Name == targetScheme {
-			return fmt.Sprintf("%s://%s:%d", port.Name, ip, port.ContainerPort)
+		if port.Name == target.scheme {
+			return fmt.Sprintf("%s://%s:%d", target.scheme, ip, port.ContainerPort)
 		}
 	}
-	return fmt.Sprintf("%s://%s:8200", targetScheme, ip) // Default to 8200 on http.
+	return fmt.Sprintf("%s://%s:%d", target.scheme, ip, defaultVaultPort) // Default to 8200 on the target scheme.
 }
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeVault is a Vault server that only implements the seal status and unseal endpoints. Every key it is given counts
+// towards the threshold, and Vault is unsealed once the threshold is met unless the keys are wrong. Every unseal is
+// given a new nonce when its first key is submitted.
+type fakeVault struct {
+	mu        sync.Mutex
+	status    api.SealStatusResponse
+	wrongKeys bool
+	submitted []string
+	resets    int
+	nonces    int
+}
+
+// newFakeVault starts a fakeVault reporting the given seal status, returning a client that talks to it.
+func newFakeVault(t *testing.T, status api.SealStatusResponse) (*fakeVault, *api.Client) {
+	t.Helper()
+
+	fv := &fakeVault{status: status}
+	srv := httptest.NewServer(http.HandlerFunc(fv.serveHTTP))
+	t.Cleanup(srv.Close)
+
+	config := api.DefaultConfig()
+	config.Address = srv.URL
+	config.MaxRetries = 0
+	vc, err := api.NewClient(config)
+	if err != nil {
+		t.Fatalf("error creating vault client: %v", err)
+	}
+	return fv, vc
+}
+
+func (fv *fakeVault) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/sys/seal-status":
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/sys/unseal":
+		var req struct {
+			Key   string `json:"key"`
+			Reset bool   `json:"reset"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.Reset {
+			fv.resets++
+			fv.status.Progress = 0
+			fv.status.Nonce = ""
+			break
+		}
+
+		fv.submitted = append(fv.submitted, req.Key)
+		if fv.status.Progress == 0 {
+			fv.nonces++
+			fv.status.Nonce = fmt.Sprintf("nonce-%d", fv.nonces)
+		}
+		fv.status.Progress++
+		if fv.status.Progress >= fv.status.T {
+			fv.status.Progress = 0
+			fv.status.Nonce = ""
+			fv.status.Sealed = fv.wrongKeys
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(fv.status)
+}
+
+func TestValidateUnsealKeysForStatus(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		keys    int
+		status  api.SealStatusResponse
+		partial bool
+		wantErr string
+	}{
+		{
+			name:   "exactly the threshold",
+			keys:   3,
+			status: api.SealStatusResponse{T: 3, N: 5},
+		},
+		{
+			name:   "more than the threshold",
+			keys:   5,
+			status: api.SealStatusResponse{T: 3, N: 5},
+		},
+		{
+			name:    "fewer than the threshold",
+			keys:    2,
+			status:  api.SealStatusResponse{T: 3, N: 5},
+			wantErr: "2 unseal keys provided, but vault requires 3",
+		},
+		{
+			name:    "more than the key shares",
+			keys:    6,
+			status:  api.SealStatusResponse{T: 3, N: 5},
+			wantErr: "6 unseal keys provided, but vault only has 5 key shares",
+		},
+		{
+			name:    "invalid threshold",
+			keys:    3,
+			status:  api.SealStatusResponse{T: 0, N: 5},
+			wantErr: "vault reported an invalid threshold of 0",
+		},
+		{
+			name:   "unknown key shares",
+			keys:   6,
+			status: api.SealStatusResponse{T: 3},
+		},
+		{
+			name:    "partial keys fewer than the threshold",
+			keys:    2,
+			status:  api.SealStatusResponse{T: 3, N: 5},
+			partial: true,
+		},
+		{
+			name:    "partial keys meeting the threshold",
+			keys:    3,
+			status:  api.SealStatusResponse{T: 3, N: 5},
+			partial: true,
+			wantErr: "3 unseal keys provided, but a custody group must hold fewer than the 3 vault requires",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			keys := make([]string, tt.keys)
+			err := validateUnsealKeysForStatus(keys, &tt.status, tt.partial)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestUnsealNewVaultPod(t *testing.T) {
+	t.Parallel()
+
+	keys := []string{"key-0", "key-1", "key-2", "key-3", "key-4"}
+
+	tests := []struct {
+		name          string
+		status        api.SealStatusResponse
+		keys          []string
+		partial       bool
+		submitted     string
+		wantSubmitted []string
+		wantResets    int
+		wantSealed    bool
+		wantReason    string
+		wantSkip      string
+	}{
+		{
+			name:          "keys are truncated to the threshold",
+			status:        api.SealStatusResponse{Initialized: true, Sealed: true, T: 3, N: 5},
+			keys:          keys,
+			wantSubmitted: []string{"key-0", "key-1", "key-2"},
+		},
+		{
+			name:          "threshold of one",
+			status:        api.SealStatusResponse{Initialized: true, Sealed: true, T: 1, N: 1},
+			keys:          keys[:1],
+			wantSubmitted: []string{"key-0"},
+		},
+		{
+			name:          "stale progress is reset",
+			status:        api.SealStatusResponse{Initialized: true, Sealed: true, T: 3, N: 5, Progress: 2},
+			keys:          keys,
+			wantSubmitted: []string{"key-0", "key-1", "key-2"},
+			wantResets:    1,
+		},
+		{
+			name:       "fewer keys than the threshold",
+			status:     api.SealStatusResponse{Initialized: true, Sealed: true, T: 3, N: 5},
+			keys:       keys[:2],
+			wantSealed: true,
+			wantReason: reasonInvalidKeys,
+		},
+		{
+			name:     "already unsealed",
+			status:   api.SealStatusResponse{Initialized: true, T: 3, N: 5},
+			keys:     keys,
+			wantSkip: skipAlreadyUnsealed,
+		},
+		{
+			name:       "not initialized",
+			status:     api.SealStatusResponse{Sealed: true},
+			keys:       keys,
+			wantSealed: true,
+			wantSkip:   skipNotInitialized,
+		},
+		{
+			name:          "partial keys are added to the progress of other groups",
+			status:        api.SealStatusResponse{Initialized: true, Sealed: true, T: 3, N: 5, Progress: 1},
+			keys:          keys[:1],
+			partial:       true,
+			wantSubmitted: []string{"key-0"},
+			wantSealed:    true,
+			wantSkip:      skipAwaitingCustodians,
+		},
+		{
+			name:       "partial keys already submitted to the unseal in progress",
+			status:     api.SealStatusResponse{Initialized: true, Sealed: true, T: 3, N: 5, Progress: 2, Nonce: "nonce-a"},
+			keys:       keys[:1],
+			partial:    true,
+			submitted:  "nonce-a",
+			wantSealed: true,
+			wantSkip:   skipAwaitingCustodians,
+		},
+		{
+			name:          "partial keys submitted to another unseal",
+			status:        api.SealStatusResponse{Initialized: true, Sealed: true, T: 3, N: 5, Progress: 1, Nonce: "nonce-b"},
+			keys:          keys[:1],
+			partial:       true,
+			submitted:     "nonce-a",
+			wantSubmitted: []string{"key-0"},
+			wantSealed:    true,
+			wantSkip:      skipAwaitingCustodians,
+		},
+		{
+			name:          "partial keys submitted to an unseal whose progress was discarded",
+			status:        api.SealStatusResponse{Initialized: true, Sealed: true, T: 3, N: 5},
+			keys:          keys[:1],
+			partial:       true,
+			submitted:     "nonce-a",
+			wantSubmitted: []string{"key-0"},
+			wantSealed:    true,
+			wantSkip:      skipAwaitingCustodians,
+		},
+		{
+			name:          "partial keys complete the threshold",
+			status:        api.SealStatusResponse{Initialized: true, Sealed: true, T: 3, N: 5, Progress: 1},
+			keys:          keys[:2],
+			partial:       true,
+			wantSubmitted: []string{"key-0", "key-1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			fv, vc := newFakeVault(t, tt.status)
+
+			var recorded []string
+			record := func(action string, keyIndex int, status *api.SealStatusResponse, err error) error {
+				recorded = append(recorded, action)
+				return nil
+			}
+
+			status, err := unsealNewVaultPod(
+				context.Background(),
+				slog.New(slog.DiscardHandler),
+				vc,
+				tt.keys,
+				tt.partial,
+				tt.submitted,
+				record,
+			)
+
+			var skip *unsealSkip
+			switch {
+			case tt.wantSkip != "":
+				if assert.ErrorAs(t, err, &skip) {
+					assert.Equal(t, tt.wantSkip, skip.reason)
+				}
+			case tt.wantReason != "":
+				assert.Error(t, err)
+				assert.Equal(t, tt.wantReason, failureReason(err))
+			default:
+				assert.NoError(t, err)
+			}
+			if status != nil {
+				assert.Equal(t, tt.wantSealed, status.Sealed)
+			}
+
+			assert.Equal(t, tt.wantSubmitted, fv.submitted)
+			assert.Equal(t, tt.wantResets, fv.resets)
+
+			wantRecorded := make([]string, 0, tt.wantResets+2*len(tt.wantSubmitted))
+			for range tt.wantResets {
+				wantRecorded = append(wantRecorded, auditActionReset)
+			}
+			for range tt.wantSubmitted {
+				wantRecorded = append(wantRecorded, auditActionIntent, auditActionSubmit)
+			}
+			if len(wantRecorded) == 0 {
+				wantRecorded = nil
+			}
+			assert.Equal(t, wantRecorded, recorded)
+		})
+	}
+}
+
+func TestUnsealNewVaultPod_StillSealed(t *testing.T) {
+	t.Parallel()
+
+	// The keys are accepted but Vault stays sealed, e.g. as they belong to another cluster.
+	fv, vc := newFakeVault(t, api.SealStatusResponse{Initialized: true, Sealed: true, T: 3, N: 5})
+	fv.wrongKeys = true
+
+	status, err := unsealNewVaultPod(
+		context.Background(),
+		slog.New(slog.DiscardHandler),
+		vc,
+		[]string{"key-0", "key-1", "key-2", "key-3", "key-4"},
+		false,
+		"",
+		func(string, int, *api.SealStatusResponse, error) error { return nil },
+	)
+	assert.EqualError(t, err, "vault still sealed after submitting 3 unseal keys")
+	assert.Equal(t, reasonStillSealed, failureReason(err))
+	assert.True(t, status.Sealed)
+	assert.Equal(t, []string{"key-0", "key-1", "key-2"}, fv.submitted)
+}
+
+func TestUnsealNewVaultPod_AuditFailure(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		failAction    string
+		failKeyIndex  int
+		progress      int
+		wantSubmitted []string
+	}{
+		{
+			name:          "intent of the first key",
+			failAction:    auditActionIntent,
+			failKeyIndex:  0,
+			wantSubmitted: nil,
+		},
+		{
+			name:          "intent of a later key",
+			failAction:    auditActionIntent,
+			failKeyIndex:  1,
+			wantSubmitted: []string{"key-0"},
+		},
+		{
+			name:          "submit of a key",
+			failAction:    auditActionSubmit,
+			failKeyIndex:  0,
+			wantSubmitted: []string{"key-0"},
+		},
+		{
+			name:          "reset",
+			failAction:    auditActionReset,
+			progress:      1,
+			wantSubmitted: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			fv, vc := newFakeVault(t, api.SealStatusResponse{
+				Initialized: true,
+				Sealed:      true,
+				T:           3,
+				N:           5,
+				Progress:    tt.progress,
+			})
+
+			_, err := unsealNewVaultPod(
+				context.Background(),
+				slog.New(slog.DiscardHandler),
+				vc,
+				[]string{"key-0", "key-1", "key-2"},
+				false,
+				"",
+				func(action string, keyIndex int, _ *api.SealStatusResponse, _ error) error {
+					if action == tt.failAction && keyIndex == tt.failKeyIndex {
+						return errors.New("disk full")
+					}
+					return nil
+				},
+			)
+			assert.EqualError(t, err, "disk full")
+			assert.Equal(t, reasonAudit, failureReason(err))
+			assert.Equal(t, tt.wantSubmitted, fv.submitted)
+		})
+	}
+}